@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+// rootApplication returns the application rendering the root of the tree
+// when it is a Helm chart generating the root applications, e.g. a bootstrap
+// chart. It's named after the root directory and rendered like any other
+// application, so the root applications are found in its output. It returns
+// nil when renderRoot isn't set or inputPath has no Chart.yaml.
+func (w *Walker) rootApplication(inputPath string) (*v1alpha1.Application, error) {
+	if !w.renderRoot {
+		return nil, nil
+	}
+	_, err := os.Stat(filepath.Join(inputPath, "Chart.yaml"))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Plain application manifests, walked like without renderRoot.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	abs, err := filepath.Abs(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	root := &v1alpha1.Application{}
+	root.Kind = "Application"
+	root.ObjectMeta.Name = filepath.Base(abs)
+	root.Spec.Source = &v1alpha1.ApplicationSource{
+		Path: inputPath,
+		Helm: &v1alpha1.ApplicationSourceHelm{},
+	}
+	return root, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestWalkRenderRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "bootstrap")
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "Chart.yaml"), []byte("apiVersion: v2\nname: bootstrap\nversion: 0.1.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeApplications(t, root, "plain.yaml", "plain")
+
+	walk := func(renderRoot bool, maxDepth int) (*fakeRenderer, string) {
+		t.Helper()
+		output := t.TempDir()
+		render := &fakeRenderer{t: t, children: map[string][]string{"bootstrap": {"team-a", "team-b"}}}
+		w := &Walker{
+			CopySource:   render.Render,
+			HelmTemplate: render.Render,
+			GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+				return "hash", nil
+			},
+			ignoreSuffix: "-ignore",
+			renderRoot:   renderRoot,
+		}
+		if _, err := w.Walk(context.Background(), root, output, maxDepth, NewMemoryHashStore()); err != nil {
+			t.Fatal(err)
+		}
+		return render, output
+	}
+
+	render, output := walk(true, 0)
+	if expected := []string{"bootstrap", "team-a", "team-b"}; !reflect.DeepEqual(render.rendered, expected) {
+		t.Errorf("expected the root chart and the applications it renders to be rendered %v got: %v", expected, render.rendered)
+	}
+	if _, err := os.Stat(filepath.Join(output, "bootstrap", "apps.yaml")); err != nil {
+		t.Errorf("expected the output of the root chart to be kept: %v", err)
+	}
+
+	render, _ = walk(false, InfiniteDepth)
+	if expected := []string{"plain"}; !reflect.DeepEqual(render.rendered, expected) {
+		t.Errorf("expected the root to be scanned as is without -render-root %v got: %v", expected, render.rendered)
+	}
+
+	if err := os.Remove(filepath.Join(root, "Chart.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	render, _ = walk(true, InfiniteDepth)
+	if expected := []string{"plain"}; !reflect.DeepEqual(render.rendered, expected) {
+		t.Errorf("expected a root without a chart to be scanned as is %v got: %v", expected, render.rendered)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/chime/mani-diffy/pkg/helm"
+)
+
+// changeSet holds the files changed since a git ref, relative to the working
+// directory.
+type changeSet struct {
+	files []string
+}
+
+// changedSince returns the files in dir that differ from ref, including
+// uncommitted changes. Untracked files are not part of it.
+func changedSince(ctx context.Context, dir, ref string) (*changeSet, error) {
+	out, err := git(ctx, dir, "diff", "--name-only", "--relative", ref, "--")
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &changeSet{}
+	for _, file := range strings.Split(out, "\n") {
+		if file != "" {
+			changes.add(file)
+		}
+	}
+	return changes, nil
+}
+
+// add records that path changed. A directory counts as changed as a whole.
+func (c *changeSet) add(path string) {
+	c.files = append(c.files, filepath.Clean(path))
+}
+
+// touches reports whether path, or any file below it when it is a directory,
+// changed.
+func (c *changeSet) touches(path string) bool {
+	if path == "" {
+		return false
+	}
+	path = filepath.Clean(path)
+	for _, file := range c.files {
+		if file == path || strings.HasPrefix(file, path+string(filepath.Separator)) || strings.HasPrefix(path, file+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// affects reports whether application, defined in source, has to be rendered
+// again: when source, the path of one of its sources, or one of the value or
+// parameter files they reference changed.
+func (c *changeSet) affects(application *v1alpha1.Application, source string) bool {
+	if c.touches(source) {
+		return true
+	}
+
+	sources, err := helm.Sources(application)
+	if err != nil {
+		// Let the render report the error.
+		return true
+	}
+
+	for _, app := range sources {
+		s := app.Spec.Source
+		if c.touches(s.Path) {
+			return true
+		}
+		if s.Helm == nil {
+			continue
+		}
+		for _, valueFile := range s.Helm.ValueFiles {
+			if c.touches(helm.ValueFilePath(s, valueFile)) {
+				return true
+			}
+		}
+		for _, parameter := range s.Helm.FileParameters {
+			if c.touches(filepath.Join(s.Path, parameter.Path)) {
+				return true
+			}
+		}
+	}
+	return false
+}
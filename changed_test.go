@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+const changedApplications = `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: parent
+spec:
+  source:
+    path: charts/parent
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: other
+spec:
+  source:
+    path: charts/other
+    helm:
+      valueFiles:
+        - ../../values/other.yaml
+`
+
+func TestWalkChangedSince(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "apps.yaml"), []byte(changedApplications), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var rendered []string
+	render := func(_ context.Context, application *v1alpha1.Application, output string) error {
+		rendered = append(rendered, application.ObjectMeta.Name)
+		if err := os.MkdirAll(output, os.ModePerm); err != nil {
+			return err
+		}
+		if application.ObjectMeta.Name == "parent" {
+			child := "apiVersion: argoproj.io/v1alpha1\nkind: Application\nmetadata:\n  name: child\nspec:\n  source:\n    path: charts/child\n"
+			return os.WriteFile(filepath.Join(output, "apps.yaml"), []byte(child), 0644)
+		}
+		return nil
+	}
+	w := &Walker{
+		CopySource:   render,
+		HelmTemplate: render,
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	walk := func() {
+		t.Helper()
+		rendered = nil
+		// Start from an empty store every time, so nothing is cached.
+		hashes, err := NewJSONHashStore(filepath.Join(t.TempDir(), "hashes.json"), HashStrategyReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, hashes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk()
+
+	for _, tc := range []struct {
+		changed  []string
+		expected []string
+	}{
+		{changed: []string{"values/other.yaml"}, expected: []string{"other"}},
+		{changed: []string{"charts/child/values.yaml"}, expected: []string{"child"}},
+		// The parent defines the child, which is checked once it's rendered.
+		{changed: []string{"charts/parent/templates/child.yaml"}, expected: []string{"parent", "child"}},
+		{changed: []string{filepath.Join(root, "apps.yaml")}, expected: []string{"parent", "child", "other"}},
+		{changed: []string{"README.md"}},
+	} {
+		w.changed = &changeSet{}
+		for _, file := range tc.changed {
+			w.changed.add(file)
+		}
+		walk()
+		if !reflect.DeepEqual(rendered, tc.expected) {
+			t.Errorf("expected %v to be rendered when %v changed got: %v", tc.expected, tc.changed, rendered)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(output, "child")); err != nil {
+		t.Errorf("expected the output of unaffected apps to be kept: %v", err)
+	}
+}
+
+func TestChangedSince(t *testing.T) {
+	repo := t.TempDir()
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"config", "user.name", "test"},
+		{"config", "user.email", "test@example.com"},
+		{"commit", "--quiet", "--allow-empty", "--message", "base"},
+	} {
+		if _, err := git(ctx, repo, args...); err != nil {
+			t.Skip(err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(repo, "charts", "app"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "charts", "app", "values.yaml"), []byte("replicas: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"add", "--all"},
+		{"commit", "--quiet", "--message", "add app"},
+	} {
+		if _, err := git(ctx, repo, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, err := changedSince(ctx, repo, "HEAD~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{filepath.Join("charts", "app", "values.yaml")}; !reflect.DeepEqual(changes.files, expected) {
+		t.Errorf("expected %v to have changed got: %v", expected, changes.files)
+	}
+	if !changes.touches("charts/app") || changes.touches("charts/other") {
+		t.Errorf("expected only the app chart to be touched got: %v", changes.files)
+	}
+
+	if _, err := changedSince(ctx, repo, "unknown-ref"); err == nil {
+		t.Error("expected an unknown ref to fail")
+	}
+}
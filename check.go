@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chime/mani-diffy/pkg/directory"
+)
+
+// Drift is the difference between the committed output of an application and
+// what it renders to.
+type Drift struct {
+	App  string
+	Diff string
+}
+
+// Check renders the tree rooted at inputPath into a copy of outputPath and
+// returns the drift of every application whose output would change. Every
+// application is rendered regardless of its hash, so hand edits to the output
+// are caught as well. outputPath itself is left untouched.
+func (w *Walker) Check(ctx context.Context, inputPath, outputPath string, maxDepth int) ([]Drift, error) {
+	tmp, err := os.MkdirTemp("", "mani-diffy-check-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	rendered := filepath.Join(tmp, "output")
+	if err := directory.Copy(outputPath, rendered, nil); err != nil {
+		return nil, err
+	}
+
+	check := *w
+	check.Diff = nil
+	// The copy isn't the committed output.
+	check.digests = nil
+	if _, err := check.Walk(ctx, inputPath, rendered, maxDepth, noHashStore{}); err != nil {
+		return nil, err
+	}
+
+	before, err := readApps(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	after, err := readApps(rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make([]string, 0, len(before)+len(after))
+	for app := range before {
+		apps = append(apps, app)
+	}
+	for app := range after {
+		if _, ok := before[app]; !ok {
+			apps = append(apps, app)
+		}
+	}
+	sort.Strings(apps)
+
+	var drifts []Drift
+	for _, app := range apps {
+		diff, err := unifiedDiff(app, before[app], after[app])
+		if err != nil {
+			return nil, err
+		}
+		if diff != "" {
+			drifts = append(drifts, Drift{App: app, Diff: diff})
+		}
+	}
+	return drifts, nil
+}
+
+// readApps reads the output of every application in outputPath, keyed by the
+// application's name. Files at the root of outputPath, like the hash stores,
+// don't belong to an application and are left out.
+func readApps(outputPath string) (map[string]map[string]string, error) {
+	files, err := readFiles(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make(map[string]map[string]string)
+	for path, content := range files {
+		app, file, ok := strings.Cut(filepath.ToSlash(path), "/")
+		if !ok {
+			continue
+		}
+		if apps[app] == nil {
+			apps[app] = make(map[string]string)
+		}
+		apps[app][file] = content
+	}
+	return apps, nil
+}
+
+// noHashStore is a HashStore that never matches, so every application is
+// rendered.
+type noHashStore struct{}
+
+func (noHashStore) Add(string, string) error   { return nil }
+func (noHashStore) Get(string) (string, error) { return "", nil }
+func (noHashStore) Save() error                { return nil }
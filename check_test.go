@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestCheck(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "edited", "untouched")
+
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			if err := os.MkdirAll(output, os.ModePerm); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte("name: "+application.ObjectMeta.Name+"\n"), 0644)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewSumFileStore(output, HashStrategyReadWrite)); err != nil {
+		t.Fatal(err)
+	}
+
+	drifts, err := w.Check(context.Background(), root, output, InfiniteDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 0 {
+		t.Errorf("expected no drift got: %+v", drifts)
+	}
+
+	// Hand edit the output and leave behind the output of a removed app.
+	manifest := filepath.Join(output, "edited", "manifest.yaml")
+	if err := os.WriteFile(manifest, []byte("name: hand-edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(output, "removed"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(output, "removed", "manifest.yaml"), []byte("name: removed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	drifts, err = w.Check(context.Background(), root, output, InfiniteDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apps []string
+	for _, drift := range drifts {
+		apps = append(apps, drift.App)
+	}
+	if expected := []string{"edited", "removed"}; !reflect.DeepEqual(apps, expected) {
+		t.Fatalf("expected %v to drift got: %v", expected, apps)
+	}
+	if !strings.Contains(drifts[0].Diff, "-name: hand-edited\n+name: edited\n") {
+		t.Errorf("unexpected diff got:\n%s", drifts[0].Diff)
+	}
+
+	// The check never writes to the output.
+	if b, _ := os.ReadFile(manifest); string(b) != "name: hand-edited\n" {
+		t.Errorf("expected the output to be left untouched got: %s", b)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cleanOutput removes everything in outputPath, so the walk renders every
+// application from scratch. The directory itself and its lock file are kept,
+// since the walk locked them first. It refuses to clean the root of the
+// filesystem, the home directory, and the working directory or any of its
+// parents, which is where the sources usually are.
+func cleanOutput(outputPath string) error {
+	path, err := filepath.Abs(outputPath)
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		if resolved, err := filepath.EvalSymlinks(home); err == nil && resolved == path {
+			return fmt.Errorf("refusing to clean %s, it is the home directory", outputPath)
+		}
+	}
+
+	// The root of the filesystem holds the working directory too.
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(wd); err == nil {
+		wd = resolved
+	}
+	if rel, err := filepath.Rel(path, wd); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to clean %s, it holds the working directory", outputPath)
+	}
+
+	slog.Info("Cleaning output", "path", outputPath)
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == lockFileName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanHashStore forgets the hashes of a HashStore, so every application is
+// rendered again, while still saving the new hashes.
+type cleanHashStore struct {
+	HashStore
+}
+
+func (cleanHashStore) Get(string) (string, error) {
+	return "", nil
+}
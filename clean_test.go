@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanOutput(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := t.TempDir()
+	if err := os.Chdir(repo); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	output := filepath.Join(repo, ".zz.auto-generated")
+	if err := os.MkdirAll(filepath.Join(output, "app"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := cleanOutput(".zz.auto-generated"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(output); err != nil || len(entries) != 0 {
+		t.Errorf("expected the output to be emptied got: %v %v", entries, err)
+	}
+	if err := cleanOutput("missing"); err != nil {
+		t.Errorf("expected a missing output to be clean got: %v", err)
+	}
+
+	for _, dangerous := range []string{".", "..", "/", repo} {
+		if err := cleanOutput(dangerous); err == nil {
+			t.Errorf("expected cleaning %s to be refused", dangerous)
+		}
+	}
+	if _, err := os.Stat(repo); err != nil {
+		t.Errorf("expected the working directory to be kept: %v", err)
+	}
+}
+
+func TestCleanHashStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	h, err := NewJSONHashStore(path, HashStrategyReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Add("app", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	clean := cleanHashStore{h}
+	if hash, err := clean.Get("app"); err != nil || hash != "" {
+		t.Errorf("expected the stored hash to be forgotten got: %q %v", hash, err)
+	}
+	if err := clean.Add("app", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := h.Get("app"); hash != "new" {
+		t.Errorf("expected the new hash to be stored got: %q", hash)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// concurrencyAuto is the -concurrency picking the number of renders from the
+// machine, see autoConcurrency.
+const concurrencyAuto = "auto"
+
+// parseConcurrency returns how many applications are rendered at once with
+// the -concurrency value: a positive number, or concurrencyAuto.
+func parseConcurrency(value string) (int, error) {
+	if value == concurrencyAuto {
+		return autoConcurrency(runtime.NumCPU(), loadAverage), nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid -concurrency %q, must be a positive number or %s", value, concurrencyAuto)
+	}
+	return n, nil
+}
+
+// autoConcurrency is one render per CPU, minus the CPUs already busy
+// according to the load average when load reports it, so a loaded machine
+// isn't overwhelmed further. At least one application is always rendered.
+func autoConcurrency(cpus int, load func() (float64, bool)) int {
+	n := cpus
+	if busy, ok := load(); ok {
+		n -= int(math.Round(busy))
+	}
+	return max(n, 1)
+}
+
+// loadAverage returns the load average over the last minute, read from
+// /proc/loadavg. It reports false where there is none, e.g. on macOS.
+func loadAverage() (float64, bool) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	return load, err == nil
+}
+
+// lockedHashStore serializes the calls to a HashStore, so the applications
+// rendered concurrently can share it.
+type lockedHashStore struct {
+	HashStore
+	mu sync.Mutex
+}
+
+func (s *lockedHashStore) Add(name, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.HashStore.Add(name, hash)
+}
+
+func (s *lockedHashStore) Get(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.HashStore.Get(name)
+}
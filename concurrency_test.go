@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestParseConcurrency(t *testing.T) {
+	for value, expected := range map[string]int{"1": 1, "8": 8} {
+		if n, err := parseConcurrency(value); err != nil || n != expected {
+			t.Errorf("expected %s to be %d got: %d %v", value, expected, n, err)
+		}
+	}
+	if n, err := parseConcurrency(concurrencyAuto); err != nil || n < 1 {
+		t.Errorf("expected auto to render at least one application got: %d %v", n, err)
+	}
+	for _, value := range []string{"0", "-1", "many", ""} {
+		if _, err := parseConcurrency(value); err == nil {
+			t.Errorf("expected %q to be invalid", value)
+		}
+	}
+}
+
+func TestAutoConcurrency(t *testing.T) {
+	for _, tc := range []struct {
+		cpus     int
+		load     float64
+		reported bool
+		expected int
+	}{
+		{cpus: 8, expected: 8},
+		{cpus: 8, load: 0.2, reported: true, expected: 8},
+		{cpus: 8, load: 2.6, reported: true, expected: 5},
+		{cpus: 8, load: 12, reported: true, expected: 1},
+		{cpus: 1, expected: 1},
+	} {
+		load := func() (float64, bool) { return tc.load, tc.reported }
+		if n := autoConcurrency(tc.cpus, load); n != tc.expected {
+			t.Errorf("expected %d CPUs with a load of %v (%t) to render %d at once got: %d", tc.cpus, tc.load, tc.reported, tc.expected, n)
+		}
+	}
+}
+
+func TestWalkConcurrency(t *testing.T) {
+	root := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "a", "b", "c", "d")
+
+	// Every root application waits until another one renders alongside
+	// it, so the walk only finishes when they are rendered concurrently.
+	var mu sync.Mutex
+	var rendered []string
+	running := 0
+	overlapped := make(chan struct{})
+	var overlap sync.Once
+	fake := &fakeRenderer{t: t, children: map[string][]string{"b": {"b-child"}}}
+	w := &Walker{
+		HelmTemplate: fake.Render,
+		CopySource: func(ctx context.Context, application *v1alpha1.Application, output string) error {
+			mu.Lock()
+			rendered = append(rendered, application.ObjectMeta.Name)
+			running++
+			if running == 2 {
+				overlap.Do(func() { close(overlapped) })
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				running--
+				mu.Unlock()
+			}()
+
+			if application.ObjectMeta.Name != "b-child" {
+				select {
+				case <-overlapped:
+				case <-time.After(5 * time.Second):
+					return errors.New("rendered alone")
+				}
+			}
+			if application.ObjectMeta.Name == "c" {
+				return errors.New("broken")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			return fake.Render(ctx, application, output)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+		concurrency:  2,
+	}
+
+	summary, err := w.Walk(context.Background(), root, t.TempDir(), InfiniteDepth, NewMemoryHashStore())
+	if err == nil {
+		t.Fatal("expected c to fail")
+	}
+
+	// The results keep the order of a walk rendering one at a time.
+	var names []string
+	for _, app := range summary.Apps {
+		names = append(names, app.Name+":"+app.Status)
+	}
+	expected := []string{"a:rendered", "b:rendered", "b-child:rendered", "c:failed", "d:rendered"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v got: %v", expected, names)
+	}
+	if rendered[len(rendered)-1] != "b-child" {
+		t.Errorf("expected the descendants to be walked once the root applications rendered got: %v", rendered)
+	}
+}
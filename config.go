@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is the config file read when -config isn't set.
+const defaultConfigFile = ".mani-diffy.yaml"
+
+// loadConfig sets the flags that weren't set on the command line to the
+// values in the config file at path. Its keys are the names of the flags, and
+// the flags that can be repeated take a list. A missing file is only an error
+// when required.
+func loadConfig(flags *flag.FlagSet, path string, required bool) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading config: %w", err)
+	}
+
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("error reading config %s: %w", path, err)
+	}
+
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		f := flags.Lookup(key)
+		if f == nil || key == "config" {
+			return fmt.Errorf("unknown key %q in config %s", key, path)
+		}
+		if set[key] {
+			// The command line wins.
+			continue
+		}
+
+		values, isList := config[key].([]interface{})
+		if !isList {
+			values = []interface{}{config[key]}
+		} else if _, repeatable := f.Value.(*stringsFlag); !repeatable {
+			return fmt.Errorf("invalid value for %q in config %s: -%s can't be repeated", key, path, key)
+		}
+		for _, value := range values {
+			if err := flags.Set(key, fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("invalid value for %q in config %s: %w", key, path, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *string, *bool, *time.Duration, *stringsFlag) {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.String("config", "", "")
+		output := flags.String("output", ".zz.auto-generated", "")
+		prune := flags.Bool("prune", false, "")
+		timeout := flags.Duration("timeout", 0, "")
+		var apiVersions stringsFlag
+		flags.Var(&apiVersions, "api-versions", "")
+		return flags, output, prune, timeout, &apiVersions
+	}
+
+	path := filepath.Join(t.TempDir(), defaultConfigFile)
+	config := `output: rendered
+prune: true
+timeout: 30m
+api-versions:
+  - monitoring.coreos.com/v1
+  - cert-manager.io/v1
+`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	flags, output, prune, timeout, apiVersions := newFlags()
+	if err := flags.Parse([]string{"-output", "from-cli"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(flags, path, true); err != nil {
+		t.Fatal(err)
+	}
+	if *output != "from-cli" {
+		t.Errorf("expected the command line to override the config got: %s", *output)
+	}
+	if !*prune || *timeout != 30*time.Minute {
+		t.Errorf("expected the config to set the flags got: %t %s", *prune, *timeout)
+	}
+	if expected := (stringsFlag{"monitoring.coreos.com/v1", "cert-manager.io/v1"}); !reflect.DeepEqual(*apiVersions, expected) {
+		t.Errorf("expected lists to repeat the flag got: %v", *apiVersions)
+	}
+
+	flags, _, _, _, _ = newFlags()
+	if err := loadConfig(flags, filepath.Join(t.TempDir(), defaultConfigFile), false); err != nil {
+		t.Errorf("expected a missing default config to be ignored got: %v", err)
+	}
+	if err := loadConfig(flags, filepath.Join(t.TempDir(), "missing.yaml"), true); err == nil {
+		t.Error("expected a missing config to fail when it's required")
+	}
+
+	for content, expected := range map[string]string{
+		"ouptut: rendered\n":   `unknown key "ouptut"`,
+		"config: other.yaml\n": `unknown key "config"`,
+		"output: [a, b]\n":     "-output can't be repeated",
+		"timeout: soon\n":      `invalid value for "timeout"`,
+		"- output\n":           "error reading config",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		flags, _, _, _, _ := newFlags()
+		if err := loadConfig(flags, path, true); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q to fail with %q got: %v", content, expected, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chime/mani-diffy/pkg/helm"
+	"github.com/pmezard/go-difflib/difflib"
+	"golang.org/x/term"
+)
+
+// DiffPrinter prints a unified diff of the files a render changed.
+type DiffPrinter struct {
+	// Out is where every diff is printed.
+	Out io.Writer
+
+	// Dir, when set, also stores the diff of every changed application in
+	// <Dir>/<application>.diff.
+	Dir string
+
+	// Color highlights the diffs printed to Out. The diffs stored in Dir are
+	// never colored.
+	Color bool
+
+	// Changed lists the applications whose diff was printed.
+	Changed []string
+
+	// mu serializes the diffs of the applications rendered concurrently.
+	mu sync.Mutex
+}
+
+// Diff prints the difference between the files an application rendered before
+// and after. A file that did not exist before is shown as additions.
+func (d *DiffPrinter) Diff(name string, before, after map[string]string) error {
+	diff, err := unifiedDiff(name, before, after)
+	if err != nil || diff == "" {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	printed := diff
+	if d.Color {
+		printed = colorDiff(diff)
+	}
+	if _, err := io.WriteString(d.Out, printed); err != nil {
+		return err
+	}
+	d.Changed = append(d.Changed, name)
+
+	if d.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(d.Dir, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %s %w", d.Dir, err)
+	}
+	return os.WriteFile(filepath.Join(d.Dir, name+".diff"), []byte(diff), 0644)
+}
+
+func unifiedDiff(name string, before, after map[string]string) (string, error) {
+	files := make([]string, 0, len(before)+len(after))
+	for file := range before {
+		files = append(files, file)
+	}
+	for file := range after {
+		if _, ok := before[file]; !ok {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	var sb strings.Builder
+	for _, file := range files {
+		a, inBefore := before[file]
+		b, inAfter := after[file]
+		if a == b && inBefore == inAfter {
+			continue
+		}
+
+		fromFile, toFile := filepath.Join("a", name, file), filepath.Join("b", name, file)
+		if !inBefore {
+			fromFile = "/dev/null"
+		}
+		if !inAfter {
+			toFile = "/dev/null"
+		}
+
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        splitLines(a),
+			B:        splitLines(b),
+			FromFile: fromFile,
+			ToFile:   toFile,
+			Context:  3,
+		})
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(diff)
+	}
+
+	return sb.String(), nil
+}
+
+const (
+	colorReset = "\x1b[0m"
+	colorBold  = "\x1b[1m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+)
+
+// colorDiff highlights the file headers, hunk headers, removals and additions
+// of a unified diff with ANSI escape codes, like git does.
+func colorDiff(diff string) string {
+	var sb strings.Builder
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		text := strings.TrimSuffix(line, "\n")
+		var color string
+		switch {
+		case strings.HasPrefix(text, "--- "), strings.HasPrefix(text, "+++ "):
+			color = colorBold
+		case strings.HasPrefix(text, "@@"):
+			color = colorCyan
+		case strings.HasPrefix(text, "-"):
+			color = colorRed
+		case strings.HasPrefix(text, "+"):
+			color = colorGreen
+		}
+		if color == "" || text == "" {
+			sb.WriteString(line)
+			continue
+		}
+		sb.WriteString(color + text + colorReset + line[len(text):])
+	}
+	return sb.String()
+}
+
+// useColor reports whether output written to f should be colored: only when
+// it is a terminal, and neither -no-color nor the NO_COLOR environment
+// variable is set.
+func useColor(noColor bool, f *os.File) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// splitLines splits s into lines that keep their line endings. Unlike
+// difflib.SplitLines, an empty file has no lines.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// readFiles returns the content of every file below dir keyed by its path
+// relative to dir. A missing dir has no files. Hash files are not rendered
+// output, so they are left out.
+func readFiles(dir string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() == sumFileName {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		// Compressed manifests are compared decompressed.
+		b, err := helm.ReadManifest(path)
+		if err != nil {
+			return err
+		}
+		files[relPath] = string(b)
+		return nil
+	})
+	return files, err
+}
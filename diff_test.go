@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestWalkDiff(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "app.yaml"), []byte(testApplication), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := "kind: ConfigMap\nmetadata:\n  name: before\n"
+	var out bytes.Buffer
+	diffs := t.TempDir()
+	printer := &DiffPrinter{Out: &out, Dir: diffs}
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			if err := os.MkdirAll(output, os.ModePerm); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte(manifest), 0644)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return manifest, nil
+		},
+		Diff:         printer.Diff,
+		ignoreSuffix: "-ignore",
+	}
+
+	walk := func() {
+		t.Helper()
+		if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewSumFileStore(output, HashStrategyReadWrite)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk()
+	expected := `--- /dev/null
++++ b/test-app/manifest.yaml
+@@ -0,0 +1,3 @@
++kind: ConfigMap
++metadata:
++  name: before
+`
+	if out.String() != expected {
+		t.Errorf("expected a new manifest to be all additions got:\n%s", out.String())
+	}
+
+	out.Reset()
+	manifest = strings.Replace(manifest, "before", "after", 1)
+	walk()
+	expected = `--- a/test-app/manifest.yaml
++++ b/test-app/manifest.yaml
+@@ -1,3 +1,3 @@
+ kind: ConfigMap
+ metadata:
+-  name: before
++  name: after
+`
+	if out.String() != expected {
+		t.Errorf("unexpected diff got:\n%s", out.String())
+	}
+
+	b, err := os.ReadFile(filepath.Join(diffs, "test-app.diff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Errorf("expected the diff to be written got:\n%s", b)
+	}
+
+	// Nothing changed, so nothing is rendered or printed.
+	out.Reset()
+	walk()
+	if out.Len() != 0 {
+		t.Errorf("expected no diff got:\n%s", out.String())
+	}
+	if expected := []string{"test-app", "test-app"}; !reflect.DeepEqual(printer.Changed, expected) {
+		t.Errorf("expected the apps with a diff to be recorded got: %v", printer.Changed)
+	}
+}
+
+func TestColorDiff(t *testing.T) {
+	diff := `--- a/test-app/manifest.yaml
++++ b/test-app/manifest.yaml
+@@ -1,2 +1,2 @@
+ kind: ConfigMap
+-  name: before
++  name: after
+`
+	expected := "\x1b[1m--- a/test-app/manifest.yaml\x1b[0m\n" +
+		"\x1b[1m+++ b/test-app/manifest.yaml\x1b[0m\n" +
+		"\x1b[36m@@ -1,2 +1,2 @@\x1b[0m\n" +
+		" kind: ConfigMap\n" +
+		"\x1b[31m-  name: before\x1b[0m\n" +
+		"\x1b[32m+  name: after\x1b[0m\n"
+	if got := colorDiff(diff); got != expected {
+		t.Errorf("unexpected colored diff got: %q", got)
+	}
+
+	f, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if useColor(false, f) {
+		t.Error("expected output that is not a terminal not to be colored")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Duplicate is a group of applications whose output is byte-identical.
+type Duplicate struct {
+	Apps []string
+
+	// Size is the size of the output of a single application in bytes.
+	Size int
+}
+
+// Wasted is how many bytes storing the output of the applications once would
+// save.
+func (d Duplicate) Wasted() int {
+	return d.Size * (len(d.Apps) - 1)
+}
+
+// findDuplicates groups the applications in outputPath whose output holds the
+// same files with the same content. Applications with no output are left out.
+// The largest savings come first.
+func findDuplicates(outputPath string) ([]Duplicate, error) {
+	apps, err := readApps(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*Duplicate)
+	for app, files := range apps {
+		names := make([]string, 0, len(files))
+		size := 0
+		for name, content := range files {
+			names = append(names, name)
+			size += len(content)
+		}
+		if size == 0 {
+			continue
+		}
+		sort.Strings(names)
+
+		h := sha256.New()
+		for _, name := range names {
+			fmt.Fprintf(h, "%s %d\n", name, len(files[name]))
+			io.WriteString(h, files[name])
+		}
+		key := fmt.Sprintf("%x", h.Sum(nil))
+		if groups[key] == nil {
+			groups[key] = &Duplicate{Size: size}
+		}
+		groups[key].Apps = append(groups[key].Apps, app)
+	}
+
+	var duplicates []Duplicate
+	for _, group := range groups {
+		if len(group.Apps) < 2 {
+			continue
+		}
+		sort.Strings(group.Apps)
+		duplicates = append(duplicates, *group)
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].Wasted() != duplicates[j].Wasted() {
+			return duplicates[i].Wasted() > duplicates[j].Wasted()
+		}
+		return duplicates[i].Apps[0] < duplicates[j].Apps[0]
+	})
+	return duplicates, nil
+}
+
+// printDuplicates writes a report of duplicates to w.
+func printDuplicates(w io.Writer, duplicates []Duplicate) {
+	wasted := 0
+	for _, d := range duplicates {
+		fmt.Fprintf(w, "%d apps with the same %d bytes of output:", len(d.Apps), d.Size)
+		for _, app := range d.Apps {
+			fmt.Fprintf(w, " %s", app)
+		}
+		fmt.Fprintln(w)
+		wasted += d.Wasted()
+	}
+	fmt.Fprintf(w, "%d groups of duplicates, %d bytes could be saved\n", len(duplicates), wasted)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	output := t.TempDir()
+	for path, content := range map[string]string{
+		"hashes.json":            "{}",
+		"web-1/manifest.yaml":    "kind: Deployment\n",
+		"web-2/manifest.yaml":    "kind: Deployment\n",
+		"web-3/manifest.yaml":    "kind: Deployment\n",
+		"worker/manifest.yaml":   "kind: Deployment\n",
+		"worker/extra.yaml":      "",
+		"config-1/manifest.yaml": "kind: ConfigMap\n",
+		"config-2/manifest.yaml": "kind: ConfigMap\n",
+		"unique/manifest.yaml":   "kind: Secret\n",
+		"empty-1/manifest.yaml":  "",
+		"empty-2/manifest.yaml":  "",
+	} {
+		if err := os.MkdirAll(filepath.Join(output, filepath.Dir(path)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(output, path), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	duplicates, err := findDuplicates(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Duplicate{
+		{Apps: []string{"web-1", "web-2", "web-3"}, Size: 17},
+		{Apps: []string{"config-1", "config-2"}, Size: 16},
+	}
+	if !reflect.DeepEqual(duplicates, expected) {
+		t.Errorf("expected %+v got: %+v", expected, duplicates)
+	}
+
+	var out bytes.Buffer
+	printDuplicates(&out, duplicates)
+	report := `3 apps with the same 17 bytes of output: web-1 web-2 web-3
+2 apps with the same 16 bytes of output: config-1 config-2
+2 groups of duplicates, 50 bytes could be saved
+`
+	if out.String() != report {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+// RenderError is the error of an application that failed to render, hash or
+// template, with where it comes from and where it renders to.
+type RenderError struct {
+	// App is the name of the application.
+	App string
+
+	// Source is the path of the application's source, the first one when
+	// it has several.
+	Source string
+
+	// Output is the directory the application renders into.
+	Output string
+
+	Err error
+}
+
+func newRenderError(application *v1alpha1.Application, output string, err error) *RenderError {
+	return &RenderError{
+		App:    application.ObjectMeta.Name,
+		Source: application.Spec.GetSource().Path,
+		Output: output,
+		Err:    err,
+	}
+}
+
+func (e *RenderError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Output, e.Err)
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
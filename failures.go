@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/chime/mani-diffy/pkg/directory"
+)
+
+// failureErrorFile is the file of an application's failure directory
+// holding its error.
+const failureErrorFile = "error.txt"
+
+// resetFailures removes the failures of previous walks from the failures
+// directory, so it only holds the ones of the walk about to start. Only the
+// directories of the applications, the ones holding an error file, are
+// removed, since the directory may hold anything else, e.g. when it's the
+// working directory.
+func (w *Walker) resetFailures() error {
+	if w.failuresDir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(w.failuresDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading the failures: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(w.failuresDir, entry.Name())
+		if _, err := os.Stat(filepath.Join(dir, failureErrorFile)); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("error removing the failures: %w", err)
+		}
+	}
+	return nil
+}
+
+// keepPartialOutput copies what the application name rendered before failing
+// to its failure directory.
+func (w *Walker) keepPartialOutput(name, rendered string) error {
+	if w.failuresDir == "" {
+		return nil
+	}
+	if _, err := os.Stat(rendered); errors.Is(err, fs.ErrNotExist) {
+		// Nothing was rendered.
+		return nil
+	}
+	return directory.Copy(rendered, filepath.Join(w.failuresDir, name), nil)
+}
+
+// recordFailure writes the error the application name failed with to its
+// failure directory, next to its partial output.
+func (w *Walker) recordFailure(name string, failure error) error {
+	if w.failuresDir == "" {
+		return nil
+	}
+	dir := filepath.Join(w.failuresDir, name)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %s %w", dir, err)
+	}
+	return os.WriteFile(filepath.Join(dir, failureErrorFile), []byte(failure.Error()+"\n"), 0644)
+}
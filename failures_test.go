@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestWalkFailuresDir(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	failures := filepath.Join(t.TempDir(), "failures")
+	writeApplications(t, root, "apps.yaml", "broken", "healthy", "unhashable")
+
+	// Failures of a previous run are removed, but nothing else.
+	if err := os.MkdirAll(filepath.Join(failures, "stale"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(failures, "stale", failureErrorFile), []byte("failed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(failures, "unrelated"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(failures, "README.md"), []byte("failures\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			if err := os.MkdirAll(output, os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte("kind: ConfigMap\n"), 0644); err != nil {
+				return err
+			}
+			if application.ObjectMeta.Name == "broken" {
+				return errors.New("Error: template: broken/templates/app.yaml:3: unexpected EOF")
+			}
+			return nil
+		},
+		GenerateHash: func(_ context.Context, application *v1alpha1.Application) (string, error) {
+			if application.ObjectMeta.Name == "unhashable" {
+				return "", errors.New("cannot hash")
+			}
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+		failuresDir:  failures,
+	}
+
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore()); err == nil {
+		t.Fatal("expected the walk to fail")
+	}
+
+	b, err := os.ReadFile(filepath.Join(failures, "broken", failureErrorFile))
+	if err != nil || !strings.Contains(string(b), "unexpected EOF") {
+		t.Errorf("expected the error of the broken app to be kept got: %s %v", b, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(failures, "broken", "manifest.yaml")); err != nil || string(b) != "kind: ConfigMap\n" {
+		t.Errorf("expected the partial output of the broken app to be kept got: %s %v", b, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(failures, "unhashable", failureErrorFile)); err != nil || !strings.Contains(string(b), "cannot hash") {
+		t.Errorf("expected the error of the unhashable app to be kept got: %s %v", b, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(failures, "stale")); !os.IsNotExist(err) {
+		t.Errorf("expected the failures of the previous run to be removed got: %v", err)
+	}
+	for _, name := range []string{"unrelated", "README.md"} {
+		if _, err := os.Stat(filepath.Join(failures, name)); err != nil {
+			t.Errorf("expected %s, which isn't a failure, to be kept: %v", name, err)
+		}
+	}
+	entries, err := os.ReadDir(failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("expected only the failed apps of the run to be added got: %v", entries)
+	}
+
+	w.failuresDir = ""
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore()); err == nil {
+		t.Fatal("expected the walk to fail")
+	}
+	if entries, err := os.ReadDir(failures); err != nil || len(entries) != 4 {
+		t.Errorf("expected the failures to be left alone without the flag got: %v %v", entries, err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// GitCommit commits the changes to the files in dir, which must be inside a
+// git work tree. The message lists the applications the run rendered. Nothing
+// is committed when dir is unchanged. With dryRun the commit is only printed
+// to out.
+func GitCommit(ctx context.Context, dir string, summary *Summary, dryRun bool, out io.Writer) error {
+	status, err := git(ctx, dir, "status", "--porcelain", "--", ".")
+	if err != nil {
+		return err
+	}
+	if status == "" {
+		return nil
+	}
+
+	message := commitMessage(summary)
+	if dryRun {
+		fmt.Fprintf(out, "Would commit:\n%s\n%s", status, message)
+		return nil
+	}
+
+	if _, err := git(ctx, dir, "add", "--all", "--", "."); err != nil {
+		return err
+	}
+	_, err = git(ctx, dir, "commit", "--quiet", "--message", message, "--", ".")
+	return err
+}
+
+// commitMessage describes the applications rendered in summary.
+func commitMessage(summary *Summary) string {
+	var apps []string
+	for _, app := range summary.Apps {
+		if app.Status == StatusRendered {
+			apps = append(apps, app.Name)
+		}
+	}
+	sort.Strings(apps)
+
+	var b strings.Builder
+	b.WriteString("Render manifests\n")
+	if len(apps) > 0 {
+		b.WriteString("\nRendered:\n")
+		for _, app := range apps {
+			fmt.Fprintf(&b, "- %s\n", app)
+		}
+	}
+	return b.String()
+}
+
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running git %s: %w: %s", args[0], err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// GitChanges returns the files in dir, which must be inside a git work tree,
+// that differ from HEAD, including untracked ones, one `git status
+// --porcelain` line per file. With reset dir is then restored to HEAD, so
+// the work tree is left as it was before the render.
+func GitChanges(ctx context.Context, dir string, reset bool) ([]string, error) {
+	status, err := git(ctx, dir, "status", "--porcelain", "--untracked-files=all", "--", ".")
+	if err != nil {
+		return nil, err
+	}
+	if status == "" {
+		return nil, nil
+	}
+	changes := strings.Split(strings.TrimRight(status, "\n"), "\n")
+	if !reset {
+		return changes, nil
+	}
+
+	// git checkout fails when nothing in dir is tracked yet.
+	tracked, err := git(ctx, dir, "ls-files", "--", ".")
+	if err != nil {
+		return nil, err
+	}
+	if tracked != "" {
+		if _, err := git(ctx, dir, "checkout", "--quiet", "HEAD", "--", "."); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := git(ctx, dir, "clean", "--quiet", "-d", "--force", "--", "."); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitCommit(t *testing.T) {
+	repo := t.TempDir()
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"config", "user.name", "test"},
+		{"config", "user.email", "test@example.com"},
+	} {
+		if _, err := git(ctx, repo, args...); err != nil {
+			t.Skip(err)
+		}
+	}
+
+	output := filepath.Join(repo, ".zz.auto-generated")
+	if err := os.MkdirAll(filepath.Join(output, "app"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(output, "app", "manifest.yaml"), []byte("kind: ConfigMap\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Changes outside the output are left alone.
+	if err := os.WriteFile(filepath.Join(repo, "other.yaml"), []byte("kind: Secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := NewSummary()
+	summary.Add(AppResult{Name: "app", Status: StatusRendered})
+	summary.Add(AppResult{Name: "cached", Status: StatusCacheHit})
+
+	var out bytes.Buffer
+	if err := GitCommit(ctx, output, summary, true, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "- app\n") {
+		t.Errorf("expected the dry run to print the commit got: %s", out.String())
+	}
+	if _, err := git(ctx, repo, "rev-parse", "HEAD"); err == nil {
+		t.Error("expected the dry run not to commit")
+	}
+
+	if err := GitCommit(ctx, output, summary, false, &out); err != nil {
+		t.Fatal(err)
+	}
+	log, err := git(ctx, repo, "log", "--format=%B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log != "Render manifests\n\nRendered:\n- app\n\n" {
+		t.Errorf("unexpected commit message: %q", log)
+	}
+	files, err := git(ctx, repo, "show", "--name-only", "--format=", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != ".zz.auto-generated/app/manifest.yaml\n" {
+		t.Errorf("expected only the output to be committed got: %q", files)
+	}
+
+	// Nothing changed, so nothing is committed.
+	if err := GitCommit(ctx, output, summary, false, &out); err != nil {
+		t.Fatal(err)
+	}
+	count, err := git(ctx, repo, "rev-list", "--count", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != "1\n" {
+		t.Errorf("expected a single commit got: %s", count)
+	}
+}
+
+func TestGitChanges(t *testing.T) {
+	repo := t.TempDir()
+	ctx := context.Background()
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"config", "user.name", "test"},
+		{"config", "user.email", "test@example.com"},
+	} {
+		if _, err := git(ctx, repo, args...); err != nil {
+			t.Skip(err)
+		}
+	}
+
+	output := filepath.Join(repo, ".zz.auto-generated")
+	write := func(file, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing in the output is tracked yet.
+	write(filepath.Join(output, "app", "manifest.yaml"), "kind: ConfigMap\n")
+	changes, err := GitChanges(ctx, output, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0] != "?? .zz.auto-generated/app/manifest.yaml" {
+		t.Errorf("expected the new manifest to be listed got: %q", changes)
+	}
+	if _, err := os.Stat(filepath.Join(output, "app")); !os.IsNotExist(err) {
+		t.Errorf("expected the new output to be removed: %v", err)
+	}
+
+	write(filepath.Join(output, "app", "manifest.yaml"), "kind: ConfigMap\n")
+	for _, args := range [][]string{
+		{"add", "--all"},
+		{"commit", "--quiet", "--message", "render"},
+	} {
+		if _, err := git(ctx, repo, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if changes, err := GitChanges(ctx, output, true); err != nil || len(changes) != 0 {
+		t.Errorf("expected no changes got: %q %v", changes, err)
+	}
+
+	write(filepath.Join(output, "app", "manifest.yaml"), "kind: Secret\n")
+	write(filepath.Join(output, "other", "manifest.yaml"), "kind: ConfigMap\n")
+	// Changes outside the output are left alone.
+	write(filepath.Join(repo, "other.yaml"), "kind: Secret\n")
+
+	changes, err = GitChanges(ctx, output, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("expected the changed and the new manifest to be listed got: %q", changes)
+	}
+	if _, err := os.Stat(filepath.Join(output, "other")); err != nil {
+		t.Errorf("expected the changes to be kept without reset: %v", err)
+	}
+
+	if _, err := GitChanges(ctx, output, true); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(output, "app", "manifest.yaml")); err != nil || string(b) != "kind: ConfigMap\n" {
+		t.Errorf("expected the manifest to be restored got: %s %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "other")); !os.IsNotExist(err) {
+		t.Errorf("expected the new output to be removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "other.yaml")); err != nil {
+		t.Errorf("expected the files outside of the output to be kept: %v", err)
+	}
+}
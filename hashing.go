@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/chime/mani-diffy/pkg/helm"
 	yaml "gopkg.in/yaml.v3"
 )
 
@@ -22,6 +31,15 @@ type HashStore interface {
 	Save() error
 }
 
+// prunableHashStore is a HashStore that can forget the hashes of the
+// applications that no longer exist.
+type prunableHashStore interface {
+	HashStore
+
+	// Prune drops the hashes of the applications not in keep.
+	Prune(keep map[string]bool)
+}
+
 const (
 	HashStrategyReadWrite = "readwrite"
 	HashStrategyRead      = "read"
@@ -33,6 +51,12 @@ type JSONHashStore struct {
 	path     string
 	hashes   map[string]string
 	strategy string
+
+	// checkpointInterval, when set, is how often the hashes added are
+	// saved before Save, so an interrupted run keeps the progress of the
+	// applications it rendered.
+	checkpointInterval time.Duration
+	lastCheckpoint     time.Time
 }
 
 func NewJSONHashStore(path, strategy string) (*JSONHashStore, error) {
@@ -47,21 +71,25 @@ func NewJSONHashStore(path, strategy string) (*JSONHashStore, error) {
 			// If the file is invalid JSON, instead of erroring out,
 			// just start from scratch so a new valid file is
 			// generated.
-			log.Printf("Unable to parse hashes from %s: %v\n", path, err)
+			slog.Warn("Unable to parse hashes, starting from scratch", "path", path, "error", err)
 		}
 	}
 
 	hashes["//"] = "AUTO GENERATED. DO NOT EDIT."
 
 	return &JSONHashStore{
-		path:     path,
-		hashes:   hashes,
-		strategy: strategy,
+		path:           path,
+		hashes:         hashes,
+		strategy:       strategy,
+		lastCheckpoint: time.Now(),
 	}, nil
 }
 
 func (s *JSONHashStore) Add(name, hash string) error {
 	s.hashes[name] = hash
+	if s.checkpointInterval > 0 && time.Since(s.lastCheckpoint) >= s.checkpointInterval {
+		return s.Save()
+	}
 	return nil
 }
 
@@ -69,6 +97,14 @@ func (s *JSONHashStore) Get(name string) (string, error) {
 	return s.hashes[name], nil
 }
 
+func (s *JSONHashStore) Prune(keep map[string]bool) {
+	for name := range s.hashes {
+		if name != "//" && !keep[name] {
+			delete(s.hashes, name)
+		}
+	}
+}
+
 func (s *JSONHashStore) Save() error {
 	if s.strategy == HashStrategyRead {
 		// Read-only mode, so don't write.
@@ -80,13 +116,54 @@ func (s *JSONHashStore) Save() error {
 		return err
 	}
 
-	return os.WriteFile(s.path, b, 0644)
+	// Atomic, since a run interrupted while checkpointing would otherwise
+	// leave invalid JSON behind and lose every hash.
+	if err := helm.WriteFileAtomic(s.path, b, 0644); err != nil {
+		return err
+	}
+	s.lastCheckpoint = time.Now()
+	return nil
+}
+
+// MemoryHashStore is a HashStore that keeps the hashes in memory only, e.g.
+// for tests or one-off renders that shouldn't touch the output.
+type MemoryHashStore struct {
+	hashes map[string]string
+}
+
+func NewMemoryHashStore() *MemoryHashStore {
+	return &MemoryHashStore{hashes: make(map[string]string)}
+}
+
+func (s *MemoryHashStore) Add(name, hash string) error {
+	s.hashes[name] = hash
+	return nil
+}
+
+func (s *MemoryHashStore) Get(name string) (string, error) {
+	return s.hashes[name], nil
+}
+
+func (s *MemoryHashStore) Prune(keep map[string]bool) {
+	for name := range s.hashes {
+		if !keep[name] {
+			delete(s.hashes, name)
+		}
+	}
+}
+
+func (s *MemoryHashStore) Save() error {
+	return nil
 }
 
 type ChartHash struct {
 	Hash string `yaml:"hash"`
 }
 
+// sumFileName is the file SumFileStore keeps the hash of an application in,
+// alongside its rendered output.
+const sumFileName = "hash.sum"
+
 // An implementation of HashStore that stores hashes in a "hash.sum" file.
 type SumFileStore struct {
 	path     string
@@ -142,5 +219,330 @@ func (s *SumFileStore) Save() error {
 }
 
 func (s *SumFileStore) filepath(name string) string {
-	return filepath.Join(s.path, name, "hash.sum")
+	return filepath.Join(s.path, name, sumFileName)
+}
+
+// An implementation of HashStore that stores the hashes of every application
+// in a single file formatted like go.sum, with a `name hash` line per
+// application sorted by name. Hashes are loaded when the store is created and
+// only written back on Save.
+type ConsolidatedSumFileStore struct {
+	path     string
+	hashes   map[string]string
+	strategy string
+}
+
+func NewConsolidatedSumFileStore(path, strategy string) (*ConsolidatedSumFileStore, error) {
+	hashes := make(map[string]string)
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for i, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("error reading hashes from %s: malformed line %d", path, i+1)
+		}
+		hashes[fields[0]] = fields[1]
+	}
+
+	return &ConsolidatedSumFileStore{
+		path:     path,
+		hashes:   hashes,
+		strategy: strategy,
+	}, nil
+}
+
+func (s *ConsolidatedSumFileStore) Add(name, hash string) error {
+	s.hashes[name] = hash
+	return nil
+}
+
+func (s *ConsolidatedSumFileStore) Get(name string) (string, error) {
+	return s.hashes[name], nil
+}
+
+func (s *ConsolidatedSumFileStore) Save() error {
+	if s.strategy == HashStrategyRead {
+		// Read-only mode, don't write
+		return nil
+	}
+
+	names := make([]string, 0, len(s.hashes))
+	for name := range s.hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s %s\n", name, s.hashes[name])
+	}
+	// Atomic, since every hash is in this file and a run killed while
+	// writing it would otherwise truncate them all.
+	return helm.WriteFileAtomic(s.path, []byte(sb.String()), 0664)
+}
+
+// An implementation of HashStore that stores all hashes inside a SQLite
+// database. Like JSONHashStore, hashes are loaded when the store is created
+// and only written back on Save. The SQLite driver needs cgo, so binaries
+// built without it fail to create one.
+type SQLiteHashStore struct {
+	path     string
+	hashes   map[string]string
+	added    map[string]string
+	strategy string
+}
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS hashes (
+	name TEXT PRIMARY KEY,
+	hash TEXT NOT NULL
+)`
+
+func NewSQLiteHashStore(path, strategy string) (*SQLiteHashStore, error) {
+	if !sqliteAvailable {
+		return nil, errors.New("the sqlite hash store is not available: mani-diffy was built without cgo, which its SQLite driver needs")
+	}
+
+	s := &SQLiteHashStore{
+		path:     path,
+		hashes:   make(map[string]string),
+		added:    make(map[string]string),
+		strategy: strategy,
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			// Nothing has been stored yet.
+			return s, nil
+		}
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening hash database %s: %w", path, err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return nil, fmt.Errorf("error creating hash table in %s: %w", path, err)
+	}
+
+	rows, err := db.Query("SELECT name, hash FROM hashes")
+	if err != nil {
+		return nil, fmt.Errorf("error reading hashes from %s: %w", path, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, hash string
+		if err := rows.Scan(&name, &hash); err != nil {
+			return nil, fmt.Errorf("error reading hashes from %s: %w", path, err)
+		}
+		s.hashes[name] = hash
+	}
+
+	return s, rows.Err()
+}
+
+func (s *SQLiteHashStore) Add(name, hash string) error {
+	s.hashes[name] = hash
+	s.added[name] = hash
+	return nil
+}
+
+func (s *SQLiteHashStore) Get(name string) (string, error) {
+	return s.hashes[name], nil
+}
+
+func (s *SQLiteHashStore) Save() error {
+	if s.strategy == HashStrategyRead {
+		// Read-only mode, so don't write.
+		return nil
+	}
+
+	db, err := sql.Open("sqlite3", s.path)
+	if err != nil {
+		return fmt.Errorf("error opening hash database %s: %w", s.path, err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		return fmt.Errorf("error creating hash table in %s: %w", s.path, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for name, hash := range s.added {
+		_, err := tx.Exec(
+			"INSERT INTO hashes (name, hash) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET hash = excluded.hash",
+			name,
+			hash,
+		)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("error writing hash for %s: %w", name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.added = make(map[string]string)
+	return nil
+}
+
+// httpHashStoreRetries is how many times a failed request to an
+// HTTPHashStore is retried, and httpHashStoreBackoff how long to wait before
+// the first retry. The wait doubles after every attempt.
+var (
+	httpHashStoreRetries = 3
+	httpHashStoreBackoff = 500 * time.Millisecond
+)
+
+// An implementation of the HashStore that keeps the hashes on a remote
+// server, so they survive ephemeral CI containers. The hash of an app is read
+// with a GET of `<url>/<name>`, and every hash added during a run is written
+// with a single PUT of a JSON object mapping names to hashes to `<url>`.
+type HTTPHashStore struct {
+	url      string
+	client   *http.Client
+	added    map[string]string
+	strategy string
+}
+
+func NewHTTPHashStore(baseURL, strategy string) (*HTTPHashStore, error) {
+	if baseURL == "" {
+		return nil, errors.New("the http hash store needs a -hash-store-url")
+	}
+	return &HTTPHashStore{
+		url:      strings.TrimSuffix(baseURL, "/"),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		added:    make(map[string]string),
+		strategy: strategy,
+	}, nil
+}
+
+func (s *HTTPHashStore) Add(name, hash string) error {
+	s.added[name] = hash
+	return nil
+}
+
+func (s *HTTPHashStore) Get(name string) (string, error) {
+	if hash, ok := s.added[name]; ok {
+		return hash, nil
+	}
+
+	body, status, err := s.do(http.MethodGet, s.url+"/"+url.PathEscape(name), nil)
+	if err != nil {
+		return "", fmt.Errorf("error getting the hash for %s: %w", name, err)
+	}
+	switch status {
+	case http.StatusOK:
+		return strings.TrimSpace(string(body)), nil
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", fmt.Errorf("error getting the hash for %s: unexpected status %d", name, status)
+	}
+}
+
+func (s *HTTPHashStore) Save() error {
+	if s.strategy == HashStrategyRead || len(s.added) == 0 {
+		// Read-only mode or nothing to write.
+		return nil
+	}
+
+	b, err := json.Marshal(s.added)
+	if err != nil {
+		return err
+	}
+	_, status, err := s.do(http.MethodPut, s.url, b)
+	if err != nil {
+		return fmt.Errorf("error saving hashes: %w", err)
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("error saving hashes: unexpected status %d", status)
+	}
+
+	s.added = make(map[string]string)
+	return nil
+}
+
+// do sends a request, retrying when it fails or the server answers with a 5xx
+// status.
+func (s *HTTPHashStore) do(method, target string, body []byte) ([]byte, int, error) {
+	backoff := httpHashStoreBackoff
+	for attempt := 0; ; attempt++ {
+		b, status, err := s.send(method, target, body)
+		if (err == nil && status < 500) || attempt >= httpHashStoreRetries {
+			return b, status, err
+		}
+		slog.Warn("Hash store request failed, retrying", "method", method, "url", target, "status", status, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *HTTPHashStore) send(method, target string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	return b, resp.StatusCode, err
+}
+
+// MigratingHashStore reads the hashes from one HashStore and writes them to
+// another, so a single run converts the cache without losing its hits. The
+// hash of every application looked up is copied over, and the hashes of the
+// applications rendered again replace them.
+type MigratingHashStore struct {
+	from HashStore
+	to   HashStore
+}
+
+func NewMigratingHashStore(from, to HashStore) *MigratingHashStore {
+	return &MigratingHashStore{from: from, to: to}
+}
+
+func (s *MigratingHashStore) Add(name, hash string) error {
+	return s.to.Add(name, hash)
+}
+
+func (s *MigratingHashStore) Get(name string) (string, error) {
+	hash, err := s.from.Get(name)
+	if err != nil || hash == "" {
+		return hash, err
+	}
+	return hash, s.to.Add(name, hash)
+}
+
+func (s *MigratingHashStore) Prune(keep map[string]bool) {
+	if to, ok := s.to.(prunableHashStore); ok {
+		to.Prune(keep)
+	}
+}
+
+// Save only persists the store migrated to. The one migrated from is left as
+// it is, and can be removed once the run succeeds.
+func (s *MigratingHashStore) Save() error {
+	return s.to.Save()
 }
@@ -0,0 +1,8 @@
+//go:build cgo
+
+package main
+
+import _ "github.com/mattn/go-sqlite3" // registers the sqlite3 database/sql driver
+
+// sqliteAvailable is set when the SQLite driver is compiled in.
+const sqliteAvailable = true
@@ -0,0 +1,7 @@
+//go:build !cgo
+
+package main
+
+// sqliteAvailable is set when the SQLite driver is compiled in. It needs cgo,
+// which cross-compiled builds usually don't have.
+const sqliteAvailable = false
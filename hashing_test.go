@@ -1,8 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewJSONHashStore(t *testing.T) {
@@ -39,6 +46,41 @@ func TestNewJSONHashStore(t *testing.T) {
 	}
 }
 
+func TestJSONHashStoreCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	h, err := NewJSONHashStore(path, HashStrategyReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.checkpointInterval = time.Nanosecond
+
+	time.Sleep(time.Millisecond)
+	if err := h.Add("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	// No Save, like in a run interrupted after rendering foo.
+	saved, err := NewJSONHashStore(path, HashStrategyRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := saved.Get("foo"); hash != "bar" {
+		t.Fatalf("Expected the checkpoint to keep the hash of foo, got %q", hash)
+	}
+
+	h.checkpointInterval = time.Hour
+	if err := h.Add("baz", "qux"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err = NewJSONHashStore(path, HashStrategyRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := saved.Get("baz"); hash != "" {
+		t.Fatalf("Expected no checkpoint before the interval elapsed, got %q", hash)
+	}
+}
+
 func TestNewJSONHashStore_InvalidJSON(t *testing.T) {
 	f, err := os.CreateTemp("", "")
 	if err != nil {
@@ -49,3 +91,274 @@ func TestNewJSONHashStore_InvalidJSON(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestNewSQLiteHashStore(t *testing.T) {
+	if !sqliteAvailable {
+		t.Skip("the SQLite driver needs cgo")
+	}
+	path := filepath.Join(t.TempDir(), "hashes.db")
+
+	h, err := NewSQLiteHashStore(path, HashStrategyReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Add("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = NewSQLiteHashStore(path, HashStrategyRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := h.Get("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash != "bar" {
+		t.Fatal("Expected hash to match")
+	}
+
+	hash, err = h.Get("unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash != "" {
+		t.Fatal("Expected unknown hash to be empty")
+	}
+}
+
+func TestSQLiteHashStore_ReadStrategy(t *testing.T) {
+	if !sqliteAvailable {
+		t.Skip("the SQLite driver needs cgo")
+	}
+	path := filepath.Join(t.TempDir(), "hashes.db")
+
+	h, err := NewSQLiteHashStore(path, HashStrategyRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Add("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Expected read-only store not to write a database")
+	}
+}
+
+func TestSQLiteHashStoreWithoutCgo(t *testing.T) {
+	if sqliteAvailable {
+		t.Skip("the SQLite driver is compiled in")
+	}
+
+	_, err := NewSQLiteHashStore(filepath.Join(t.TempDir(), "hashes.db"), HashStrategyReadWrite)
+	if err == nil || !strings.Contains(err.Error(), "built without cgo") {
+		t.Errorf("expected the sqlite hash store to be unavailable got: %v", err)
+	}
+}
+
+func TestConsolidatedSumFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hash.sum")
+
+	h, err := NewConsolidatedSumFileStore(path, HashStrategyReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, hash := range map[string]string{"foo": "1", "bar": "2"} {
+		if err := h.Add(name, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Add("foo", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "bar 2\nfoo 3\n" {
+		t.Errorf("expected sorted hashes got:\n%s", b)
+	}
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Errorf("expected only the sum file to be written got: %v %v", entries, err)
+	}
+
+	h, err = NewConsolidatedSumFileStore(path, HashStrategyRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Add("baz", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"foo": "3", "bar": "2", "missing": ""} {
+		if hash, err := h.Get(name); err != nil || hash != expected {
+			t.Errorf("expected %s to be %q got: %q %v", name, expected, hash, err)
+		}
+	}
+	if b, _ := os.ReadFile(path); string(b) != "bar 2\nfoo 3\n" {
+		t.Errorf("expected the read strategy not to write got:\n%s", b)
+	}
+
+	if err := os.WriteFile(path, []byte("foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewConsolidatedSumFileStore(path, HashStrategyRead); err == nil {
+		t.Error("expected a malformed file to fail")
+	}
+}
+
+func TestHTTPHashStore(t *testing.T) {
+	httpHashStoreBackoff = time.Millisecond
+	t.Cleanup(func() { httpHashStoreBackoff = 500 * time.Millisecond })
+
+	var mu sync.Mutex
+	stored := map[string]string{"foo": "bar"}
+	puts, failures := 0, 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			hash, ok := stored[strings.TrimPrefix(r.URL.Path, "/hashes/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write([]byte(hash + "\n"))
+		case http.MethodPut:
+			puts++
+			if err := json.NewDecoder(r.Body).Decode(&stored); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	h, err := NewHTTPHashStore(srv.URL+"/hashes/", HashStrategyReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first request fails and is retried.
+	if hash, err := h.Get("foo"); err != nil || hash != "bar" {
+		t.Errorf("expected the stored hash got: %q %v", hash, err)
+	}
+	if hash, err := h.Get("missing"); err != nil || hash != "" {
+		t.Errorf("expected no hash for a missing app got: %q %v", hash, err)
+	}
+
+	for _, name := range []string{"foo", "baz"} {
+		if err := h.Add(name, name+"-hash"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hash, _ := h.Get("baz"); hash != "baz-hash" {
+		t.Errorf("expected the added hash got: %q", hash)
+	}
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if puts != 1 || stored["foo"] != "foo-hash" || stored["baz"] != "baz-hash" {
+		t.Errorf("expected a single put of every hash got %d puts: %v", puts, stored)
+	}
+}
+
+func TestHTTPHashStore_ReadStrategy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("expected read-only store not to write got a %s", r.Method)
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	h, err := NewHTTPHashStore(srv.URL, HashStrategyRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Add("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewHTTPHashStore("", HashStrategyRead); err == nil {
+		t.Error("expected a store without a url to fail")
+	}
+}
+
+func TestMigratingHashStore(t *testing.T) {
+	output := t.TempDir()
+	sumfile := NewSumFileStore(output, HashStrategyReadWrite)
+	for name, hash := range map[string]string{"cached": "1", "stale": "2"} {
+		if err := os.MkdirAll(filepath.Join(output, name), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := sumfile.Add(name, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(output, "hashes.json")
+	to, err := NewJSONHashStore(path, HashStrategyReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewMigratingHashStore(NewSumFileStore(output, HashStrategyRead), to)
+	for name, expected := range map[string]string{"cached": "1", "stale": "2", "new": ""} {
+		if hash, err := h.Get(name); err != nil || hash != expected {
+			t.Errorf("expected %s to be %q got: %q %v", name, expected, hash, err)
+		}
+	}
+	for name, hash := range map[string]string{"stale": "3", "new": "4"} {
+		if err := h.Add(name, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.Prune(map[string]bool{"cached": true, "stale": true, "new": true})
+	if err := h.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := NewJSONHashStore(path, HashStrategyRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"cached": "1", "stale": "3", "new": "4"} {
+		if hash, err := migrated.Get(name); err != nil || hash != expected {
+			t.Errorf("expected the migrated %s to be %q got: %q %v", name, expected, hash, err)
+		}
+	}
+	if hash, err := sumfile.Get("stale"); err != nil || hash != "2" {
+		t.Errorf("expected the store migrated from to be left as it is got: %q %v", hash, err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/gobwas/glob"
+)
+
+// readIgnoreFile reads the names of the applications to ignore from path. Every
+// line holds a name or a glob, and empty lines and lines starting with `#` are
+// left out.
+func readIgnoreFile(path string) ([]glob.Glob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []glob.Glob
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		g, err := glob.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q in %s: %w", line, path, err)
+		}
+		patterns = append(patterns, g)
+	}
+	return patterns, scanner.Err()
+}
+
+// ignored reports whether name matches one of the patterns of the ignore file.
+func (w *Walker) ignored(name string) bool {
+	for _, g := range w.ignore {
+		if g.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipped reports whether the application opted out of rendering with the skip
+// annotation.
+func (w *Walker) skipped(crd *v1alpha1.Application) bool {
+	return w.skipAnnotation != "" && crd.ObjectMeta.Annotations[w.skipAnnotation] == "true"
+}
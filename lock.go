@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errOutputLocked is returned by lockDir when another process holds the lock.
+var errOutputLocked = errors.New("output locked")
+
+// lockFileName is the file in the output locked on Windows, where directories
+// can't be locked. Cleaning the output keeps it.
+const lockFileName = ".mani-diffy.lock"
+
+// lockOutput takes the lock of outputPath when lock is set, and returns the
+// function releasing it. Another run holding it is an error rather than
+// waiting for it, since both would render the same applications. The lock is
+// released by the system if the run is killed, so an interrupted run never
+// leaves it behind.
+func (w *Walker) lockOutput(outputPath string) (func(), error) {
+	if !w.lock {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	unlock, err := lockDir(outputPath)
+	if errors.Is(err, errOutputLocked) {
+		return nil, fmt.Errorf("%s is locked by another mani-diffy run, wait for it to finish or pass -no-lock", outputPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error locking %s: %w", outputPath, err)
+	}
+	return unlock, nil
+}
+
+// startWalk prepares outputPath for a walk: it takes the lock of outputPath,
+// then cleans it when clean is set, so the output of a concurrent run is never
+// removed, and removes the failures of the previous run. It returns the
+// function releasing the lock.
+func (w *Walker) startWalk(outputPath string) (func(), error) {
+	unlock, err := w.lockOutput(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	if w.clean {
+		if err := cleanOutput(outputPath); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	if err := w.resetFailures(); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestLockOutput(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "app")
+
+	renderer := &fakeRenderer{t: t}
+	w := &Walker{
+		CopySource: renderer.Render,
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+		lock:         true,
+	}
+
+	// Another run rendering into the same output.
+	unlock, err := w.lockOutput(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore())
+	if err == nil || !strings.Contains(err.Error(), "locked by another mani-diffy run") {
+		t.Errorf("expected the walk to fail while the output is locked got: %v", err)
+	}
+	if len(renderer.rendered) > 0 {
+		t.Errorf("expected nothing to be rendered got: %v", renderer.rendered)
+	}
+
+	unlock()
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore()); err != nil {
+		t.Fatal(err)
+	}
+	// The walk released the lock once done.
+	unlock, err = w.lockOutput(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestLockOutputClean(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "app")
+	stale := filepath.Join(output, "stale", "manifest.yaml")
+	if err := os.MkdirAll(filepath.Dir(stale), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("kind: ConfigMap\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	renderer := &fakeRenderer{t: t}
+	w := &Walker{
+		CopySource: renderer.Render,
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+		lock:         true,
+		clean:        true,
+	}
+
+	// The output of another run isn't cleaned while it renders.
+	unlock, err := w.lockOutput(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore()); err == nil {
+		t.Error("expected the walk to fail while the output is locked")
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("expected the locked output to be kept: %v", err)
+	}
+
+	unlock()
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the output to be cleaned once locked got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "app")); err != nil {
+		t.Errorf("expected the application to be rendered after cleaning: %v", err)
+	}
+}
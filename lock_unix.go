@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockDir takes an flock on the directory at path itself, so locking leaves
+// no file behind.
+func lockDir(path string) (func(), error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(dir.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		dir.Close()
+		return nil, errOutputLocked
+	}
+	if err != nil {
+		dir.Close()
+		return nil, err
+	}
+	return func() {
+		// Closing the directory releases the lock.
+		dir.Close()
+	}, nil
+}
@@ -1,30 +1,40 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"os/exec"
 
 	"path/filepath"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/chime/mani-diffy/pkg/applicationset"
+	"github.com/chime/mani-diffy/pkg/directory"
 	"github.com/chime/mani-diffy/pkg/helm"
 	"github.com/chime/mani-diffy/pkg/kustomize"
+	"github.com/chime/mani-diffy/pkg/plugin"
 
 	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/gobwas/glob"
 )
 
 const InfiniteDepth = -1
 
 // Renderer is a function that can render an Argo application.
-type Renderer func(*v1alpha1.Application, string) error
+type Renderer func(context.Context, *v1alpha1.Application, string) error
 
 // PostRenderer is a function that can be called after an Argo application is rendered.
-type PostRenderer func(string) error
+type PostRenderer func(context.Context, string) error
 
 // Walker walks a directory tree looking for Argo applications and renders them
 // using a depth first search.
@@ -39,244 +49,1422 @@ type Walker struct {
 	PostRender PostRenderer
 
 	// GenerateHash is used to generate a cache key for an Argo application
-	GenerateHash func(*v1alpha1.Application) (string, error)
+	GenerateHash func(context.Context, *v1alpha1.Application) (string, error)
+
+	// Diff, when set, is called with the files an application rendered before
+	// and after every render.
+	Diff func(name string, before, after map[string]string) error
+
+	// Renderers are consulted in order before the built-in renderers, and
+	// the first one matching an application renders it.
+	Renderers []SourceRenderer
 
 	ignoreSuffix string
+
+	// ignore holds the patterns of the ignore file. Matching applications
+	// are neither rendered nor pruned.
+	ignore []glob.Glob
+
+	// skipAnnotation is the annotation marking applications that are neither
+	// rendered nor pruned when it is set to "true".
+	skipAnnotation string
+
+	// splitManifests is set when rendered Helm manifests are split into one
+	// file per resource.
+	splitManifests bool
+
+	// only, when set, limits rendering to the applications whose name it
+	// matches.
+	only glob.Glob
+
+	// changed, when set, limits rendering to the applications affected by
+	// the files in it. The output of every application rendered is added
+	// to it, so the applications it defines are checked too.
+	changed *changeSet
+
+	// progressInterval, when set, is how often the progress of a walk is
+	// logged.
+	progressInterval time.Duration
+
+	// showWarnings collects the warnings helm prints for every application
+	// in its result.
+	showWarnings bool
+
+	// renderTimeout, when set, is how long a single application may take
+	// to render.
+	renderTimeout time.Duration
+
+	// compress is set when rendered Helm manifests are compressed.
+	compress bool
+
+	// outputFormat is the format rendered Helm manifests are written in.
+	outputFormat string
+
+	// manifestFilename is the name of the file rendered Helm manifests are
+	// written to.
+	manifestFilename string
+
+	// warnDuplicates logs applications with the same name as one rendered
+	// earlier instead of failing the walk.
+	warnDuplicates bool
+
+	// prune removes stale output after walks bounded by a max depth too.
+	// Walks with an infinite depth always prune.
+	prune bool
+
+	// failuresDir, when set, keeps the error and the partial output of
+	// every application that failed in <failuresDir>/<application>.
+	failuresDir string
+
+	// pathRewrites rewrite the source paths of every application before
+	// it's hashed and rendered.
+	pathRewrites []pathRewrite
+
+	// renderRoot renders the root of the tree first when it is a Helm
+	// chart, and walks its output instead of the root itself.
+	renderRoot bool
+
+	// digests, when set, records the digest of the output of every
+	// application rendered, which Verify checks the committed output
+	// against.
+	digests HashStore
+
+	// lock holds a lock on the output during walks, so a concurrent run
+	// on the same output fails instead of corrupting its hashes.
+	lock bool
+
+	// clean removes the output once it's locked, before walks, so every
+	// application is rendered from scratch.
+	clean bool
+
+	// concurrency is how many of the applications found in the same file
+	// are rendered at once. They are rendered one at a time when it's
+	// under 2.
+	concurrency int
 }
 
-// Walk walks a directory tree looking for Argo applications and renders them
-func (w *Walker) Walk(inputPath, outputPath string, maxDepth int, hashes HashStore) error {
-	visited := make(map[string]bool)
+// Walk walks a directory tree looking for Argo applications and renders them.
+// The returned summary records the outcome of every application that was
+// visited, including when the walk fails partway. Once ctx is done no more
+// applications are rendered.
+func (w *Walker) Walk(ctx context.Context, inputPath, outputPath string, maxDepth int, hashes HashStore) (*Summary, error) {
+	summary := NewSummary()
+	stop := reportProgress(summary, w.progressInterval)
+	err := w.walkTree(ctx, inputPath, outputPath, maxDepth, hashes, summary)
+	stop()
+	summary.Finish(err)
+	return summary, err
+}
+
+// WalkReader renders the applications read from r into outputPath. Unlike
+// Walk, their descendants are not rendered and nothing is pruned.
+func (w *Walker) WalkReader(ctx context.Context, r io.Reader, outputPath string, hashes HashStore) (*Summary, error) {
+	summary := NewSummary()
+	stop := reportProgress(summary, w.progressInterval)
+	err := w.walkReader(ctx, r, outputPath, hashes, summary)
+	stop()
+	summary.Finish(err)
+	return summary, err
+}
 
-	if err := w.walk(inputPath, outputPath, 0, maxDepth, visited, hashes); err != nil {
+func (w *Walker) walkReader(ctx context.Context, r io.Reader, outputPath string, hashes HashStore, summary *Summary) error {
+	crds, appSets, err := helm.Decode(r)
+	if err != nil {
+		return err
+	}
+	unlock, err := w.startWalk(outputPath)
+	if err != nil {
 		return err
 	}
+	defer unlock()
 
+	errs := w.walkApps(ctx, crds, appSets, "-", outputPath, 0, 0, make(map[string]string), hashes, summary)
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
 	if err := hashes.Save(); err != nil {
+		errs = append(errs, err)
+	}
+	if w.digests != nil {
+		if err := w.digests.Save(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *Walker) walkTree(ctx context.Context, inputPath, outputPath string, maxDepth int, hashes HashStore, summary *Summary) error {
+	unlock, err := w.startWalk(outputPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	visited := make(map[string]string)
+
+	root, err := w.rootApplication(inputPath)
+	if err != nil {
 		return err
 	}
+	var errs []error
+	if root != nil {
+		// The root applications are in the output of the root chart, one
+		// level down, so they are still at depth 0.
+		errs = w.walkApps(ctx, []*v1alpha1.Application{root}, nil, inputPath, outputPath, -1, maxDepth, visited, hashes, summary)
+	} else {
+		errs = w.walk(ctx, inputPath, outputPath, 0, maxDepth, visited, hashes, summary)
+	}
+	if err := ctx.Err(); err != nil {
+		// The walk was cut short, so the applications that were not reached
+		// were never visited.
+		errs = append(errs, err)
+	}
+
+	// When every application was visited, the hashes of the ones that
+	// weren't are stale, like the directories pruned below.
+	complete := len(errs) == 0 && (maxDepth == InfiniteDepth || w.prune)
+	if store, ok := hashes.(prunableHashStore); ok && complete {
+		keep := make(map[string]bool, len(visited))
+		for path := range visited {
+			keep[filepath.Base(path)] = true
+		}
+		store.Prune(keep)
+	}
 
-	if maxDepth == InfiniteDepth {
+	// Save the hashes of the applications that did render, so they don't
+	// have to be rendered again on the next run.
+	if err := hashes.Save(); err != nil {
+		errs = append(errs, err)
+	}
+	if w.digests != nil {
+		if err := w.digests.Save(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		// Descendants of the applications that failed were never visited,
+		// so pruning now would delete their output.
+		return errors.Join(errs...)
+	}
+
+	if complete {
 		return pruneUnvisited(visited, outputPath)
 	}
 
 	return nil
 }
 
-func pruneUnvisited(visited map[string]bool, outputPath string) error {
-	files, err := os.ReadDir(outputPath)
-	if err != nil {
-		return err
+// pruneUnvisited removes every directory under outputPath that was not
+// visited during the walk. The contents of visited directories belong to their
+// application and are left alone, as are the intermediate directories leading
+// to a visited directory.
+func pruneUnvisited(visited map[string]string, outputPath string) error {
+	ancestors := make(map[string]bool)
+	for path := range visited {
+		for dir := filepath.Dir(path); dir != outputPath && dir != "." && !ancestors[dir]; dir = filepath.Dir(dir) {
+			ancestors[dir] = true
+		}
 	}
 
-	for _, f := range files {
-		if !f.IsDir() {
-			continue
+	return filepath.WalkDir(outputPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == outputPath {
+			return nil
 		}
 
-		path := filepath.Join(outputPath, f.Name())
-		if visited[path] {
-			continue
+		if _, ok := visited[path]; ok {
+			return filepath.SkipDir
 		}
+		if ancestors[path] {
+			return nil
+		}
+
 		if err := os.RemoveAll(path); err != nil {
 			return err
 		}
-	}
-
-	return nil
+		return filepath.SkipDir
+	})
 }
 
-func (w *Walker) walk(inputPath, outputPath string, depth, maxDepth int, visited map[string]bool, hashes HashStore) error {
+// walk renders every application found in inputPath and its descendants. It
+// keeps going when an application fails and returns the errors of every
+// application that failed, each prefixed with the application's output path.
+//
+// Applications are walked in the order of the files in a directory and of the
+// documents in a file, so the errors and summary of two runs over the same
+// inputs are identical. Unless the concurrency is over 1, they are rendered
+// one at a time too, so a single helm process runs however deep the tree is.
+func (w *Walker) walk(ctx context.Context, inputPath, outputPath string, depth, maxDepth int, visited map[string]string, hashes HashStore, summary *Summary) []error {
 	if maxDepth != InfiniteDepth {
 		// If we've reached the max depth, stop walking
 		if depth > maxDepth {
+			if w.prune {
+				// The applications below are not rendered, but
+				// their output is still in use.
+				return w.markDescendants(inputPath, outputPath, visited)
+			}
 			return nil
 		}
 	}
 
-	log.Println("Dropping into", inputPath)
+	slog.Debug("Dropping into", "path", inputPath)
 
-	fi, err := os.ReadDir(inputPath)
+	sources, err := w.manifestFiles(inputPath, outputPath)
 	if err != nil {
-		return err
+		return []error{err}
 	}
-	for _, file := range fi {
-		if !strings.Contains(file.Name(), ".yaml") {
+
+	var errs []error
+	for _, source := range sources {
+		crds, appSets, err := helm.ReadAll(source)
+		if err != nil {
+			errs = append(errs, err)
 			continue
 		}
+		errs = append(errs, w.walkApps(ctx, crds, appSets, source, outputPath, depth, maxDepth, visited, hashes, summary)...)
+	}
+	return errs
+}
 
-		crds, err := helm.Read(filepath.Join(inputPath, file.Name()))
+// markDescendants marks the output of the applications found in inputPath and
+// their descendants as visited without rendering them, so pruning after a walk
+// bounded by a max depth keeps the output of the applications it didn't reach.
+func (w *Walker) markDescendants(inputPath, outputPath string, visited map[string]string) []error {
+	sources, err := w.manifestFiles(inputPath, outputPath)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, source := range sources {
+		crds, appSets, err := helm.ReadAll(source)
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			continue
 		}
-		for _, crd := range crds {
-			if crd.Kind != "Application" {
+		for _, appSet := range appSets {
+			apps, err := applicationset.Expand(appSet)
+			if err != nil {
+				errs = append(errs, err)
 				continue
 			}
+			crds = append(crds, apps...)
+		}
 
-			if strings.HasSuffix(crd.ObjectMeta.Name, w.ignoreSuffix) {
+		for _, crd := range crds {
+			if crd.Kind != "Application" || strings.HasSuffix(crd.ObjectMeta.Name, w.ignoreSuffix) {
 				continue
 			}
 
-			path := filepath.Join(outputPath, crd.ObjectMeta.Name)
-			visited[path] = true
-
-			hash, err := hashes.Get(crd.ObjectMeta.Name)
-			// COMPARE HASHES HERE. STEP INTO RENDER IF NO MATCH
+			path, err := appOutput(outputPath, crd)
 			if err != nil {
-				return err
+				// There is no output to keep.
+				continue
 			}
-
-			hashGenerated, err := w.GenerateHash(crd)
-			if err != nil {
-				if errors.Is(err, kustomize.ErrNotSupported) {
-					continue
-				}
-				return err
+			if _, ok := visited[path]; ok {
+				continue
 			}
+			visited[path] = source
 
-			emptyManifest, err := helm.EmptyManifest(filepath.Join(path, "manifest.yaml"))
-			if err != nil {
-				return err
+			if w.ignored(crd.ObjectMeta.Name) || w.skipped(crd) {
+				continue
+			}
+			if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+				// Never rendered, so there is nothing to keep.
+				continue
 			}
+			errs = append(errs, w.markDescendants(path, outputPath, visited)...)
+		}
+	}
+	return errs
+}
 
-			if hashGenerated != hash || emptyManifest {
-				log.Printf("No match detected. Render: %s\n", crd.ObjectMeta.Name)
-				if err := w.Render(crd, path); err != nil {
-					if errors.Is(err, kustomize.ErrNotSupported) {
-						continue
-					}
-					return err
-				}
-
-				if err := hashes.Add(crd.ObjectMeta.Name, hashGenerated); err != nil {
-					return err
-				}
+// appOutput returns the directory crd renders into, in outputPath. An
+// application without a name would render into outputPath itself and replace
+// the output of every other application, so it's an error.
+func appOutput(outputPath string, crd *v1alpha1.Application) (string, error) {
+	if crd.ObjectMeta.Name == "" {
+		return "", errors.New("application without metadata.name")
+	}
+	return filepath.Join(outputPath, crd.ObjectMeta.Name), nil
+}
+
+// manifestFiles returns the paths of the manifests in inputPath, in lexical
+// order. The output of an application, inside outputPath, is searched
+// recursively, so the applications in the subdirectories of a directory
+// source copied with recurse are found too. Any other input, like the root of
+// the tree, is only searched at its top level.
+func (w *Walker) manifestFiles(inputPath, outputPath string) ([]string, error) {
+	var files []string
+	if rel, err := filepath.Rel(outputPath, inputPath); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		entries, err := os.ReadDir(inputPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range entries {
+			if w.isManifest(file) {
+				files = append(files, filepath.Join(inputPath, file.Name()))
 			}
+		}
+		return files, nil
+	}
 
-			if err := w.walk(path, outputPath, depth+1, maxDepth, visited, hashes); err != nil {
-				return err
+	err := filepath.WalkDir(inputPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if w.isManifest(d) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// isManifest reports whether file is a YAML file that may hold applications,
+// including the compressed manifests written with -compress. JSON files are
+// only when the manifests are written as JSON.
+func (w *Walker) isManifest(file fs.DirEntry) bool {
+	if file.IsDir() {
+		return false
+	}
+	ext := filepath.Ext(strings.TrimSuffix(file.Name(), ".gz"))
+	return ext == ".yaml" || ext == ".yml" || (ext == ".json" && w.outputFormat == helm.FormatJSON)
+}
+
+// walkApps renders the applications read from the file source, including the
+// ones generated by its ApplicationSets, and walks their descendants. With a
+// concurrency over 1, those applications are rendered concurrently before
+// their descendants are walked, see walkAppsConcurrently.
+func (w *Walker) walkApps(ctx context.Context, crds []*v1alpha1.Application, appSets []*v1alpha1.ApplicationSet, source, outputPath string, depth, maxDepth int, visited map[string]string, hashes HashStore, summary *Summary) []error {
+	var errs []error
+	for _, appSet := range appSets {
+		apps, err := applicationset.Expand(appSet)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		crds = append(crds, apps...)
+	}
+	if w.concurrency > 1 {
+		return append(errs, w.walkAppsConcurrently(ctx, crds, source, outputPath, depth, maxDepth, visited, hashes, summary)...)
+	}
+
+	for _, crd := range crds {
+		if ctx.Err() != nil {
+			return errs
+		}
+
+		step := w.planApp(crd, source, outputPath, visited, summary)
+		errs = append(errs, step.errs...)
+		switch {
+		case step.descend:
+			errs = append(errs, w.walk(ctx, step.path, outputPath, depth, maxDepth, visited, hashes, summary)...)
+		case step.render:
+			result, err := w.sync(ctx, step.crd, step.path, hashes)
+			errs = append(errs, w.finishApp(ctx, step, result, err, outputPath, depth, maxDepth, visited, hashes, summary)...)
+		}
+	}
+	return errs
+}
+
+// walkAppsConcurrently is walkApps rendering up to concurrency of the
+// applications in crds at once. Their descendants are only walked once they
+// are all rendered, one application after the other, so the results and
+// errors are recorded in the same order as with a single render at a time.
+func (w *Walker) walkAppsConcurrently(ctx context.Context, crds []*v1alpha1.Application, source, outputPath string, depth, maxDepth int, visited map[string]string, hashes HashStore, summary *Summary) []error {
+	var steps []appStep
+	for _, crd := range crds {
+		if ctx.Err() != nil {
+			break
+		}
+		steps = append(steps, w.planApp(crd, source, outputPath, visited, summary))
+	}
+
+	type synced struct {
+		started bool
+		result  AppResult
+		err     error
+	}
+	results := make([]synced, len(steps))
+	locked := &lockedHashStore{HashStore: hashes}
+	sem := make(chan struct{}, w.concurrency)
+	var wg sync.WaitGroup
+	for i, step := range steps {
+		if !step.render {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, step appStep) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				// Like the applications a sequential walk doesn't
+				// reach, it isn't recorded.
+				return
 			}
+			results[i].started = true
+			results[i].result, results[i].err = w.sync(ctx, step.crd, step.path, locked)
+		}(i, step)
+	}
+	wg.Wait()
+
+	// The applications that rendered are recorded even when ctx is done,
+	// since their hashes were stored. The walks of their descendants stop
+	// right away then.
+	var errs []error
+	for i, step := range steps {
+		errs = append(errs, step.errs...)
+		switch {
+		case step.descend:
+			errs = append(errs, w.walk(ctx, step.path, outputPath, depth, maxDepth, visited, hashes, summary)...)
+		case step.render && results[i].started:
+			errs = append(errs, w.finishApp(ctx, step, results[i].result, results[i].err, outputPath, depth, maxDepth, visited, hashes, summary)...)
 		}
 	}
-	return nil
+	return errs
+}
+
+// An appStep is what walking a single application found in a file does.
+type appStep struct {
+	crd  *v1alpha1.Application
+	path string
+
+	// render is set when the application is synced before its descendants
+	// are walked, and descend when only its descendants are walked.
+	render  bool
+	descend bool
+
+	errs []error
+}
+
+// planApp returns what walking crd, read from the file source, does: nothing
+// for the applications that are ignored or fail before rendering, like
+// duplicates, walking the descendants of the ones left as they are by -only
+// and -changed-since, and rendering the others.
+func (w *Walker) planApp(crd *v1alpha1.Application, source, outputPath string, visited map[string]string, summary *Summary) appStep {
+	step := appStep{crd: crd}
+	if crd.Kind != "Application" {
+		return step
+	}
+
+	if strings.HasSuffix(crd.ObjectMeta.Name, w.ignoreSuffix) {
+		return step
+	}
+
+	summary.discover()
+	path, err := appOutput(outputPath, crd)
+	if err != nil {
+		step.errs = append(step.errs, fmt.Errorf("%s: %w", source, err))
+		return step
+	}
+	step.path = path
+	if first, ok := visited[path]; ok {
+		// Both applications would render into the same directory,
+		// and whichever renders last would win.
+		err := fmt.Errorf("application %s in %s has the same output as the one in %s", crd.ObjectMeta.Name, source, first)
+		if !w.warnDuplicates {
+			step.errs = append(step.errs, fmt.Errorf("%s: %w", path, err))
+			return step
+		}
+		slog.Warn("Duplicate application", "path", path, "error", err)
+	} else {
+		visited[path] = source
+	}
+
+	if w.ignored(crd.ObjectMeta.Name) || w.skipped(crd) {
+		return step
+	}
+
+	if w.only != nil && !w.only.Match(crd.ObjectMeta.Name) {
+		// Leave the application as it is, but keep looking for
+		// matches among its descendants. It doesn't count towards
+		// the depth, so nested matches are found with -max-depth too.
+		step.descend = true
+		return step
+	}
+
+	w.rewritePaths(crd)
+
+	if w.changed != nil && !w.changed.affects(crd, source) {
+		// Like -only, the application is left as it is without even
+		// reading its chart, but its descendants may be affected.
+		step.descend = true
+		return step
+	}
+
+	step.render = true
+	return step
+}
+
+// finishApp records the result of syncing the application of step, which
+// failed with err if it isn't nil, and walks its descendants once it
+// rendered.
+func (w *Walker) finishApp(ctx context.Context, step appStep, result AppResult, err error, outputPath string, depth, maxDepth int, visited map[string]string, hashes HashStore, summary *Summary) []error {
+	crd, path := step.crd, step.path
+	if kind, ok := unsupportedSource(err); ok {
+		result.Status = StatusSkipped
+		result.unsupported = kind
+		summary.Add(result)
+		return nil
+	}
+	if err != nil {
+		result.Status = StatusFailed
+		result.Error = err.Error()
+		summary.Add(result)
+		errs := []error{newRenderError(crd, path, err)}
+		if err := w.recordFailure(crd.ObjectMeta.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+
+	var errs []error
+	w.measureOutput(&result, path)
+	if result.Status == StatusRendered {
+		if err := w.recordDigest(crd.ObjectMeta.Name, path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	summary.Add(result)
+	if w.changed != nil && result.Status == StatusRendered {
+		w.changed.add(path)
+	}
+
+	return append(errs, w.walk(ctx, path, outputPath, depth+1, maxDepth, visited, hashes, summary)...)
+}
+
+// sync renders an application into path when its generated hash no longer
+// matches the one in the hash store.
+func (w *Walker) sync(ctx context.Context, crd *v1alpha1.Application, path string, hashes HashStore) (AppResult, error) {
+	result := AppResult{Name: crd.ObjectMeta.Name}
+
+	hash, err := hashes.Get(crd.ObjectMeta.Name)
+	// COMPARE HASHES HERE. STEP INTO RENDER IF NO MATCH
+	if err != nil {
+		return result, err
+	}
+
+	result.Hash, err = w.GenerateHash(ctx, crd)
+	if err != nil {
+		return result, err
+	}
+
+	var emptyManifest bool
+	if w.splitManifests {
+		emptyManifest, err = helm.EmptyManifestDir(path)
+	} else {
+		emptyManifest, err = helm.EmptyManifest(filepath.Join(path, helm.ManifestName(w.manifestFilename, w.outputFormat, w.compress)))
+	}
+	if err != nil {
+		return result, err
+	}
+
+	if result.Hash == hash && !emptyManifest {
+		result.Status = StatusCacheHit
+		return result, nil
+	}
+
+	slog.Info("No match detected, rendering", "app", crd.ObjectMeta.Name)
+	var warnings func() []string
+	if w.showWarnings {
+		ctx, warnings = helm.WithWarnings(ctx)
+	}
+
+	start := time.Now()
+	err = w.renderWithTimeout(helm.WithHash(ctx, result.Hash), crd, path)
+	result.duration = time.Since(start)
+	result.Duration = result.duration.String()
+	if warnings != nil {
+		result.Warnings = warnings()
+		for _, warning := range result.Warnings {
+			slog.Warn("Helm warning", "app", crd.ObjectMeta.Name, "warning", warning)
+		}
+	}
+	if err != nil {
+		return result, err
+	}
+
+	if err := hashes.Add(crd.ObjectMeta.Name, result.Hash); err != nil {
+		return result, err
+	}
+
+	result.Status = StatusRendered
+	return result, nil
 }
 
-func (w *Walker) Render(application *v1alpha1.Application, output string) error {
-	log.Println("Render", application.ObjectMeta.Name)
+// renderWithTimeout renders crd into path, giving up once the render timeout
+// is over. Commands started with the context are killed when that happens.
+func (w *Walker) renderWithTimeout(ctx context.Context, crd *v1alpha1.Application, path string) error {
+	if w.renderTimeout <= 0 {
+		return w.Render(ctx, crd, path)
+	}
+
+	renderCtx, cancel := context.WithTimeout(ctx, w.renderTimeout)
+	defer cancel()
+	err := w.Render(renderCtx, crd, path)
+	if err != nil && ctx.Err() == nil && errors.Is(renderCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("rendering %s timed out after %s: %w", crd.ObjectMeta.Name, w.renderTimeout, err)
+	}
+	return err
+}
 
-	var render Renderer
+func (w *Walker) Render(ctx context.Context, application *v1alpha1.Application, output string) error {
+	slog.Debug("Render", "app", application.ObjectMeta.Name)
 
 	// Figure out which renderer to use
-	switch {
-	case application.Spec.Source.Helm != nil:
-		render = w.HelmTemplate
-	case application.Spec.Source.Kustomize != nil:
-		log.Println("WARNING: kustomize not supported")
-		return kustomize.ErrNotSupported
-	default:
-		render = w.CopySource
+	render := w.renderer(application)
+
+	var before map[string]string
+	if w.Diff != nil {
+		var err error
+		if before, err = readFiles(output); err != nil {
+			return err
+		}
 	}
 
-	// Make sure the directory is empty before rendering.
-	if err := os.RemoveAll(output); err != nil {
+	// Render into an empty directory next to output, so the previous output
+	// is left untouched when rendering fails.
+	tmp, err := os.MkdirTemp(filepath.Dir(output), ".render-")
+	if err != nil {
 		return err
 	}
+	defer os.RemoveAll(tmp)
+	rendered := filepath.Join(tmp, filepath.Base(output))
 
 	// Render
-	if err := render(application, output); err != nil {
-		return err
+	if err := render(ctx, application, rendered); err != nil {
+		return errors.Join(err, w.keepPartialOutput(application.ObjectMeta.Name, rendered))
 	}
 
 	// Call the post renderer to do any post processing
 	if w.PostRender != nil {
-		if err := w.PostRender(output); err != nil {
-			return fmt.Errorf("post render failed: %w", err)
+		if err := w.PostRender(ctx, rendered); err != nil {
+			return errors.Join(fmt.Errorf("post render failed: %w", err), w.keepPartialOutput(application.ObjectMeta.Name, rendered))
 		}
 	}
 
+	if w.Diff != nil {
+		after, err := readFiles(rendered)
+		if err != nil {
+			return err
+		}
+		if err := w.Diff(application.ObjectMeta.Name, before, after); err != nil {
+			return err
+		}
+	}
+
+	return replaceDir(rendered, output, tmp)
+}
+
+// replaceDir moves src to dst, replacing whatever dst held. The previous
+// content of dst is moved to trash first, which must be on the same file
+// system.
+func replaceDir(src, dst, trash string) error {
+	// When nothing was rendered dst is still replaced, by an empty directory.
+	if err := os.MkdirAll(src, os.ModePerm); err != nil {
+		return err
+	}
+
+	old := filepath.Join(trash, "previous")
+	if err := os.Rename(dst, old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// renderSources renders an application with multiple sources. The Helm
+// sources are rendered together by HelmTemplate, which combines their output
+// into a single manifest, and every other source is copied.
+func (w *Walker) renderSources(ctx context.Context, application *v1alpha1.Application, output string) error {
+	sources, err := helm.Sources(application)
+	if err != nil {
+		return err
+	}
+
+	hasHelm := false
+	for _, source := range sources {
+		switch {
+		case helm.IsHelm(source.Spec.Source):
+			hasHelm = true
+		case source.Spec.Source.Kustomize != nil:
+			slog.Warn("kustomize not supported", "app", application.ObjectMeta.Name)
+			return kustomize.ErrNotSupported
+		case source.Spec.Source.Plugin != nil:
+			return pluginError(application, source.Spec.Source)
+		default:
+			if err := w.CopySource(ctx, source, output); err != nil {
+				return err
+			}
+		}
+	}
+
+	if hasHelm {
+		return w.HelmTemplate(ctx, application, output)
+	}
 	return nil
 }
 
-func HelmTemplate(application *v1alpha1.Application, output string) error {
-	return helm.Run(application, output, "", "")
+// pluginError is the error of an application with a source rendered by a
+// config management plugin.
+func pluginError(application *v1alpha1.Application, source *v1alpha1.ApplicationSource) error {
+	name := source.Plugin.Name
+	if name == "" {
+		name = "discovered by Argo"
+	}
+	slog.Warn("config management plugin not supported", "app", application.ObjectMeta.Name, "plugin", name)
+	return fmt.Errorf("application %s is rendered by the config management plugin %s: %w", application.ObjectMeta.Name, name, plugin.ErrNotSupported)
+}
+
+func HelmTemplate(ctx context.Context, application *v1alpha1.Application, output string) error {
+	return helm.Run(ctx, application, output, helm.Options{})
 }
 
-func CopySource(application *v1alpha1.Application, output string) error {
-	cmd := exec.Command("cp", "-r", application.Spec.Source.Path+"/.", output)
-	return cmd.Run()
+func CopySource(_ context.Context, application *v1alpha1.Application, output string) error {
+	return directory.Copy(application.Spec.Source.Path, output, application.Spec.Source.Directory)
 }
 
 func PostRender(command string) PostRenderer {
-	return func(output string) error {
-		cmd := exec.Command(command, output)
+	return func(ctx context.Context, output string) error {
+		cmd := exec.CommandContext(ctx, command, output)
 		cmd.Stderr = os.Stderr
 		return cmd.Run()
 	}
 }
 
+// The exit codes of mani-diffy, so CI can tell a failed run from one finding
+// drift.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitDrift = 2
+)
+
+// usage prints the usage of the flags of flags along with the exit codes.
+func usage(flags *flag.FlagSet) {
+	out := flags.Output()
+	fmt.Fprintf(out, "Usage: %s [check|verify|duplicates|serve] [flags]\n       %s render [flags] <file>\n", flags.Name(), flags.Name())
+	flags.PrintDefaults()
+	fmt.Fprintf(out, `
+Exit codes:
+  %d  success, and no drift found by check, -diff-only or -ci
+  %d  error, e.g. a chart failing to render or an invalid flag
+  %d  drift: check found output that differs from a fresh render,
+     -diff-only printed a diff, -ci found changes to the output, or
+     verify found output that doesn't match its hash or digest
+`, exitOK, exitError, exitDrift)
+}
+
+// buildVersion is the version of the mani-diffy module in the binary, e.g.
+// `v1.2.0` when installed with `go install`.
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return ""
+}
+
 func main() {
-	root := flag.String("root", "bootstrap", "Directory to initially look for k8s manifests containing Argo applications. The root of the tree.")
+	// Invalid flags are errors like any other, instead of the exit code 2
+	// of the flag package, which is the one of drift.
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.CommandLine.Usage = func() { usage(flag.CommandLine) }
+
+	// The first argument may name a subcommand, e.g. `mani-diffy serve`.
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	configFile := flag.String("config", "", "Config file setting the default of every flag, keyed by the flag names. Flags on the command line override it. Defaults to `.mani-diffy.yaml` when it exists.")
+	root := flag.String("root", "bootstrap", "Directory to initially look for k8s manifests containing Argo applications. The root of the tree. When `-`, the applications are read from stdin and rendered without their descendants.")
 	workdir := flag.String("workdir", ".", "Directory to run the command in.")
-	renderDir := flag.String("output", ".zz.auto-generated", "Path to store the compiled Argo applications.")
+	renderDir := flag.String("output", ".zz.auto-generated", "Path to store the compiled Argo applications. When `-` with `mani-diffy render`, the rendered manifests are printed to stdout instead.")
+	clean := flag.Bool("clean", false, "Remove the output and ignore the stored hashes before rendering, so every application is rendered from scratch.")
 	maxDepth := flag.Int("max-depth", InfiniteDepth, "Maximum depth for the depth first walk.")
-	hashStore := flag.String("hash-store", "sumfile", "The hashing backend to use. Can be `sumfile` or `json`.")
+	warnDuplicates := flag.Bool("warn-duplicates", false, "Only log a warning when two applications have the same name, instead of failing. Whichever renders last wins.")
+	prune := flag.Bool("prune", false, "Remove stale output when -max-depth is set too. The output of the applications below the max depth is kept.")
+	hashStore := flag.String("hash-store", "sumfile", "The hashing backend to use. Can be `sumfile`, `json`, `sqlite`, which needs a build with cgo, or `http`.")
+	migrateHashStore := flag.String("migrate-hash-store", "", "When provided, hashes are read from this store and written to -hash-store, so a single run converts the cache without losing its hits. Can be `sumfile`, `json`, `sqlite`, which needs a build with cgo, or `http`.")
+	hashStoreURL := flag.String("hash-store-url", "", "Base URL of the `http` hash store.")
+	sumfileConsolidated := flag.Bool("sumfile-consolidated", false, "Keep the hashes of the `sumfile` store in a single hash.sum at the root of the output instead of one per application.")
+	checkpointInterval := flag.Duration("checkpoint-interval", 0, "When provided, how often the `json` hash store saves the hashes of the applications rendered so far, e.g. `30s`, so an interrupted run doesn't render them again. By default, hashes.json is only written at the end of the run.")
+	fingerprintCache := flag.String("fingerprint-cache", "", "When provided, the sizes and modification times of the files hashed are kept in this file, and the content of the charts and value files whose fingerprint didn't change is not hashed again.")
+	outputDigests := flag.String("output-digests", "", "When provided, the digest of the output of every application rendered is recorded in this file, one `name digest` line per application, for `verify` to detect output edited by hand.")
+	expandEnv := flag.Bool("expand-env", false, "Expand the `${VAR}` placeholders of the inline values and value files of Helm sources with the environment before templating, like a config management plugin running envsubst. The expanded values are hashed, so a change to the environment renders the chart again.")
+	gotmplValues := flag.Bool("gotmpl-values", false, "Render the value files of Helm sources ending in `.gotmpl` as Go templates before templating, like helmfile does, and hash the rendered values. Other value files are passed to helm as they are.")
+	gotmplData := flag.String("gotmpl-data", "", "When provided with -gotmpl-values, the YAML file holding the data the `.gotmpl` value files are rendered with, e.g. `{{ .cluster }}`.")
+	includeHidden := flag.Bool("include-hidden", false, "Hash every file of a chart, including the ones its .helmignore lists and hidden files under templates, which helm leaves out and by default don't change the hash.")
+	hashAlgorithm := flag.String("hash-algorithm", helm.HashSHA256, "Checksum used for the hashes. Can be `sha256` or `blake3`. Changing it renders every application again.")
 	hashStrategy := flag.String("hash-strategy", HashStrategyReadWrite, "Whether to read + write, or just read hashes. Can be `readwrite` or `read`.")
+	concurrency := flag.String("concurrency", "1", "How many of the applications defined in the same file are rendered at once, or `auto` for one per CPU minus the load average over the last minute, when the system reports it. Their descendants are walked once they are all rendered, so the errors and summary keep the same order.")
+	noLock := flag.Bool("no-lock", false, "Don't lock the output during the run. By default, a run fails when another one is rendering into the same output, instead of both writing the hashes at once.")
+	failuresDir := flag.String("failures-dir", "", "When provided, the error and the partial output of every application that fails are kept in `<dir>/<application>`, with the error in error.txt. The failures of the previous run are removed at the start of every run; nothing else in the directory is.")
+	var pathRewrites stringsFlag
+	flag.Var(&pathRewrites, "path-rewrite", "Rewrite applied to the source path of every application before it's hashed and rendered, as `<regexp>=<replacement>`, e.g. `^vendor/=src/`. Can be repeated, and the rewrites are applied in order.")
+	renderRoot := flag.Bool("render-root", false, "When the root directory is a Helm chart, e.g. a bootstrap chart generating the root applications, render it first, as an application named after the directory, and walk its output.")
+	only := flag.String("only", "", "When provided, only the applications whose name matches this glob are rendered.")
+	changedSinceRef := flag.String("changed-since", "", "When provided, only the applications whose file, source path, value files or file parameters changed since this git ref are rendered, along with the applications they define.")
+	ignoreFile := flag.String("ignore-file", "", "When provided, apps whose name matches one of the names or globs in this file, one per line, are ignored. Their output is kept.")
+	skipAnnotation := flag.String("skip-annotation", "mani-diffy.chime.com/skip", "Apps with this annotation set to `true` are ignored. Their output is kept.")
 	ignoreSuffix := flag.String("ignore-suffix", "-ignore", "Suffix used to identify apps to ignore")
 	skipRenderKey := flag.String("skip-render-key", "do-not-render", "Key to not render")
-	ignoreValueFile := flag.String("ignore-value-file", "overrides-to-ignore", "Override file to ignore based on filename")
+	var ignoreValueFiles stringsFlag
+	flag.Var(&ignoreValueFiles, "ignore-value-file", "Override file to ignore based on filename. Can be repeated. Defaults to `overrides-to-ignore`.")
+	defaultNamespace := flag.String("default-namespace", "", "Namespace charts are rendered in when the Application has no destination namespace.")
+	includeCRDs := flag.Bool("include-crds", false, "Render the CRDs charts ship, like Argo does.")
+	kubeVersion := flag.String("kube-version", "", "Kubernetes version used for Capabilities.KubeVersion when templating charts.")
+	var apiVersions stringsFlag
+	flag.Var(&apiVersions, "api-versions", "Kubernetes API version used for Capabilities.APIVersions when templating charts. Can be repeated.")
+	compress := flag.Bool("compress", false, "Write the manifests rendered by Helm compressed with gzip, e.g. manifest.yaml.gz instead of manifest.yaml.")
+	compressionLevel := flag.Int("compression-level", gzip.DefaultCompression, "The gzip level used with -compress, from 1 (fastest) to 9 (smallest).")
+	var excludeKinds stringsFlag
+	flag.Var(&excludeKinds, "exclude-kind", "Kind of the resources left out of the manifests rendered by Helm, e.g. `Secret`. Can be repeated.")
+	outputFormat := flag.String("output-format", helm.FormatYAML, "Format of the manifests rendered by Helm. Can be `yaml` or `json`, which writes manifest.json holding an array of the resources.")
+	manifestFilename := flag.String("manifest-filename", helm.DefaultManifestFilename, "Name of the file holding the manifest rendered by Helm for every application, e.g. `rendered.yaml`. With -output-format json its extension is .json.")
+	splitManifests := flag.Bool("split-manifests", false, "Write every resource rendered by Helm to its own `<kind>-<name>.yaml` file instead of a single manifest.yaml.")
+	maxManifestSize := flag.Int64("max-manifest-size", 0, "When provided, the size in `bytes` over which the manifest of an application fails to render instead of being written.")
+	failOnEmpty := flag.Bool("fail-on-empty", false, "Fail apps whose Helm chart renders an empty manifest.")
+	reportSkipped := flag.Bool("report-skipped", false, "List the names of the applications skipped because their source is not supported, e.g. kustomize, at the end of the run. Their number is always logged.")
+	showWarnings := flag.Bool("show-warnings", false, "Log the warnings helm prints for every application, e.g. about deprecated APIs, and add them to the summary.")
+	validateValuesSchema := flag.Bool("values-schema-validate", false, "Check the values of every chart shipping a values.schema.json against it before templating, failing the app with the keys that don't match.")
+	confinePaths := flag.Bool("confine-paths", false, "Fail apps whose chart, value files or file parameters resolve outside of the working directory, following symlinks. For running untrusted manifests in CI.")
+	valuesPrecedence := flag.String("values-precedence", helm.ValuesPrecedenceInline, "What wins when the value files and the inline values of an app set the same key. Can be `inline` or `files`.")
+	var namespaceOverrides stringsFlag
+	flag.Var(&namespaceOverrides, "namespace-override", "Namespace a chart is rendered in instead of the destination namespace of its app, as `<app>=<namespace>`. Can be repeated.")
+	validate := flag.Bool("validate", false, "Fail apps whose rendered Helm manifest holds documents that are not Kubernetes objects.")
+	skipDepUpdate := flag.Bool("skip-dep-update", false, "Never run `helm dependency update`, e.g. when the dependencies of every chart are vendored.")
+	depCacheDir := flag.String("dep-cache-dir", "", "When provided, chart dependencies are cached in this directory and shared between the charts locking the same version.")
+	depStrategy := flag.String("dep-strategy", helm.DependencyStrategyUpdate, "How missing chart dependencies are fetched. `build` runs `helm dependency build`, which uses the versions pinned in the Chart.lock, for charts with a lock, falling back to `helm dependency update` for the others. `update` always runs `helm dependency update`, which may bump versions.")
+	depUpdateRetries := flag.Int("dep-update-retries", 2, "How many times to retry a failed `helm dependency update`.")
+	provenanceHeader := flag.Bool("provenance-header", false, "Start every YAML manifest rendered by Helm with a comment recording the mani-diffy version, the chart, the hash of the application and the time of the render.")
+	noTimestamp := flag.Bool("no-timestamp", false, "Leave the time of the render out of the -provenance-header, so rendering the same inputs again doesn't change the manifest.")
+	normalize := flag.Bool("normalize", false, "Rewrite every manifest.yaml, or every file of the manifests split with -split-manifests, with sorted keys before calling the post renderer.")
+	var normalizeDrop stringsFlag
+	flag.Var(&normalizeDrop, "normalize-drop", "Label or annotation removed from every object when normalizing, e.g. `helm.sh/chart`. Can be repeated.")
+	helmPostRenderer := flag.String("helm-post-renderer", "", "When provided, passed to `helm template --post-renderer`, so helm pipes every chart through this binary before the manifest is written.")
 	postRenderer := flag.String("post-renderer", "", "When provided, binary will be called after an application is rendered.")
-	flag.Parse()
+	gitCommit := flag.Bool("git-commit", false, "Commit the changes to the output after a successful render. The commit message lists the rendered applications.")
+	ci := flag.Bool("ci", false, "After a successful render, fail with exit code 2 listing the files of the output that differ from git HEAD, e.g. in pull requests that forgot to render. The output is restored to HEAD afterwards.")
+	ciKeepChanges := flag.Bool("ci-keep-changes", false, "With -ci, leave the rendered changes in the work tree instead of restoring the output.")
+	dryRun := flag.Bool("dry-run", false, "With -git-commit, print what would be committed instead of committing.")
+	diffOnly := flag.Bool("diff-only", false, "Print a unified diff of the files every render changes.")
+	diffOutput := flag.String("diff-output", "", "When provided with -diff-only, the diff of every changed application is also written to this directory.")
+	noColor := flag.Bool("no-color", false, "Never color the output. It is only colored when stdout is a terminal and NO_COLOR is not set.")
+	metricsFile := flag.String("metrics-file", "", "When provided, metrics about the run are written to this file in the Prometheus text format.")
+	summaryOutput := flag.String("summary-output", "", "When provided, a JSON summary of the run is written to this file, with the status, the number of resources and the manifest size of every application.")
+	progressInterval := flag.Duration("progress-interval", 0, "When provided, how often to log how many applications were discovered, rendered and found in the cache so far, e.g. `30s`.")
+	renderTimeout := flag.Duration("render-timeout", 0, "Maximum duration of the render of a single application, e.g. `5m`. Helm is killed and the application fails when it is over.")
+	timeout := flag.Duration("timeout", 0, "Maximum duration of a run, e.g. `30m`. Runs are not limited when 0.")
+	addr := flag.String("addr", ":8080", "Address to listen on when running `mani-diffy serve`.")
+	logLevel := flag.String("log-level", "info", "Minimum level of the log messages. Can be `debug`, `info`, `warn` or `error`.")
+	logFormat := flag.String("log-format", "text", "Format of the log messages. Can be `text` or `json`.")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		// The flag package already printed the error and the usage.
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitError)
+	}
 
-	// Runs the command in the specified directory
-	err := os.Chdir(*workdir)
+	configPath, configRequired := *configFile, true
+	if configPath == "" {
+		configPath, configRequired = defaultConfigFile, false
+	}
+	if err := loadConfig(flag.CommandLine, configPath, configRequired); err != nil {
+		fatal(err)
+	}
+
+	if ignoreValueFiles == nil {
+		ignoreValueFiles = stringsFlag{"overrides-to-ignore"}
+	}
+
+	logger, err := newLogger(*logLevel, *logFormat, os.Stderr)
 	if err != nil {
-		log.Fatal("Could not set workdir: ", err)
+		fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	// Runs the command in the specified directory
+	if err := os.Chdir(*workdir); err != nil {
+		fatal(fmt.Errorf("could not set workdir: %w", err))
 	}
 
 	start := time.Now()
-	if err := helm.VerifyRenderDir(*renderDir); err != nil {
-		log.Fatal(err)
+	if *clean && command != "" {
+		fatal(errors.New("-clean can only be used when rendering"))
+	}
+	// Rendering to stdout writes no output directory.
+	if command != "render" || *renderDir != "-" {
+		if err := helm.VerifyRenderDir(*renderDir); err != nil {
+			fatal(err)
+		}
+	}
+
+	// Helm is checked once, when it's first needed. The commands rendering
+	// the whole tree check it upfront, so a missing helm fails the run
+	// right away instead of every Helm application; verify, duplicates
+	// and rendering a file without Helm sources don't need it at all.
+	checkHelm := sync.OnceValues(func() (string, error) {
+		return helm.CheckHelmAvailable(context.Background())
+	})
+	switch command {
+	case "", "check", "serve":
+		helmVersion, err := checkHelm()
+		if err != nil {
+			fatal(err)
+		}
+		slog.Info("Using helm", "version", helmVersion)
+	}
+
+	if *migrateHashStore != "" && *migrateHashStore == *hashStore {
+		fatal(fmt.Errorf("-migrate-hash-store must be different from -hash-store %s", *hashStore))
+	}
+	if _, err := helm.HashFunc(*hashAlgorithm); err != nil {
+		fatal(err)
+	}
+	if err := helm.CheckFormat(*outputFormat); err != nil {
+		fatal(err)
+	}
+	if err := helm.CheckDependencyStrategy(*depStrategy); err != nil {
+		fatal(err)
+	}
+	if err := helm.CheckValuesPrecedence(*valuesPrecedence); err != nil {
+		fatal(err)
+	}
+	if err := helm.CheckManifestFilename(*manifestFilename); err != nil {
+		fatal(err)
+	}
+	if *ci && *gitCommit {
+		fatal(errors.New("-ci can't be used with -git-commit"))
+	}
+	if *outputFormat == helm.FormatJSON && *normalize {
+		fatal(errors.New("-normalize can't be used with -output-format json, whose keys are always sorted"))
+	}
+	if *compress {
+		if _, err := gzip.NewWriterLevel(io.Discard, *compressionLevel); err != nil {
+			fatal(err)
+		}
+		if *normalize {
+			fatal(errors.New("-normalize can't be used with -compress"))
+		}
 	}
 
-	h, err := getHashStore(*hashStore, *hashStrategy, *renderDir)
+	namespaces, err := parseNamespaceOverrides(namespaceOverrides)
+	if err != nil {
+		fatal(err)
+	}
+	renders, err := parseConcurrency(*concurrency)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	helmOpts := helm.Options{
+		SkipRenderKey:           *skipRenderKey,
+		IgnoreValueFiles:        ignoreValueFiles,
+		DependencyUpdateRetries: *depUpdateRetries,
+		KubeVersion:             *kubeVersion,
+		APIVersions:             apiVersions,
+		Validate:                *validate,
+		ValidateValuesSchema:    *validateValuesSchema,
+		SplitManifests:          *splitManifests,
+		SkipDependencyUpdate:    *skipDepUpdate,
+		DependencyCacheDir:      *depCacheDir,
+		DependencyStrategy:      *depStrategy,
+		FailOnEmpty:             *failOnEmpty,
+		MaxManifestSize:         *maxManifestSize,
+		HashAlgorithm:           *hashAlgorithm,
+		DefaultNamespace:        *defaultNamespace,
+		IncludeCRDs:             *includeCRDs,
+		Compress:                *compress,
+		CompressionLevel:        *compressionLevel,
+		PostRenderer:            *helmPostRenderer,
+		ExcludeKinds:            excludeKinds,
+		Normalize:               *normalize,
+		NormalizeDrop:           normalizeDrop,
+		OutputFormat:            *outputFormat,
+		ManifestFilename:        *manifestFilename,
+		ConfinePaths:            *confinePaths,
+		ValuesPrecedence:        *valuesPrecedence,
+		NamespaceOverrides:      namespaces,
+		IncludeHidden:           *includeHidden,
+		ExpandEnv:               *expandEnv,
+		GotmplValues:            *gotmplValues,
+		ProvenanceHeader:        *provenanceHeader,
+		Version:                 buildVersion(),
+		NoTimestamp:             *noTimestamp,
+	}
+
+	if *gotmplData != "" {
+		if helmOpts.GotmplData, err = helm.LoadGotmplData(*gotmplData); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *fingerprintCache != "" {
+		if helmOpts.Fingerprints, err = helm.LoadFingerprintCache(*fingerprintCache); err != nil {
+			fatal(err)
+		}
 	}
 
 	w := &Walker{
 		CopySource: CopySource,
-		HelmTemplate: func(application *v1alpha1.Application, output string) error {
-			return helm.Run(application, output, *skipRenderKey, *ignoreValueFile)
+		HelmTemplate: func(ctx context.Context, application *v1alpha1.Application, output string) error {
+			if _, err := checkHelm(); err != nil {
+				return err
+			}
+			return helm.Run(ctx, application, output, helmOpts)
 		},
-		GenerateHash: func(application *v1alpha1.Application) (string, error) {
-			return helm.GenerateHash(application, *ignoreValueFile)
+		GenerateHash: func(ctx context.Context, application *v1alpha1.Application) (string, error) {
+			return helm.GenerateHash(ctx, application, helmOpts)
 		},
-		ignoreSuffix: *ignoreSuffix,
+		ignoreSuffix:     *ignoreSuffix,
+		skipAnnotation:   *skipAnnotation,
+		splitManifests:   *splitManifests,
+		prune:            *prune,
+		lock:             !*noLock,
+		clean:            *clean,
+		warnDuplicates:   *warnDuplicates,
+		compress:         *compress,
+		outputFormat:     *outputFormat,
+		manifestFilename: *manifestFilename,
+		renderTimeout:    *renderTimeout,
+		showWarnings:     *showWarnings,
+		progressInterval: *progressInterval,
+		failuresDir:      *failuresDir,
+		renderRoot:       *renderRoot,
+		concurrency:      renders,
+	}
+
+	if *outputDigests != "" {
+		if w.digests, err = NewConsolidatedSumFileStore(*outputDigests, *hashStrategy); err != nil {
+			fatal(err)
+		}
+	}
+
+	for _, rewrite := range pathRewrites {
+		r, err := parsePathRewrite(rewrite)
+		if err != nil {
+			fatal(err)
+		}
+		w.pathRewrites = append(w.pathRewrites, r)
 	}
 
+	if *ignoreFile != "" {
+		if w.ignore, err = readIgnoreFile(*ignoreFile); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *only != "" {
+		if w.only, err = glob.Compile(*only); err != nil {
+			fatal(fmt.Errorf("invalid -only glob %q: %w", *only, err))
+		}
+	}
+
+	if *changedSinceRef != "" {
+		if w.changed, err = changedSince(context.Background(), ".", *changedSinceRef); err != nil {
+			fatal(err)
+		}
+	}
+
+	var normalizer, external PostRenderer
+	if *normalize {
+		normalizer = Normalize(normalizeDrop, *manifestFilename, *splitManifests)
+	}
 	if *postRenderer != "" {
-		w.PostRender = PostRender(*postRenderer)
+		external = PostRender(*postRenderer)
+	}
+	w.PostRender = chainPostRenderers(normalizer, external)
+
+	var diffPrinter *DiffPrinter
+	if *diffOnly {
+		diffPrinter = &DiffPrinter{Out: os.Stdout, Dir: *diffOutput, Color: useColor(*noColor, os.Stdout)}
+		w.Diff = diffPrinter.Diff
+	}
+
+	run := func() (*Summary, error) {
+		// Remote charts following a range are resolved once per run.
+		ctx := helm.WithChartVersions(context.Background())
+		if *timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *timeout)
+			defer cancel()
+		}
+
+		h, err := getHashStore(*hashStore, hashStoreOptions{
+			outputPath:         *renderDir,
+			strategy:           *hashStrategy,
+			consolidated:       *sumfileConsolidated,
+			checkpointInterval: *checkpointInterval,
+			url:                *hashStoreURL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if *migrateHashStore != "" {
+			from, err := getHashStore(*migrateHashStore, hashStoreOptions{
+				outputPath:   *renderDir,
+				strategy:     HashStrategyRead,
+				consolidated: *sumfileConsolidated,
+				url:          *hashStoreURL,
+			})
+			if err != nil {
+				return nil, err
+			}
+			h = NewMigratingHashStore(from, h)
+		}
+		if *clean {
+			h = cleanHashStore{h}
+		}
+		var summary *Summary
+		if *root == "-" {
+			summary, err = w.WalkReader(ctx, os.Stdin, *renderDir, h)
+		} else {
+			summary, err = w.Walk(ctx, *root, *renderDir, *maxDepth, h)
+		}
+		if helmOpts.Fingerprints != nil {
+			err = errors.Join(err, helmOpts.Fingerprints.Save())
+		}
+		return summary, err
+	}
+
+	switch command {
+	case "":
+		summary, err := run()
+		if summary != nil {
+			summary.logSkipped(*reportSkipped)
+		}
+		if *summaryOutput != "" && summary != nil {
+			if err := summary.Write(*summaryOutput); err != nil {
+				slog.Error("Unable to write summary", "error", err)
+			}
+		}
+		if *metricsFile != "" && summary != nil {
+			if err := summary.WriteMetrics(*metricsFile); err != nil {
+				slog.Error("Unable to write metrics", "error", err)
+			}
+		}
+		if summary != nil {
+			summary.logFinished(time.Since(start))
+		}
+		if err != nil {
+			fatal(err)
+		}
+		if *gitCommit {
+			if err := GitCommit(context.Background(), *renderDir, summary, *dryRun, os.Stdout); err != nil {
+				fatal(err)
+			}
+		}
+		if *ci {
+			changes, err := GitChanges(context.Background(), *renderDir, !*ciKeepChanges)
+			if err != nil {
+				fatal(err)
+			}
+			if len(changes) > 0 {
+				fmt.Println(strings.Join(changes, "\n"))
+				slog.Error("The output is out of date, render it again and commit the changes", "files", len(changes))
+				os.Exit(exitDrift)
+			}
+		}
+		if diffPrinter != nil && len(diffPrinter.Changed) > 0 {
+			slog.Info("Drift detected", "apps", len(diffPrinter.Changed))
+			os.Exit(exitDrift)
+		}
+	case "check":
+		drifts, err := w.Check(helm.WithChartVersions(context.Background()), *root, *renderDir, *maxDepth)
+		if err != nil {
+			fatal(err)
+		}
+		for _, drift := range drifts {
+			fmt.Print(drift.Diff)
+		}
+		if len(drifts) > 0 {
+			for _, drift := range drifts {
+				slog.Error("Drift detected", "app", drift.App)
+			}
+			os.Exit(exitDrift)
+		}
+		slog.Info("No drift detected", "duration", time.Since(start))
+	case "verify":
+		h, err := getHashStore(*hashStore, hashStoreOptions{
+			outputPath:   *renderDir,
+			strategy:     HashStrategyRead,
+			consolidated: *sumfileConsolidated,
+			url:          *hashStoreURL,
+		})
+		if err != nil {
+			fatal(err)
+		}
+		mismatches, err := w.Verify(helm.WithChartVersions(context.Background()), *root, *renderDir, *maxDepth, h)
+		if err != nil {
+			fatal(err)
+		}
+		if len(mismatches) > 0 {
+			for _, mismatch := range mismatches {
+				slog.Error("Output can't be trusted", "app", mismatch.App, "reason", mismatch.Reason)
+			}
+			os.Exit(exitDrift)
+		}
+		slog.Info("The output matches its hashes and digests", "duration", time.Since(start))
+	case "duplicates":
+		duplicates, err := findDuplicates(*renderDir)
+		if err != nil {
+			fatal(err)
+		}
+		printDuplicates(os.Stdout, duplicates)
+	case "render":
+		if flag.NArg() != 1 {
+			fatal(errors.New("render needs the file of the applications to render, e.g. `mani-diffy render apps/app.yaml`"))
+		}
+		output := *renderDir
+		if output == "-" {
+			tmp, err := os.MkdirTemp("", "mani-diffy-render-")
+			if err != nil {
+				fatal(err)
+			}
+			output = tmp
+		}
+		err := w.RenderFile(helm.WithChartVersions(context.Background()), flag.Arg(0), output)
+		if output != *renderDir {
+			// Whatever rendered is printed even when others failed.
+			printErr := printOutput(os.Stdout, output)
+			os.RemoveAll(output)
+			if printErr != nil {
+				fatal(printErr)
+			}
+		}
+		if err != nil {
+			fatal(err)
+		}
+	case "serve":
+		if err := Serve(*addr, &Server{Run: run}); err != nil {
+			fatal(err)
+		}
+	default:
+		fatal(fmt.Errorf("unknown command: %s", command))
+	}
+}
+
+// stringsFlag is a flag that can be repeated to collect several values.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parseNamespaceOverrides parses the `<app>=<namespace>` namespace overrides
+// into a map keyed by the name of the application.
+func parseNamespaceOverrides(overrides []string) (map[string]string, error) {
+	if len(overrides) == 0 {
+		return nil, nil
+	}
+	namespaces := make(map[string]string, len(overrides))
+	for _, override := range overrides {
+		app, namespace, ok := strings.Cut(override, "=")
+		if !ok || app == "" || namespace == "" {
+			return nil, fmt.Errorf("invalid namespace override %q, must be <app>=<namespace>", override)
+		}
+		if _, ok := namespaces[app]; ok {
+			return nil, fmt.Errorf("namespace of %s overridden twice", app)
+		}
+		namespaces[app] = namespace
+	}
+	return namespaces, nil
+}
+
+// newLogger returns a logger writing messages of at least level to w in the
+// given format.
+func newLogger(level, format string, w io.Writer) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
 	}
+}
 
-	if err := w.Walk(*root, *renderDir, *maxDepth, h); err != nil {
-		log.Fatal(err)
+// fatal logs every error joined in err on its own line and exits with
+// exitError.
+func fatal(err error) {
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		errs := joined.Unwrap()
+		for _, e := range errs {
+			var renderErr *RenderError
+			if errors.As(e, &renderErr) {
+				slog.Error("Error", "app", renderErr.App, "source", renderErr.Source, "output", renderErr.Output, "error", renderErr.Err)
+				continue
+			}
+			slog.Error("Error", "error", e)
+		}
+		slog.Error(fmt.Sprintf("%d errors occurred", len(errs)))
+		os.Exit(exitError)
 	}
-	log.Printf("mani-diffy took %v to run", time.Since(start))
+	slog.Error("Error", "error", err)
+	os.Exit(exitError)
+}
+
+// hashStoreOptions configures the hash store of a run.
+type hashStoreOptions struct {
+	outputPath string
+	strategy   string
+
+	// consolidated keeps every hash of the sumfile store in a single file
+	// at the root of the output.
+	consolidated bool
+
+	// checkpointInterval is how often the json store saves the hashes
+	// added during the run, or never before the end of the run when zero.
+	checkpointInterval time.Duration
+
+	// url is the base URL of the http store.
+	url string
 }
 
-var hashStores = map[string]func(string, string) (HashStore, error){
-	"sumfile": func(outputPath, hashStrategy string) (HashStore, error) { //nolint:unparam
-		return NewSumFileStore(outputPath, hashStrategy), nil
+var hashStores = map[string]func(hashStoreOptions) (HashStore, error){
+	"sumfile": func(opts hashStoreOptions) (HashStore, error) {
+		if opts.consolidated {
+			return NewConsolidatedSumFileStore(filepath.Join(opts.outputPath, sumFileName), opts.strategy)
+		}
+		return NewSumFileStore(opts.outputPath, opts.strategy), nil
+	},
+	"json": func(opts hashStoreOptions) (HashStore, error) {
+		s, err := NewJSONHashStore(filepath.Join(opts.outputPath, "hashes.json"), opts.strategy)
+		if err != nil {
+			return nil, err
+		}
+		s.checkpointInterval = opts.checkpointInterval
+		return s, nil
+	},
+	"sqlite": func(opts hashStoreOptions) (HashStore, error) {
+		return NewSQLiteHashStore(filepath.Join(opts.outputPath, "hashes.db"), opts.strategy)
 	},
-	"json": func(outputPath, hashStrategy string) (HashStore, error) {
-		return NewJSONHashStore(filepath.Join(outputPath, "hashes.json"), hashStrategy)
+	"http": func(opts hashStoreOptions) (HashStore, error) {
+		return NewHTTPHashStore(opts.url, opts.strategy)
 	},
 }
 
-func getHashStore(hashStore, hashStrategy, outputPath string) (HashStore, error) {
+func getHashStore(hashStore string, opts hashStoreOptions) (HashStore, error) {
 	if fn, ok := hashStores[hashStore]; ok {
-		return fn(outputPath, hashStrategy)
+		return fn(opts)
 	}
 	return nil, fmt.Errorf("Invalid hash store: %v", hashStore)
 }
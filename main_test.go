@@ -0,0 +1,1053 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/chime/mani-diffy/pkg/helm"
+	"github.com/gobwas/glob"
+)
+
+const testApplication = `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: test-app
+spec:
+  source:
+    path: charts/test-app
+`
+
+func writeApplications(t *testing.T, dir, file string, names ...string) {
+	t.Helper()
+	var docs []string
+	for _, name := range names {
+		docs = append(docs, strings.Replace(testApplication, "name: test-app", "name: "+name, 1))
+	}
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(strings.Join(docs, "---\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeRenderer is a Renderer that records the applications it renders
+// instead of running helm, and writes the children set for them.
+type fakeRenderer struct {
+	t        *testing.T
+	children map[string][]string
+	rendered []string
+}
+
+func (f *fakeRenderer) Render(_ context.Context, application *v1alpha1.Application, output string) error {
+	f.rendered = append(f.rendered, application.ObjectMeta.Name)
+	if err := os.MkdirAll(output, os.ModePerm); err != nil {
+		return err
+	}
+	if children := f.children[application.ObjectMeta.Name]; len(children) > 0 {
+		writeApplications(f.t, output, "apps.yaml", children...)
+	}
+	return nil
+}
+
+func TestWalkAggregatesErrors(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "broken-1", "healthy", "broken-2")
+
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			if strings.HasPrefix(application.ObjectMeta.Name, "broken") {
+				return fmt.Errorf("cannot render %s", application.ObjectMeta.Name)
+			}
+			return os.MkdirAll(output, os.ModePerm)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	_, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewSumFileStore(output, HashStrategyReadWrite))
+	if err == nil {
+		t.Fatal("expected the walk to fail")
+	}
+
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) || len(joined.Unwrap()) != 2 {
+		t.Fatalf("expected two errors got: %v", err)
+	}
+	for _, name := range []string{"broken-1", "broken-2"} {
+		if !strings.Contains(err.Error(), filepath.Join(output, name)+": cannot render "+name) {
+			t.Errorf("expected error to name %s got: %v", name, err)
+		}
+	}
+	for i, name := range []string{"broken-1", "broken-2"} {
+		var renderErr *RenderError
+		if !errors.As(joined.Unwrap()[i], &renderErr) {
+			t.Fatalf("expected a render error got: %v", joined.Unwrap()[i])
+		}
+		expected := RenderError{App: name, Source: "charts/test-app", Output: filepath.Join(output, name)}
+		if renderErr.App != expected.App || renderErr.Source != expected.Source || renderErr.Output != expected.Output {
+			t.Errorf("expected %+v got: %+v", expected, *renderErr)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(output, "healthy")); err != nil {
+		t.Errorf("expected healthy app to be rendered: %v", err)
+	}
+}
+
+func TestPruneUnvisited(t *testing.T) {
+	output := t.TempDir()
+	for _, dir := range []string{"app/templates", "parent/child", "parent/stale-child", "stale"} {
+		if err := os.MkdirAll(filepath.Join(output, dir), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(output, "hashes.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	visited := map[string]string{
+		filepath.Join(output, "app"):          "apps.yaml",
+		filepath.Join(output, "parent/child"): "apps.yaml",
+	}
+	if err := pruneUnvisited(visited, output); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"app/templates", "parent/child", "hashes.json"} {
+		if _, err := os.Stat(filepath.Join(output, path)); err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+	}
+	for _, path := range []string{"parent/stale-child", "stale"} {
+		if _, err := os.Stat(filepath.Join(output, path)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be pruned", path)
+		}
+	}
+}
+
+func TestRenderMultipleSources(t *testing.T) {
+	var helmApps, copied []string
+	w := &Walker{
+		HelmTemplate: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			helmApps = append(helmApps, application.ObjectMeta.Name)
+			return nil
+		},
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			copied = append(copied, application.Spec.Source.Path)
+			return nil
+		},
+	}
+
+	app := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Sources: v1alpha1.ApplicationSources{
+				{Path: "charts/service", Helm: &v1alpha1.ApplicationSourceHelm{}},
+				{Ref: "values"},
+				{Path: "manifests"},
+			},
+		},
+	}
+	app.ObjectMeta.Name = "multi-source"
+
+	if err := w.Render(context.Background(), app, filepath.Join(t.TempDir(), "multi-source")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(helmApps) != 1 || helmApps[0] != "multi-source" {
+		t.Errorf("expected the helm sources to be rendered once got: %v", helmApps)
+	}
+	if len(copied) != 1 || copied[0] != "manifests" {
+		t.Errorf("expected only the directory source to be copied got: %v", copied)
+	}
+}
+
+func TestWalkCancel(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "first", "second", "third")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var rendered []string
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			rendered = append(rendered, application.ObjectMeta.Name)
+			cancel()
+			return os.MkdirAll(output, os.ModePerm)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	_, err := w.Walk(ctx, root, output, InfiniteDepth, NewSumFileStore(output, HashStrategyReadWrite))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the walk to be canceled got: %v", err)
+	}
+	if len(rendered) != 1 {
+		t.Errorf("expected no renders after cancellation got: %v", rendered)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newLogger("warn", "json", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Info("Dropping into", "path", "bootstrap")
+	logger.Warn("kustomize not supported", "app", "test-app")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record got: %s", out.String())
+	}
+	if record["level"] != "WARN" || record["app"] != "test-app" {
+		t.Errorf("unexpected record: %v", record)
+	}
+
+	if _, err := newLogger("verbose", "text", &out); err == nil {
+		t.Error("expected an invalid level to fail")
+	}
+	if _, err := newLogger("info", "xml", &out); err == nil {
+		t.Error("expected an invalid format to fail")
+	}
+}
+
+func TestWalkOrder(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "b.yaml", "b")
+	writeApplications(t, root, "a.yaml", "a-2", "a-1")
+
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			return fmt.Errorf("cannot render %s", application.ObjectMeta.Name)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	expected := []string{"a-2", "a-1", "b"}
+	for i := 0; i < 3; i++ {
+		summary, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewSumFileStore(output, HashStrategyReadWrite))
+
+		var joined interface{ Unwrap() []error }
+		if !errors.As(err, &joined) || len(joined.Unwrap()) != len(expected) {
+			t.Fatalf("expected %d errors got: %v", len(expected), err)
+		}
+		for j, name := range expected {
+			if summary.Apps[j].Name != name || !strings.HasSuffix(joined.Unwrap()[j].Error(), "cannot render "+name) {
+				t.Errorf("expected %s to be rendered in position %d got: %+v %v", name, j, summary.Apps[j], joined.Unwrap()[j])
+			}
+		}
+	}
+}
+
+func TestWalkRendersOneAtATime(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "parent", "other")
+
+	renderer := &fakeRenderer{t: t, children: map[string][]string{
+		"parent":  {"child-1", "child-2", "child-3"},
+		"child-1": {"grandchild-1", "grandchild-2"},
+		"child-3": {"grandchild-3"},
+	}}
+	var inFlight, maxInFlight int32
+	w := &Walker{
+		CopySource: func(ctx context.Context, application *v1alpha1.Application, output string) error {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			if n > atomic.LoadInt32(&maxInFlight) {
+				atomic.StoreInt32(&maxInFlight, n)
+			}
+			time.Sleep(time.Millisecond)
+			return renderer.Render(ctx, application, output)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore()); err != nil {
+		t.Fatal(err)
+	}
+	if len(renderer.rendered) != 8 {
+		t.Errorf("expected every app to be rendered got: %v", renderer.rendered)
+	}
+	// However deep the tree, a single helm process runs at a time.
+	if maxInFlight != 1 {
+		t.Errorf("expected a single render at a time got: %d", maxInFlight)
+	}
+}
+
+func TestWalkOnly(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "parent", "other")
+
+	renderer := &fakeRenderer{t: t, children: map[string][]string{"parent": {"child-1", "child-2"}}}
+	w := &Walker{
+		CopySource: renderer.Render,
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	walk := func(maxDepth int) {
+		t.Helper()
+		renderer.rendered = nil
+		// Start from an empty store every time, so nothing is cached.
+		if _, err := w.Walk(context.Background(), root, output, maxDepth, NewMemoryHashStore()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk(InfiniteDepth)
+
+	w.only = glob.MustCompile("child-*")
+	for _, maxDepth := range []int{InfiniteDepth, 0} {
+		walk(maxDepth)
+		if expected := []string{"child-1", "child-2"}; !reflect.DeepEqual(renderer.rendered, expected) {
+			t.Errorf("expected only %v to be rendered with max depth %d got: %v", expected, maxDepth, renderer.rendered)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(output, "other")); err != nil {
+		t.Errorf("expected the output of apps that don't match to be kept: %v", err)
+	}
+}
+
+func TestWalkApplicationWithoutName(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "app", "")
+
+	renderer := &fakeRenderer{t: t}
+	w := &Walker{
+		CopySource: renderer.Render,
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+	_, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore())
+	if err == nil || !strings.Contains(err.Error(), "application without metadata.name") {
+		t.Fatalf("expected the application without a name to fail got: %v", err)
+	}
+
+	// It would have rendered into the output itself, replacing the output
+	// of the other applications.
+	if expected := []string{"app"}; !reflect.DeepEqual(renderer.rendered, expected) {
+		t.Errorf("expected only %v to be rendered got: %v", expected, renderer.rendered)
+	}
+	if _, err := os.Stat(filepath.Join(output, "app")); err != nil {
+		t.Errorf("expected the output of the other applications to be kept: %v", err)
+	}
+}
+
+func TestWalkCache(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "parent", "other")
+
+	renderer := &fakeRenderer{t: t, children: map[string][]string{"parent": {"child"}}}
+	hash := map[string]string{}
+	w := &Walker{
+		CopySource: renderer.Render,
+		GenerateHash: func(_ context.Context, application *v1alpha1.Application) (string, error) {
+			return "hash" + hash[application.ObjectMeta.Name], nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	hashes := NewMemoryHashStore()
+	walk := func() *Summary {
+		t.Helper()
+		renderer.rendered = nil
+		summary, err := w.Walk(context.Background(), root, output, InfiniteDepth, hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	walk()
+	if expected := []string{"parent", "child", "other"}; !reflect.DeepEqual(renderer.rendered, expected) {
+		t.Errorf("expected %v to be rendered depth first got: %v", expected, renderer.rendered)
+	}
+
+	summary := walk()
+	if len(renderer.rendered) != 0 {
+		t.Errorf("expected nothing to be rendered got: %v", renderer.rendered)
+	}
+	for _, app := range summary.Apps {
+		if app.Status != StatusCacheHit {
+			t.Errorf("expected %s to be a cache hit got: %s", app.Name, app.Status)
+		}
+	}
+
+	hash["child"] = "-changed"
+	walk()
+	if expected := []string{"child"}; !reflect.DeepEqual(renderer.rendered, expected) {
+		t.Errorf("expected only %v to be rendered got: %v", expected, renderer.rendered)
+	}
+
+	// Once the parent no longer defines it, the child and its hash are
+	// pruned.
+	renderer.children = nil
+	hash["parent"] = "-changed"
+	walk()
+	if _, err := os.Stat(filepath.Join(output, "child")); !os.IsNotExist(err) {
+		t.Errorf("expected the output of the removed child to be pruned got: %v", err)
+	}
+	if h, _ := hashes.Get("child"); h != "" {
+		t.Errorf("expected the hash of the removed child to be pruned got: %s", h)
+	}
+}
+
+func TestWalkIgnoreFile(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "kept", "legacy-1", "legacy-2", "frozen")
+
+	ignoreFile := filepath.Join(t.TempDir(), "ignore")
+	if err := os.WriteFile(ignoreFile, []byte("# Apps we don't render\nlegacy-*\n\nfrozen\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ignore, err := readIgnoreFile(ignoreFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Output rendered before the apps were ignored.
+	for _, name := range []string{"legacy-1", "frozen"} {
+		if err := os.MkdirAll(filepath.Join(output, name), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rendered []string
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			rendered = append(rendered, application.ObjectMeta.Name)
+			return os.MkdirAll(output, os.ModePerm)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignore:       ignore,
+		ignoreSuffix: "-ignore",
+	}
+
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewSumFileStore(output, HashStrategyReadWrite)); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"kept"}; !reflect.DeepEqual(rendered, expected) {
+		t.Errorf("expected only %v to be rendered got: %v", expected, rendered)
+	}
+	for _, name := range []string{"legacy-1", "frozen"} {
+		if _, err := os.Stat(filepath.Join(output, name)); err != nil {
+			t.Errorf("expected the output of ignored apps to be kept: %v", err)
+		}
+	}
+}
+
+func TestWalkSkipAnnotation(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	skipped := strings.Replace(testApplication, "name: test-app", `name: skipped
+  annotations:
+    mani-diffy.chime.com/skip: "true"`, 1)
+	if err := os.WriteFile(filepath.Join(root, "apps.yaml"), []byte(testApplication+"---\n"+skipped), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(output, "skipped"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	var rendered []string
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			rendered = append(rendered, application.ObjectMeta.Name)
+			return os.MkdirAll(output, os.ModePerm)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix:   "-ignore",
+		skipAnnotation: "mani-diffy.chime.com/skip",
+	}
+
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewSumFileStore(output, HashStrategyReadWrite)); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"test-app"}; !reflect.DeepEqual(rendered, expected) {
+		t.Errorf("expected only %v to be rendered got: %v", expected, rendered)
+	}
+	if _, err := os.Stat(filepath.Join(output, "skipped")); err != nil {
+		t.Errorf("expected the output of skipped apps to be kept: %v", err)
+	}
+}
+
+func TestWalkReader(t *testing.T) {
+	output := t.TempDir()
+
+	var rendered []string
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			rendered = append(rendered, application.ObjectMeta.Name)
+			if err := os.MkdirAll(output, os.ModePerm); err != nil {
+				return err
+			}
+			// Descendants are not rendered when reading from stdin.
+			writeApplications(t, output, "apps.yaml", "child")
+			return nil
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	other := strings.Replace(testApplication, "name: test-app", "name: other-app", 1)
+	summary, err := w.WalkReader(context.Background(), strings.NewReader(testApplication+"---\n"+other), output, NewSumFileStore(output, HashStrategyReadWrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"test-app", "other-app"}; !reflect.DeepEqual(rendered, expected) {
+		t.Errorf("expected %v to be rendered got: %v", expected, rendered)
+	}
+	if len(summary.Apps) != 2 {
+		t.Errorf("expected both apps in the summary got: %+v", summary.Apps)
+	}
+}
+
+func TestWalkManifestExtensions(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "a.yaml", "from-yaml")
+	writeApplications(t, root, "b.yml", "from-yml")
+	writeApplications(t, root, "c.yaml.bak", "from-backup")
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write([]byte(strings.Replace(testApplication, "name: test-app", "name: from-gzip", 1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "d.yaml.gz"), compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "foo.yaml-backup"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "dir.yaml"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	var rendered []string
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			rendered = append(rendered, application.ObjectMeta.Name)
+			return os.MkdirAll(output, os.ModePerm)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewSumFileStore(output, HashStrategyReadWrite)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"from-yaml", "from-yml", "from-gzip"}; !reflect.DeepEqual(rendered, expected) {
+		t.Errorf("expected %v to be rendered got: %v", expected, rendered)
+	}
+
+	// JSON manifests are only read when the output is JSON.
+	app := `[{"apiVersion": "argoproj.io/v1alpha1", "kind": "Application", "metadata": {"name": "from-json"}, "spec": {"source": {"path": "charts/test-app"}}}]`
+	if err := os.WriteFile(filepath.Join(root, "e.json"), []byte(app), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.outputFormat = helm.FormatJSON
+	rendered = nil
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore()); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"from-yaml", "from-yml", "from-gzip", "from-json"}; !reflect.DeepEqual(rendered, expected) {
+		t.Errorf("expected %v to be rendered got: %v", expected, rendered)
+	}
+}
+
+func TestRenderKeepsOutputOnError(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "test-app")
+	if err := os.MkdirAll(output, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte("kind: ConfigMap\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	renderErr := errors.New("boom")
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			if err := os.MkdirAll(output, os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte("kind: Secret\n"), 0644); err != nil {
+				return err
+			}
+			return renderErr
+		},
+	}
+	app := &v1alpha1.Application{Spec: v1alpha1.ApplicationSpec{Source: &v1alpha1.ApplicationSource{Path: "charts/test-app"}}}
+
+	if err := w.Render(context.Background(), app, output); !errors.Is(err, renderErr) {
+		t.Fatalf("expected the render to fail got: %v", err)
+	}
+	if b, err := os.ReadFile(filepath.Join(output, "manifest.yaml")); err != nil || string(b) != "kind: ConfigMap\n" {
+		t.Errorf("expected the previous output to be kept got: %s %v", b, err)
+	}
+
+	renderErr = nil
+	if err := w.Render(context.Background(), app, output); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(output, "manifest.yaml")); err != nil || string(b) != "kind: Secret\n" {
+		t.Errorf("expected the output to be replaced got: %s %v", b, err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected the temporary render directories to be removed got: %v", entries)
+	}
+}
+
+func TestWalkPruneMaxDepth(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "parent")
+
+	children := map[string][]string{
+		"parent": {"child"},
+		"child":  {"grandchild"},
+	}
+	var rendered []string
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			rendered = append(rendered, application.ObjectMeta.Name)
+			if err := os.MkdirAll(output, os.ModePerm); err != nil {
+				return err
+			}
+			if names := children[application.ObjectMeta.Name]; len(names) > 0 {
+				writeApplications(t, output, "apps.yaml", names...)
+			}
+			return nil
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	walk := func(maxDepth int) {
+		t.Helper()
+		rendered = nil
+		hashes, err := NewJSONHashStore(filepath.Join(t.TempDir(), "hashes.json"), HashStrategyReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Walk(context.Background(), root, output, maxDepth, hashes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk(InfiniteDepth)
+
+	stale := filepath.Join(output, "stale")
+	if err := os.MkdirAll(stale, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	walk(0)
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("expected bounded walks not to prune by default: %v", err)
+	}
+
+	w.prune = true
+	walk(0)
+	if expected := []string{"parent"}; !reflect.DeepEqual(rendered, expected) {
+		t.Errorf("expected only %v to be rendered got: %v", expected, rendered)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("expected the stale output to be pruned")
+	}
+	for _, name := range []string{"parent", "child", "grandchild"} {
+		if _, err := os.Stat(filepath.Join(output, name)); err != nil {
+			t.Errorf("expected the output of %s to be kept: %v", name, err)
+		}
+	}
+}
+
+func TestWalkDuplicateNames(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "a.yaml", "dup", "other")
+	writeApplications(t, root, "b.yaml", "dup")
+
+	var rendered []string
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			rendered = append(rendered, application.ObjectMeta.Name)
+			return os.MkdirAll(output, os.ModePerm)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	walk := func() error {
+		t.Helper()
+		rendered = nil
+		hashes, err := NewJSONHashStore(filepath.Join(t.TempDir(), "hashes.json"), HashStrategyReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Walk(context.Background(), root, output, InfiniteDepth, hashes)
+		return err
+	}
+
+	err := walk()
+	if err == nil {
+		t.Fatal("expected the duplicate to fail the walk")
+	}
+	for _, file := range []string{"a.yaml", "b.yaml"} {
+		if !strings.Contains(err.Error(), filepath.Join(root, file)) {
+			t.Errorf("expected the error to name %s got: %v", file, err)
+		}
+	}
+	if expected := []string{"dup", "other"}; !reflect.DeepEqual(rendered, expected) {
+		t.Errorf("expected the duplicate not to be rendered got: %v", rendered)
+	}
+
+	w.warnDuplicates = true
+	if err := walk(); err != nil {
+		t.Errorf("expected duplicates to only warn got: %v", err)
+	}
+}
+
+func TestWalkRenderTimeout(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "hangs", "healthy")
+
+	w := &Walker{
+		CopySource: func(ctx context.Context, application *v1alpha1.Application, output string) error {
+			if application.ObjectMeta.Name == "hangs" {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return os.MkdirAll(output, os.ModePerm)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix:  "-ignore",
+		renderTimeout: 10 * time.Millisecond,
+	}
+
+	summary, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewSumFileStore(output, HashStrategyReadWrite))
+	if err == nil || !strings.Contains(err.Error(), "rendering hangs timed out after 10ms") {
+		t.Errorf("expected the timeout to name the app got: %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline exceeded error got: %v", err)
+	}
+	statuses := map[string]string{}
+	for _, app := range summary.Apps {
+		statuses[app.Name] = app.Status
+	}
+	if statuses["hangs"] != StatusFailed || statuses["healthy"] != StatusRendered {
+		t.Errorf("expected the walk to go on after the timeout got: %v", statuses)
+	}
+}
+
+func TestWalkPrunesJSONHashes(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "kept", "deleted")
+
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			return os.MkdirAll(output, os.ModePerm)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	path := filepath.Join(output, "hashes.json")
+	walk := func(maxDepth int) map[string]string {
+		t.Helper()
+		hashes, err := NewJSONHashStore(path, HashStrategyReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Walk(context.Background(), root, output, maxDepth, hashes); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := map[string]string{}
+		if err := json.Unmarshal(b, &saved); err != nil {
+			t.Fatal(err)
+		}
+		return saved
+	}
+
+	if saved := walk(InfiniteDepth); saved["deleted"] != "hash" {
+		t.Fatalf("expected the hash of every app to be saved got: %v", saved)
+	}
+
+	writeApplications(t, root, "apps.yaml", "kept")
+	if saved := walk(0); saved["deleted"] != "hash" {
+		t.Errorf("expected bounded walks not to prune hashes got: %v", saved)
+	}
+
+	saved := walk(InfiniteDepth)
+	if _, ok := saved["deleted"]; ok {
+		t.Errorf("expected the hash of the deleted app to be pruned got: %v", saved)
+	}
+	if saved["kept"] != "hash" || saved["//"] == "" {
+		t.Errorf("expected the other hashes and the comment to be kept got: %v", saved)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var out bytes.Buffer
+	flags := flag.NewFlagSet("mani-diffy", flag.ContinueOnError)
+	flags.SetOutput(&out)
+	flags.String("output", ".zz.auto-generated", "Path to store the compiled Argo applications.")
+	usage(flags)
+
+	for _, expected := range []string{"-output", "Exit codes:", "  0  success", "  1  error", "  2  drift"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected the usage to contain %q got:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestWalkNestedOutput(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "parent")
+	// Only the top level of the root is searched.
+	if err := os.MkdirAll(filepath.Join(root, "nested"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	writeApplications(t, filepath.Join(root, "nested"), "apps.yaml", "unreached")
+
+	var rendered []string
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			rendered = append(rendered, application.ObjectMeta.Name)
+			if application.ObjectMeta.Name != "parent" {
+				return os.MkdirAll(output, os.ModePerm)
+			}
+			// Like a directory source copied with recurse.
+			for dir, child := range map[string]string{"apps": "child-1", filepath.Join("apps", "team"): "child-2"} {
+				if err := os.MkdirAll(filepath.Join(output, dir), os.ModePerm); err != nil {
+					return err
+				}
+				writeApplications(t, filepath.Join(output, dir), "apps.yaml", child)
+			}
+			return nil
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore()); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"parent", "child-1", "child-2"}; !reflect.DeepEqual(rendered, expected) {
+		t.Errorf("expected %v to be rendered got: %v", expected, rendered)
+	}
+}
+
+func TestParseNamespaceOverrides(t *testing.T) {
+	namespaces, err := parseNamespaceOverrides([]string{"web=staging", "worker=jobs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]string{"web": "staging", "worker": "jobs"}; !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("expected %v got: %v", expected, namespaces)
+	}
+
+	for _, overrides := range [][]string{{"web"}, {"=staging"}, {"web="}, {"web=staging", "web=jobs"}} {
+		if _, err := parseNamespaceOverrides(overrides); err == nil {
+			t.Errorf("expected %q to be invalid", overrides)
+		}
+	}
+}
+
+func TestWalkPluginSource(t *testing.T) {
+	root := t.TempDir()
+	apps := `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: jsonnet-app
+spec:
+  source:
+    path: jsonnet/app
+    plugin:
+      name: jsonnet
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: multi-source-app
+spec:
+  sources:
+    - path: charts/app
+    - path: plugins/app
+      plugin: {}
+`
+	if err := os.WriteFile(filepath.Join(root, "apps.yaml"), []byte(apps), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var copied []string
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, _ string) error {
+			copied = append(copied, application.Spec.Source.Path)
+			return nil
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	// Plugin sources are skipped like kustomize ones instead of failing the
+	// run.
+	summary, err := w.Walk(context.Background(), root, t.TempDir(), InfiniteDepth, NewMemoryHashStore())
+	if err != nil {
+		t.Fatalf("expected the plugin sources to be skipped got: %v", err)
+	}
+	for _, app := range summary.Apps {
+		if app.Status != StatusSkipped {
+			t.Errorf("expected %s to be skipped got: %s", app.Name, app.Status)
+		}
+	}
+	for _, expected := range []string{"app=jsonnet-app plugin=jsonnet", `app=multi-source-app plugin="discovered by Argo"`} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected the log to contain %q got: %s", expected, out.String())
+		}
+	}
+	for _, path := range copied {
+		if path != "charts/app" {
+			t.Errorf("expected the plugin source not to be copied got: %v", copied)
+		}
+	}
+
+	out.Reset()
+	summary.logSkipped(false)
+	if logged := out.String(); !strings.Contains(logged, `msg="Skipped 2 config management plugin apps"`) {
+		t.Errorf("expected the skipped plugin apps to be logged got: %s", logged)
+	}
+}
+
+func TestWalkToggleSplitManifests(t *testing.T) {
+	// A fake helm rendering two ConfigMaps.
+	bin := t.TempDir()
+	script := "#!/bin/sh\nprintf 'apiVersion: v1\\nkind: ConfigMap\\nmetadata:\\n  name: a\\n---\\napiVersion: v1\\nkind: ConfigMap\\nmetadata:\\n  name: b\\n'\n"
+	if err := os.WriteFile(filepath.Join(bin, "helm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	root := t.TempDir()
+	chart := t.TempDir()
+	app := strings.Replace(testApplication, "path: charts/test-app", "path: "+chart+"\n    helm: {}", 1)
+	if err := os.WriteFile(filepath.Join(root, "apps.yaml"), []byte(app), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := t.TempDir()
+	hashes := NewMemoryHashStore()
+	for _, split := range []bool{false, true, false} {
+		opts := helm.Options{SkipDependencyUpdate: true, SplitManifests: split}
+		w := &Walker{
+			HelmTemplate: func(ctx context.Context, application *v1alpha1.Application, output string) error {
+				return helm.Run(ctx, application, output, opts)
+			},
+			GenerateHash: func(ctx context.Context, application *v1alpha1.Application) (string, error) {
+				return helm.GenerateHash(ctx, application, opts)
+			},
+			ignoreSuffix:   "-ignore",
+			splitManifests: split,
+		}
+		if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, hashes); err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := readFiles(filepath.Join(output, "test-app"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		expected := []string{"manifest.yaml"}
+		if split {
+			expected = []string{"configmap-a.yaml", "configmap-b.yaml"}
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("expected the split=%t output to be %v got: %v", split, expected, names)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// WriteMetrics stores the counts and durations of the run in the file at path
+// using the Prometheus text format, e.g. for the node exporter's textfile
+// collector or a push to a Pushgateway.
+func (s *Summary) WriteMetrics(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]int)
+	var renderSeconds float64
+	for _, app := range s.Apps {
+		counts[app.Status]++
+		renderSeconds += app.duration.Seconds()
+	}
+
+	var sb strings.Builder
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("manidiffy_apps_total", "counter", "Applications visited.", len(s.Apps))
+	metric("manidiffy_apps_rendered", "counter", "Applications rendered.", counts[StatusRendered])
+	metric("manidiffy_apps_cache_hit", "counter", "Applications whose hash matched, so they were not rendered.", counts[StatusCacheHit])
+	metric("manidiffy_apps_skipped", "counter", "Applications skipped because their source is not supported.", counts[StatusSkipped])
+	metric("manidiffy_apps_failed", "counter", "Applications that failed to render.", counts[StatusFailed])
+	fmt.Fprintf(&sb, "# HELP manidiffy_render_duration_seconds Time spent rendering applications.\n")
+	fmt.Fprintf(&sb, "# TYPE manidiffy_render_duration_seconds summary\n")
+	fmt.Fprintf(&sb, "manidiffy_render_duration_seconds_sum %v\n", renderSeconds)
+	fmt.Fprintf(&sb, "manidiffy_render_duration_seconds_count %d\n", counts[StatusRendered]+counts[StatusFailed])
+	metric("manidiffy_run_duration_seconds", "gauge", "Time the run took.", s.duration.Seconds())
+
+	return os.WriteFile(path, []byte(sb.String()), 0644)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	summary := NewSummary()
+	summary.Add(AppResult{Name: "rendered-1", Status: StatusRendered, duration: time.Second})
+	summary.Add(AppResult{Name: "rendered-2", Status: StatusRendered, duration: 2 * time.Second})
+	summary.Add(AppResult{Name: "cached", Status: StatusCacheHit})
+	summary.Add(AppResult{Name: "failed", Status: StatusFailed, duration: 500 * time.Millisecond})
+	summary.Finish(nil)
+
+	path := filepath.Join(t.TempDir(), "metrics.prom")
+	if err := summary.WriteMetrics(path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"# TYPE manidiffy_apps_total counter",
+		"manidiffy_apps_total 4",
+		"manidiffy_apps_rendered 2",
+		"manidiffy_apps_cache_hit 1",
+		"manidiffy_apps_skipped 0",
+		"manidiffy_apps_failed 1",
+		"manidiffy_render_duration_seconds_sum 3.5",
+		"manidiffy_render_duration_seconds_count 3",
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("expected %q in metrics got:\n%s", line, b)
+		}
+	}
+}
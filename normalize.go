@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/chime/mani-diffy/pkg/helm"
+	"gopkg.in/yaml.v3"
+)
+
+// Normalize returns a PostRenderer that rewrites the manifest of an
+// application, named after manifestFilename, with sorted keys, so that
+// manifests diff cleanly. With split, the manifests are split into one file
+// per resource and every YAML file of the output is rewritten instead. The
+// labels and annotations named in drop are removed from every object, which is
+// handy for the ones that change with every chart version like `helm.sh/chart`.
+func Normalize(drop []string, manifestFilename string, split bool) PostRenderer {
+	return func(_ context.Context, output string) error {
+		if !split {
+			return normalizeFile(filepath.Join(output, helm.ManifestName(manifestFilename, helm.FormatYAML, false)), drop)
+		}
+		entries, err := os.ReadDir(output)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+				continue
+			}
+			if err := normalizeFile(filepath.Join(output, entry.Name()), drop); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// normalizeFile rewrites the manifest at path like Normalize, if it exists.
+func normalizeFile(path string, drop []string) error {
+	manifest, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	normalized, err := normalizeManifest(manifest, drop)
+	if err != nil {
+		return err
+	}
+	return helm.WriteFileAtomic(path, normalized, 0664)
+}
+
+func normalizeManifest(manifest []byte, drop []string) ([]byte, error) {
+	var out bytes.Buffer
+	// Comments are lost when re-encoding, except the ones the manifest
+	// starts with, like its provenance header.
+	for _, line := range bytes.SplitAfter(manifest, []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte("#")) {
+			break
+		}
+		out.Write(line)
+	}
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+
+	dec := yaml.NewDecoder(bytes.NewReader(manifest))
+	for {
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if doc == nil {
+			continue
+		}
+
+		dropMetadata(doc, drop)
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// dropMetadata removes the keys in drop from the labels and annotations of
+// every metadata found in node, including the ones of nested templates.
+func dropMetadata(node interface{}, drop []string) {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		if metadata, ok := node["metadata"].(map[string]interface{}); ok {
+			for _, field := range []string{"labels", "annotations"} {
+				values, ok := metadata[field].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				for _, key := range drop {
+					delete(values, key)
+				}
+			}
+		}
+		for _, value := range node {
+			dropMetadata(value, drop)
+		}
+	case []interface{}:
+		for _, value := range node {
+			dropMetadata(value, drop)
+		}
+	}
+}
+
+// chainPostRenderers returns a PostRenderer calling every non nil renderer in
+// order.
+func chainPostRenderers(renderers ...PostRenderer) PostRenderer {
+	var chain []PostRenderer
+	for _, r := range renderers {
+		if r != nil {
+			chain = append(chain, r)
+		}
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+
+	return func(ctx context.Context, output string) error {
+		for _, r := range chain {
+			if err := r(ctx, output); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
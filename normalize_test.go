@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	output := t.TempDir()
+	manifest := `---
+# Source: app/templates/deployment.yaml
+kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: app
+  labels:
+    helm.sh/chart: app-1.2.3
+    app: app
+spec:
+  template:
+    metadata:
+      labels:
+        helm.sh/chart: app-1.2.3
+        app: app
+    spec:
+      containers:
+        - name: app
+          image: app:1.2.3
+---
+# Source: app/templates/empty.yaml
+---
+kind: ConfigMap
+apiVersion: v1
+metadata:
+  name: config
+  annotations:
+    checksum: abc
+`
+	if err := os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Normalize([]string{"helm.sh/chart"}, "", false)(context.Background(), output); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(output, "manifest.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: app
+  name: app
+spec:
+  template:
+    metadata:
+      labels:
+        app: app
+    spec:
+      containers:
+        - image: app:1.2.3
+          name: app
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  annotations:
+    checksum: abc
+  name: config
+`
+	if string(b) != expected {
+		t.Errorf("unexpected normalized manifest got:\n%s", b)
+	}
+	if entries, err := os.ReadDir(output); err != nil || len(entries) != 1 {
+		t.Errorf("expected the manifest to be rewritten in place got: %v %v", entries, err)
+	}
+
+	// The provenance header survives.
+	header := "# Generated by mani-diffy v1.2.0\n# Hash: abc\n"
+	if err := os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte(header+manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Normalize([]string{"helm.sh/chart"}, "", false)(context.Background(), output); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(output, "manifest.yaml")); err != nil || string(b) != header+expected {
+		t.Errorf("expected the header to be kept got:\n%s %v", b, err)
+	}
+
+	// Applications without a manifest, e.g. copied sources, are left alone.
+	if err := Normalize(nil, "", false)(context.Background(), t.TempDir()); err != nil {
+		t.Errorf("expected a missing manifest to be ignored got: %v", err)
+	}
+}
+
+func TestNormalizeSplitManifests(t *testing.T) {
+	output := t.TempDir()
+	for name, content := range map[string]string{
+		"deployment-app.yaml": "kind: Deployment\napiVersion: apps/v1\nmetadata:\n  name: app\n  labels:\n    helm.sh/chart: app-1.2.3\n",
+		"configmap-app.yaml":  "kind: ConfigMap\napiVersion: v1\nmetadata:\n  name: app\n",
+		"notes.txt":           "kind: left alone\n",
+	} {
+		if err := os.WriteFile(filepath.Join(output, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Normalize([]string{"helm.sh/chart"}, "", true)(context.Background(), output); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{
+		"deployment-app.yaml": "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  labels: {}\n  name: app\n",
+		"configmap-app.yaml":  "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n",
+		"notes.txt":           "kind: left alone\n",
+	} {
+		if b, err := os.ReadFile(filepath.Join(output, name)); err != nil || string(b) != expected {
+			t.Errorf("unexpected %s got:\n%s %v", name, b, err)
+		}
+	}
+
+	if err := Normalize(nil, "", true)(context.Background(), filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("expected a missing output to be ignored got: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package applicationset
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"text/template"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+// tag matches a fasttemplate style `{{ param }}` placeholder.
+var tag = regexp.MustCompile(`\{\{\s*([^{}]*?)\s*\}\}`)
+
+// Expand turns an ApplicationSet into the Applications its generators produce.
+// Only list generators can be expanded statically; every other generator
+// depends on the state of a cluster or a remote service and is skipped.
+func Expand(set *v1alpha1.ApplicationSet) ([]*v1alpha1.Application, error) {
+	var apps []*v1alpha1.Application
+	for i, generator := range set.Spec.Generators {
+		if generator.List == nil {
+			slog.Warn("Skipping generator, only list generators can be expanded", "applicationset", set.ObjectMeta.Name, "generator", i)
+			continue
+		}
+
+		if !reflect.DeepEqual(generator.List.Template, v1alpha1.ApplicationSetTemplate{}) {
+			slog.Warn("Ignoring the template override of generator", "applicationset", set.ObjectMeta.Name, "generator", i)
+		}
+
+		for j, element := range generator.List.Elements {
+			params, err := listParams(element.Raw, set.Spec.GoTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("error reading element %d of ApplicationSet %s: %w", j, set.ObjectMeta.Name, err)
+			}
+
+			app, err := render(set.Spec.Template, params, set.Spec.GoTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("error rendering element %d of ApplicationSet %s: %w", j, set.ObjectMeta.Name, err)
+			}
+			apps = append(apps, app)
+		}
+	}
+	return apps, nil
+}
+
+// listParams converts a list generator element into template parameters the
+// same way Argo does: with Go templates the element is used as is, otherwise
+// every key must be a string and the keys of `values` are flattened into
+// `values.<key>`.
+func listParams(raw []byte, goTemplate bool) (map[string]interface{}, error) {
+	var element map[string]interface{}
+	if err := json.Unmarshal(raw, &element); err != nil {
+		return nil, err
+	}
+
+	if goTemplate {
+		return element, nil
+	}
+
+	params := make(map[string]interface{})
+	for key, value := range element {
+		if key == "values" {
+			values, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("error parsing values as a map")
+			}
+			for k, v := range values {
+				params["values."+k] = v
+			}
+			continue
+		}
+
+		v, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("error parsing value of %s as a string", key)
+		}
+		params[key] = v
+	}
+	return params, nil
+}
+
+func render(tmpl v1alpha1.ApplicationSetTemplate, params map[string]interface{}, goTemplate bool) (*v1alpha1.Application, error) {
+	b, err := json.Marshal(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+	if err := json.Unmarshal(b, &tree); err != nil {
+		return nil, err
+	}
+
+	tree, err = replace(tree, func(s string) (string, error) {
+		if goTemplate {
+			return renderGoTemplate(s, params)
+		}
+		return renderFastTemplate(s, params), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if b, err = json.Marshal(tree); err != nil {
+		return nil, err
+	}
+
+	var rendered v1alpha1.ApplicationSetTemplate
+	if err := json.Unmarshal(b, &rendered); err != nil {
+		return nil, err
+	}
+
+	app := &v1alpha1.Application{Spec: rendered.Spec}
+	app.APIVersion = "argoproj.io/v1alpha1"
+	app.Kind = "Application"
+	app.ObjectMeta.Name = rendered.Name
+	app.ObjectMeta.Namespace = rendered.Namespace
+	app.ObjectMeta.Labels = rendered.Labels
+	app.ObjectMeta.Annotations = rendered.Annotations
+	app.ObjectMeta.Finalizers = rendered.Finalizers
+	return app, nil
+}
+
+// replace calls fn on every string in a decoded JSON tree.
+func replace(tree interface{}, fn func(string) (string, error)) (interface{}, error) {
+	switch v := tree.(type) {
+	case string:
+		return fn(v)
+	case map[string]interface{}:
+		for key, value := range v {
+			replaced, err := replace(value, fn)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = replaced
+		}
+	case []interface{}:
+		for i, value := range v {
+			replaced, err := replace(value, fn)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = replaced
+		}
+	}
+	return tree, nil
+}
+
+func renderFastTemplate(s string, params map[string]interface{}) string {
+	return tag.ReplaceAllStringFunc(s, func(match string) string {
+		name := tag.FindStringSubmatch(match)[1]
+		if value, ok := params[name]; ok {
+			return fmt.Sprint(value)
+		}
+		// Argo leaves unknown parameters untouched.
+		return match
+	})
+}
+
+func renderGoTemplate(s string, params map[string]interface{}) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := t.Execute(&out, params); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,123 @@
+package applicationset
+
+import (
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+func element(raw string) apiextensionsv1.JSON {
+	return apiextensionsv1.JSON{Raw: []byte(raw)}
+}
+
+func TestExpandListGenerator(t *testing.T) {
+	set := &v1alpha1.ApplicationSet{
+		Spec: v1alpha1.ApplicationSetSpec{
+			Generators: []v1alpha1.ApplicationSetGenerator{
+				{
+					List: &v1alpha1.ListGenerator{
+						Elements: []apiextensionsv1.JSON{
+							element(`{"cluster": "prod", "values": {"region": "us-east-1"}}`),
+							element(`{"cluster": "test", "values": {"region": "us-west-2"}}`),
+						},
+					},
+				},
+				// Git generators can't be expanded without cloning the repo.
+				{Git: &v1alpha1.GitGenerator{RepoURL: "https://github.com/chime/mani-diffy"}},
+			},
+			Template: v1alpha1.ApplicationSetTemplate{
+				ApplicationSetTemplateMeta: v1alpha1.ApplicationSetTemplateMeta{Name: "{{cluster}}-service"},
+				Spec: v1alpha1.ApplicationSpec{
+					Source: &v1alpha1.ApplicationSource{
+						Path: "charts/service",
+						Helm: &v1alpha1.ApplicationSourceHelm{
+							ValueFiles: []string{"../../overrides/{{ cluster }}.yaml"},
+							Parameters: []v1alpha1.HelmParameter{{Name: "region", Value: "{{values.region}}"}},
+						},
+					},
+					Destination: v1alpha1.ApplicationDestination{Namespace: "{{unknown}}"},
+				},
+			},
+		},
+	}
+
+	apps, err := Expand(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(apps) != 2 {
+		t.Fatalf("expected 2 applications got: %d", len(apps))
+	}
+
+	for i, expected := range []struct{ name, valueFile, region string }{
+		{"prod-service", "../../overrides/prod.yaml", "us-east-1"},
+		{"test-service", "../../overrides/test.yaml", "us-west-2"},
+	} {
+		app := apps[i]
+		if app.Kind != "Application" {
+			t.Errorf("expected kind Application got: %s", app.Kind)
+		}
+		if app.ObjectMeta.Name != expected.name {
+			t.Errorf("name got: %s wanted: %s", app.ObjectMeta.Name, expected.name)
+		}
+		if got := app.Spec.Source.Helm.ValueFiles[0]; got != expected.valueFile {
+			t.Errorf("value file got: %s wanted: %s", got, expected.valueFile)
+		}
+		if got := app.Spec.Source.Helm.Parameters[0].Value; got != expected.region {
+			t.Errorf("region got: %s wanted: %s", got, expected.region)
+		}
+		if got := app.Spec.Destination.Namespace; got != "{{unknown}}" {
+			t.Errorf("expected unknown parameters to be left alone got: %s", got)
+		}
+	}
+}
+
+func TestExpandGoTemplate(t *testing.T) {
+	set := &v1alpha1.ApplicationSet{
+		Spec: v1alpha1.ApplicationSetSpec{
+			GoTemplate: true,
+			Generators: []v1alpha1.ApplicationSetGenerator{
+				{
+					List: &v1alpha1.ListGenerator{
+						Elements: []apiextensionsv1.JSON{element(`{"cluster": {"name": "prod"}}`)},
+					},
+				},
+			},
+			Template: v1alpha1.ApplicationSetTemplate{
+				ApplicationSetTemplateMeta: v1alpha1.ApplicationSetTemplateMeta{Name: "{{ .cluster.name }}-service"},
+				Spec: v1alpha1.ApplicationSpec{
+					Source: &v1alpha1.ApplicationSource{Path: "charts/service"},
+				},
+			},
+		},
+	}
+
+	apps, err := Expand(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(apps) != 1 || apps[0].ObjectMeta.Name != "prod-service" {
+		t.Errorf("unexpected applications: %v", apps)
+	}
+}
+
+func TestExpandInvalidElement(t *testing.T) {
+	set := &v1alpha1.ApplicationSet{
+		Spec: v1alpha1.ApplicationSetSpec{
+			Generators: []v1alpha1.ApplicationSetGenerator{
+				{
+					List: &v1alpha1.ListGenerator{
+						Elements: []apiextensionsv1.JSON{element(`{"replicas": 3}`)},
+					},
+				},
+			},
+		},
+	}
+
+	if _, err := Expand(set); err == nil {
+		t.Error("expected non string values to return an error")
+	}
+}
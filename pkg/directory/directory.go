@@ -0,0 +1,149 @@
+package directory
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/chime/mani-diffy/pkg/helm"
+	"github.com/gobwas/glob"
+)
+
+// manifestFile matches the files Argo considers when generating manifests from
+// a directory source.
+var manifestFile = regexp.MustCompile(`^.*\.(yaml|yml|json)$`)
+
+// Copy copies the files in src to dst. When directory is nil every file is
+// copied. Otherwise the semantics Argo uses for directory sources apply: only
+// manifests are copied, only the top level of src is considered unless Recurse
+// is set, and relative paths are matched against the Include and Exclude globs.
+//
+// Symlinks are resolved the same way they are when hashing a source: linked
+// files are copied as regular files, and linked directories are copied as
+// regular directories. Links pointing back up the tree are skipped so they
+// don't loop forever.
+func Copy(src, dst string, directory *v1alpha1.ApplicationSourceDirectory) error {
+	recurse := true
+	var include, exclude glob.Glob
+	if directory != nil {
+		var err error
+		recurse = directory.Recurse
+		if include, err = compile(directory.Include); err != nil {
+			return err
+		}
+		if exclude, err = compile(directory.Exclude); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %s %w", dst, err)
+	}
+
+	// ancestors are the resolved directories being walked.
+	var ancestors []string
+	if info, err := os.Lstat(src); err == nil && info.IsDir() {
+		if resolved, err := filepath.EvalSymlinks(src); err == nil {
+			ancestors = append(ancestors, resolved)
+		}
+	}
+
+	var walk func(dir, prefix string, ancestors []string) error
+	walk = func(dir, prefix string, ancestors []string) error {
+		return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("error walking the file path %s: %w", src, err)
+			}
+
+			relPath, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			relPath = filepath.Join(prefix, relPath)
+
+			if d.IsDir() {
+				if relPath != "." && !recurse {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			source := path
+			if d.Type()&fs.ModeSymlink != 0 {
+				target, isDir, err := helm.ResolveSymlink(path)
+				if err != nil {
+					return err
+				}
+				if isDir {
+					resolved, err := filepath.EvalSymlinks(path)
+					if err != nil {
+						return err
+					}
+					if !recurse || helm.SymlinkLoops(resolved, path, ancestors) {
+						return nil
+					}
+					return walk(resolved, relPath, append(ancestors, resolved))
+				}
+				source = target
+			} else if !d.Type().IsRegular() {
+				return nil
+			}
+
+			if directory != nil && !manifestFile.MatchString(d.Name()) {
+				return nil
+			}
+			if exclude != nil && exclude.Match(relPath) {
+				return nil
+			}
+			if include != nil && !include.Match(relPath) {
+				return nil
+			}
+
+			return copyFile(source, filepath.Join(dst, relPath))
+		})
+	}
+	return walk(src, "", ancestors)
+}
+
+func compile(pattern string) (glob.Glob, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	g, err := glob.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	return g, nil
+}
+
+func copyFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %s %w", filepath.Dir(dst), err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
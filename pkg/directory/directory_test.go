@@ -0,0 +1,180 @@
+package directory
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func writeFiles(t *testing.T, root string, files ...string) {
+	t.Helper()
+	for _, f := range files {
+		path := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func listFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestCopy(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src,
+		"deployment.yaml",
+		"service.yml",
+		"README.md",
+		"nested/configmap.yaml",
+		"nested/deep/secret.json",
+		"test/fixture.yaml",
+	)
+
+	scenarios := []struct {
+		name      string
+		directory *v1alpha1.ApplicationSourceDirectory
+		expected  []string
+	}{
+		{
+			name:      "non recursive only copies top level manifests",
+			directory: &v1alpha1.ApplicationSourceDirectory{},
+			expected:  []string{"deployment.yaml", "service.yml"},
+		},
+		{
+			name:      "recursive copies nested manifests",
+			directory: &v1alpha1.ApplicationSourceDirectory{Recurse: true},
+			expected: []string{
+				"deployment.yaml",
+				"nested/configmap.yaml",
+				"nested/deep/secret.json",
+				"service.yml",
+				"test/fixture.yaml",
+			},
+		},
+		{
+			name:      "include glob",
+			directory: &v1alpha1.ApplicationSourceDirectory{Recurse: true, Include: "{deployment.yaml,nested/*}"},
+			expected:  []string{"deployment.yaml", "nested/configmap.yaml", "nested/deep/secret.json"},
+		},
+		{
+			name:      "exclude glob",
+			directory: &v1alpha1.ApplicationSourceDirectory{Recurse: true, Exclude: "test/*"},
+			expected: []string{
+				"deployment.yaml",
+				"nested/configmap.yaml",
+				"nested/deep/secret.json",
+				"service.yml",
+			},
+		},
+		{
+			name:      "exclude wins over include",
+			directory: &v1alpha1.ApplicationSourceDirectory{Recurse: true, Include: "*.yaml", Exclude: "nested/*"},
+			expected:  []string{"deployment.yaml", "test/fixture.yaml"},
+		},
+	}
+
+	for _, tt := range scenarios {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "output")
+			if err := Copy(src, dst, tt.directory); err != nil {
+				t.Fatal(err)
+			}
+			got := listFiles(t, dst)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("copied files do not match. got: %v wanted: %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCopyInvalidGlob(t *testing.T) {
+	src := t.TempDir()
+	err := Copy(src, t.TempDir(), &v1alpha1.ApplicationSourceDirectory{Include: "[unterminated"})
+	if err == nil {
+		t.Error("expected an invalid glob to return an error")
+	}
+}
+
+func TestCopyEverything(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, "Chart.yaml", "README.md", "templates/deployment.yaml", "templates/shared/base.yaml")
+	if err := os.Chmod(filepath.Join(src, "README.md"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("base.yaml", filepath.Join(src, "templates/shared/link.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("shared", filepath.Join(src, "templates/linked-dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(src, "templates/shared/loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "output")
+	if err := Copy(src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"Chart.yaml",
+		"README.md",
+		"templates/deployment.yaml",
+		"templates/linked-dir/base.yaml",
+		"templates/linked-dir/link.yaml",
+		"templates/shared/base.yaml",
+		"templates/shared/link.yaml",
+	}
+	if got := listFiles(t, dst); !reflect.DeepEqual(got, expected) {
+		t.Errorf("copied files do not match. got: %v wanted: %v", got, expected)
+	}
+
+	link := filepath.Join(dst, "templates/shared/link.yaml")
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Errorf("expected the symlink to be copied as a regular file got: %v", info.Mode())
+	}
+	if b, _ := os.ReadFile(link); string(b) != "templates/shared/base.yaml" {
+		t.Errorf("expected the symlink target's content got: %s", b)
+	}
+
+	info, err = os.Stat(filepath.Join(dst, "README.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("expected file mode to be preserved got: %v", info.Mode().Perm())
+	}
+}
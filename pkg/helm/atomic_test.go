@@ -0,0 +1,42 @@
+package helm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "manifest.yaml")
+	if err := os.WriteFile(path, []byte("kind: Secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFileAtomic(path, []byte("kind: ConfigMap\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil || string(b) != "kind: ConfigMap\n" {
+		t.Errorf("expected the manifest to be replaced got: %s %v", b, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0664 {
+		t.Errorf("expected the manifest to keep the 0664 mode got: %s", info.Mode())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected no temporary file to be left behind got: %v", entries)
+	}
+
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "manifest.yaml"), nil, 0664); err == nil {
+		t.Error("expected writing to a missing directory to fail")
+	}
+}
@@ -0,0 +1,83 @@
+package helm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// compressedExt is the extension of manifests written with Options.Compress.
+const compressedExt = ".gz"
+
+// ReadManifest reads the file at path, decompressing it when it was written
+// with Options.Compress.
+func ReadManifest(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil || !strings.HasSuffix(path, compressedExt) {
+		return b, err
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing %s: %w", path, err)
+	}
+	defer r.Close()
+	b, err = io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing %s: %w", path, err)
+	}
+	return b, nil
+}
+
+// writeManifest writes manifest to path, compressed and with the compressed
+// extension added when opts.Compress is set.
+func writeManifest(path string, manifest []byte, opts Options) error {
+	if !opts.Compress {
+		return WriteFileAtomic(path, manifest, 0664)
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, opts.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(manifest); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return WriteFileAtomic(path+compressedExt, buf.Bytes(), 0664)
+}
+
+// emptyCompressedManifest is EmptyManifest for compressed manifests, which
+// are never empty files even when nothing was rendered.
+func emptyCompressedManifest(manifest string) (bool, error) {
+	f, err := os.Open(manifest)
+	if errors.Is(err, fs.ErrNotExist) {
+		// the root dirs don't have manifest files
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking if %s is empty: %w", manifest, err)
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return false, fmt.Errorf("error checking if %s is empty: %w", manifest, err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAtLeast(r, make([]byte, 1), 1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		return false, fmt.Errorf("error checking if %s is empty: %w", manifest, err)
+	}
+	return false, nil
+}
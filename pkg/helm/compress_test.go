@@ -0,0 +1,89 @@
+package helm
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteToFileCompress(t *testing.T) {
+	manifest := `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: child
+spec:
+  source:
+    path: charts/child
+`
+	opts := Options{Compress: true, CompressionLevel: gzip.BestCompression}
+
+	output := filepath.Join(t.TempDir(), "app")
+	if err := writeToFile([]byte(manifest), "", output, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "manifest.yaml")); !os.IsNotExist(err) {
+		t.Error("expected no uncompressed manifest to be written")
+	}
+
+	path := filepath.Join(output, ManifestName("", "", true))
+	b, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != manifest {
+		t.Errorf("expected the manifest to round trip got: %s", b)
+	}
+
+	apps, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || apps[0].ObjectMeta.Name != "child" {
+		t.Errorf("expected the application in the compressed manifest to be read got: %v", apps)
+	}
+
+	empty, err := EmptyManifest(path)
+	if err != nil || empty {
+		t.Errorf("expected the manifest not to be empty got: %t %v", empty, err)
+	}
+
+	emptyOutput := filepath.Join(t.TempDir(), "empty")
+	if err := writeToFile([]byte{}, "", emptyOutput, opts); err != nil {
+		t.Fatal(err)
+	}
+	empty, err = EmptyManifest(filepath.Join(emptyOutput, ManifestName("", "", true)))
+	if err != nil || !empty {
+		t.Errorf("expected the compressed empty manifest to be empty got: %t %v", empty, err)
+	}
+
+	empty, err = EmptyManifest(filepath.Join(t.TempDir(), ManifestName("", "", true)))
+	if err != nil || empty {
+		t.Errorf("expected a missing manifest not to be empty got: %t %v", empty, err)
+	}
+}
+
+func TestWriteToFileCompressSplit(t *testing.T) {
+	manifest := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`
+	output := t.TempDir()
+	if err := writeToFile([]byte(manifest), "", output, Options{SplitManifests: true, Compress: true, CompressionLevel: gzip.DefaultCompression}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ReadManifest(filepath.Join(output, "configmap-config.yaml.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != manifest {
+		t.Errorf("expected the resource to round trip got: %s", b)
+	}
+
+	empty, err := EmptyManifestDir(output)
+	if err != nil || empty {
+		t.Errorf("expected the split manifest not to be empty got: %t %v", empty, err)
+	}
+}
@@ -0,0 +1,70 @@
+package helm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+// ErrOutsideRoot is returned with Options.ConfinePaths when a source reads a
+// file outside of the working directory.
+var ErrOutsideRoot = errors.New("path is outside of the repo")
+
+// checkConfined returns an error wrapping ErrOutsideRoot when the chart, a
+// value file or a file parameter of source resolves outside of root,
+// following symlinks. Ignored value files are never read, so they are not
+// checked.
+func checkConfined(source *v1alpha1.ApplicationSource, root string, ignoreValueFiles []string) error {
+	root, err := resolvePath(root)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	if !remoteChart(source) {
+		paths = append(paths, source.Path)
+	}
+	if source.Helm != nil {
+		for _, valueFile := range source.Helm.ValueFiles {
+			// The value files shipped with a remote chart have no
+			// path, and are always inside it.
+			if path := ValueFilePath(source, valueFile); path != "" && !ignoredValueFile(valueFile, ignoreValueFiles) {
+				paths = append(paths, path)
+			}
+		}
+		for _, parameter := range source.Helm.FileParameters {
+			paths = append(paths, filepath.Join(source.Path, parameter.Path))
+		}
+	}
+
+	for _, path := range paths {
+		resolved, err := resolvePath(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s: %w", path, ErrOutsideRoot)
+		}
+	}
+	return nil
+}
+
+// resolvePath returns the absolute path of path with its symlinks resolved.
+// Missing files are left to helm to report, so their path is only made
+// absolute.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if errors.Is(err, os.ErrNotExist) {
+		return abs, nil
+	}
+	return resolved, err
+}
@@ -0,0 +1,89 @@
+package helm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestCheckConfined(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	chart := filepath.Join(root, "charts", "app")
+	if err := os.MkdirAll(chart, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "values.yaml"), []byte("replicas: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "linked")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		source   v1alpha1.ApplicationSource
+		confined bool
+	}{
+		{
+			name:     "inside",
+			source:   v1alpha1.ApplicationSource{Path: chart, Helm: &v1alpha1.ApplicationSourceHelm{ValueFiles: []string{"../../values/app.yaml", "values-prod.yaml"}}},
+			confined: true,
+		},
+		{
+			name:   "relative",
+			source: v1alpha1.ApplicationSource{Path: chart, Helm: &v1alpha1.ApplicationSourceHelm{ValueFiles: []string{"../../../etc/passwd"}}},
+		},
+		{
+			name:   "absolute",
+			source: v1alpha1.ApplicationSource{Path: chart, Helm: &v1alpha1.ApplicationSourceHelm{ValueFiles: []string{"/etc/passwd"}}},
+		},
+		{
+			name:   "symlink",
+			source: v1alpha1.ApplicationSource{Path: chart, Helm: &v1alpha1.ApplicationSourceHelm{ValueFiles: []string{"../../linked/values.yaml"}}},
+		},
+		{
+			name:     "ignored",
+			source:   v1alpha1.ApplicationSource{Path: chart, Helm: &v1alpha1.ApplicationSourceHelm{ValueFiles: []string{"/etc/passwd-ignore"}}},
+			confined: true,
+		},
+		{
+			name:   "file parameter",
+			source: v1alpha1.ApplicationSource{Path: chart, Helm: &v1alpha1.ApplicationSourceHelm{FileParameters: []v1alpha1.HelmFileParameter{{Name: "key", Path: "../../../key.pem"}}}},
+		},
+		{
+			name:   "chart",
+			source: v1alpha1.ApplicationSource{Path: outside, Helm: &v1alpha1.ApplicationSourceHelm{}},
+		},
+	} {
+		source := tc.source
+		err := checkConfined(&source, root, []string{"-ignore"})
+		if tc.confined && err != nil {
+			t.Errorf("expected the %s paths to be confined got: %v", tc.name, err)
+		}
+		if !tc.confined && !errors.Is(err, ErrOutsideRoot) {
+			t.Errorf("expected the %s path to be outside of the root got: %v", tc.name, err)
+		}
+	}
+}
+
+func TestRunConfinePaths(t *testing.T) {
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: t.TempDir(),
+				Helm: &v1alpha1.ApplicationSourceHelm{ValueFiles: []string{"/etc/passwd"}},
+			},
+		},
+	}
+	crd.ObjectMeta.Name = "untrusted"
+
+	err := Run(context.Background(), crd, t.TempDir(), Options{ConfinePaths: true})
+	if !errors.Is(err, ErrOutsideRoot) {
+		t.Errorf("expected the value file to be rejected before templating got: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package helm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// lockedDependency is a dependency pinned in the Chart.lock of a chart.
+type lockedDependency struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Repository string `json:"repository"`
+}
+
+// resolveDependencies makes the dependencies of the chart in chartDirectory
+// available. When a cache directory is configured, dependencies fetched for
+// one chart are reused by every chart locking the same name and version, and
+// `helm dependency update` only runs when one of them is not cached yet.
+//
+// Applications rendered concurrently may share a chart, so the dependencies
+// of a chart are only resolved by one of them at a time.
+func resolveDependencies(ctx context.Context, chartDirectory string, opts Options) error {
+	unlock := lockChart(chartDirectory)
+	defer unlock()
+
+	if opts.DependencyCacheDir == "" {
+		return updateDependencies(ctx, chartDirectory, opts.DependencyStrategy, opts.DependencyUpdateRetries)
+	}
+
+	restored, err := restoreDependencies(chartDirectory, opts.DependencyCacheDir)
+	if err != nil || restored {
+		return err
+	}
+
+	if err := updateDependencies(ctx, chartDirectory, opts.DependencyStrategy, opts.DependencyUpdateRetries); err != nil {
+		return err
+	}
+	return cacheDependencies(chartDirectory, opts.DependencyCacheDir)
+}
+
+// chartLocks holds a *sync.Mutex for every chart directory whose dependencies
+// were resolved.
+var chartLocks sync.Map
+
+// lockChart locks the chart in chartDirectory, returning a function unlocking
+// it.
+func lockChart(chartDirectory string) func() {
+	if abs, err := filepath.Abs(chartDirectory); err == nil {
+		chartDirectory = abs
+	}
+	mu, _ := chartLocks.LoadOrStore(chartDirectory, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// lockedDependencies returns the dependencies locked by the chart.
+func lockedDependencies(chartDirectory string) ([]lockedDependency, error) {
+	b, err := os.ReadFile(filepath.Join(chartDirectory, "Chart.lock"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lock struct {
+		Dependencies []lockedDependency `json:"dependencies"`
+	}
+	if err := yamlutil.Unmarshal(b, &lock); err != nil {
+		return nil, fmt.Errorf("error reading the Chart.lock of %s: %w", chartDirectory, err)
+	}
+	return lock.Dependencies, nil
+}
+
+// cacheable reports whether the dependency can be shared with other charts.
+// Dependencies from `file://` repositories can change without a version bump,
+// so they are not.
+func (d lockedDependency) cacheable() bool {
+	return !strings.HasPrefix(d.Repository, "file://")
+}
+
+// archive is the name helm gives to the package of a dependency in charts/.
+func (d lockedDependency) archive() string {
+	return fmt.Sprintf("%s-%s.tgz", d.Name, d.Version)
+}
+
+// restoreDependencies copies the dependencies of the chart from cacheDir into
+// its charts/ directory. It reports whether every dependency was cached; when
+// one is missing, or can't be cached, nothing is copied.
+func restoreDependencies(chartDirectory, cacheDir string) (bool, error) {
+	deps, err := lockedDependencies(chartDirectory)
+	if err != nil || len(deps) == 0 {
+		return false, err
+	}
+
+	for _, dep := range deps {
+		if !dep.cacheable() {
+			return false, nil
+		}
+		if _, err := os.Stat(filepath.Join(cacheDir, dep.archive())); err != nil {
+			return false, nil
+		}
+	}
+
+	for _, dep := range deps {
+		if err := copyArchive(filepath.Join(cacheDir, dep.archive()), filepath.Join(chartDirectory, "charts", dep.archive())); err != nil {
+			return false, err
+		}
+	}
+	slog.Info("Restored dependencies from cache", "chart", chartDirectory)
+	return true, nil
+}
+
+// cacheDependencies copies the dependencies fetched into the charts/
+// directory of the chart to cacheDir.
+func cacheDependencies(chartDirectory, cacheDir string) error {
+	deps, err := lockedDependencies(chartDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, dep := range deps {
+		if !dep.cacheable() {
+			continue
+		}
+		src := filepath.Join(chartDirectory, "charts", dep.archive())
+		if _, err := os.Stat(src); err != nil {
+			// Not packaged under the usual name, so leave it to helm.
+			continue
+		}
+		if err := copyArchive(src, filepath.Join(cacheDir, dep.archive())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyArchive copies src to dst through a temporary file, so a concurrent
+// reader never sees a partially written archive.
+func copyArchive(src, dst string) error {
+	if err := CreateDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-"+filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,115 @@
+package helm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDependencyCache(t *testing.T) {
+	lock := `dependencies:
+- name: redis
+  repository: https://charts.bitnami.com/bitnami
+  version: 17.3.7
+- name: common
+  repository: file://../common
+  version: 0.1.0
+digest: sha256:0000
+generated: "2023-01-01T00:00:00Z"
+`
+	newChart := func(lock string) string {
+		chart := t.TempDir()
+		if err := os.WriteFile(filepath.Join(chart, "Chart.lock"), []byte(lock), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return chart
+	}
+	cache := filepath.Join(t.TempDir(), "cache")
+
+	chart := newChart(lock)
+	restored, err := restoreDependencies(chart, cache)
+	if err != nil || restored {
+		t.Fatalf("expected nothing to be restored from an empty cache got: %t %v", restored, err)
+	}
+
+	// What `helm dependency update` would have fetched.
+	if err := os.MkdirAll(filepath.Join(chart, "charts"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for _, archive := range []string{"redis-17.3.7.tgz", "common-0.1.0.tgz"} {
+		if err := os.WriteFile(filepath.Join(chart, "charts", archive), []byte(archive), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cacheDependencies(chart, cache); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cache, "common-0.1.0.tgz")); err == nil {
+		t.Error("expected local dependencies not to be cached")
+	}
+
+	// The local dependency can't be restored from the cache.
+	restored, err = restoreDependencies(newChart(lock), cache)
+	if err != nil || restored {
+		t.Fatalf("expected nothing to be restored got: %t %v", restored, err)
+	}
+
+	other := newChart(strings.Replace(lock, "- name: common\n  repository: file://../common\n  version: 0.1.0\n", "", 1))
+	restored, err = restoreDependencies(other, cache)
+	if err != nil || !restored {
+		t.Fatalf("expected the dependencies to be restored got: %t %v", restored, err)
+	}
+	b, err := os.ReadFile(filepath.Join(other, "charts", "redis-17.3.7.tgz"))
+	if err != nil || string(b) != "redis-17.3.7.tgz" {
+		t.Errorf("expected the cached archive to be restored got: %s %v", b, err)
+	}
+}
+
+func TestDependencyStrategy(t *testing.T) {
+	// A fake helm recording the dependency command it was called with.
+	bin := t.TempDir()
+	calls := filepath.Join(t.TempDir(), "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\n"
+	if err := os.WriteFile(filepath.Join(bin, "helm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	locked := t.TempDir()
+	if err := os.WriteFile(filepath.Join(locked, "Chart.lock"), []byte("dependencies: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unlocked := t.TempDir()
+
+	for _, tc := range []struct {
+		chart    string
+		strategy string
+		expected string
+	}{
+		{chart: locked, strategy: "", expected: "dependency update"},
+		{chart: locked, strategy: DependencyStrategyUpdate, expected: "dependency update"},
+		{chart: locked, strategy: DependencyStrategyBuild, expected: "dependency build"},
+		// Without a lock there is nothing to build from.
+		{chart: unlocked, strategy: DependencyStrategyBuild, expected: "dependency update"},
+	} {
+		if err := os.Remove(calls); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if err := resolveDependencies(context.Background(), tc.chart, Options{DependencyStrategy: tc.strategy}); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(b)) != tc.expected {
+			t.Errorf("expected helm %s for the %s strategy got: %s", tc.expected, tc.strategy, b)
+		}
+	}
+
+	if err := CheckDependencyStrategy("upgrade"); err == nil {
+		t.Error("expected an unknown strategy to fail")
+	}
+}
@@ -0,0 +1,73 @@
+package helm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+// envPlaceholder matches the `${VAR}` placeholders expanded with
+// Options.ExpandEnv. The bare `$VAR` form is left alone, since it appears in
+// values like passwords and regular expressions.
+var envPlaceholder = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the `${VAR}` placeholders in s with the value of the
+// environment variable, which is empty when it isn't set.
+func expandEnv(s string) string {
+	return envPlaceholder.ReplaceAllStringFunc(s, func(placeholder string) string {
+		return os.Getenv(envPlaceholder.FindStringSubmatch(placeholder)[1])
+	})
+}
+
+// expandValueFile returns the content of the value file at path with its
+// placeholders expanded.
+func expandValueFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading values: %w", err)
+	}
+	return []byte(expandEnv(string(b))), nil
+}
+
+// expandValues returns a copy of helmInfo whose inline values and value files
+// have their placeholders expanded. The expanded value files are temporary
+// copies, removed by the returned function once the chart is templated.
+func expandValues(helmInfo *v1alpha1.Application, opts Options) (*v1alpha1.Application, func(), error) {
+	expanded := helmInfo.DeepCopy()
+	source := expanded.Spec.Source
+	source.Helm.Values = expandEnv(source.Helm.Values)
+
+	var copies []string
+	cleanup := func() {
+		for _, file := range copies {
+			os.Remove(file)
+		}
+	}
+	for i, valueFile := range source.Helm.ValueFiles {
+		if ignoredValueFile(valueFile, opts.IgnoreValueFiles) {
+			continue
+		}
+		b, err := expandValueFile(ValueFilePath(helmInfo.Spec.Source, valueFile))
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		file, err := createTempFile(string(b))
+		if file != "" {
+			copies = append(copies, file)
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		// Absolute, since helm runs in the chart directory.
+		if source.Helm.ValueFiles[i], err = filepath.Abs(file); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	return expanded, cleanup, nil
+}
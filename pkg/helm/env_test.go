@@ -0,0 +1,106 @@
+package helm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestExpandValues(t *testing.T) {
+	t.Setenv("MANI_DIFFY_TEST_REPLICAS", "3")
+	chart := t.TempDir()
+	if err := os.WriteFile(filepath.Join(chart, "overrides.yaml"), []byte("replicas: ${MANI_DIFFY_TEST_REPLICAS}\npassword: $ecret\nmissing: \"${MANI_DIFFY_TEST_UNSET}\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	app := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: chart,
+				Helm: &v1alpha1.ApplicationSourceHelm{
+					Values:     "image: app:${MANI_DIFFY_TEST_REPLICAS}\n",
+					ValueFiles: []string{"overrides.yaml", "ignored.yaml"},
+				},
+			},
+		},
+	}
+
+	expanded, cleanup, err := expandValues(app, Options{IgnoreValueFiles: []string{"ignored"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expanded.Spec.Source.Helm.Values != "image: app:3\n" {
+		t.Errorf("expected the inline values to be expanded got: %q", expanded.Spec.Source.Helm.Values)
+	}
+	if app.Spec.Source.Helm.Values != "image: app:${MANI_DIFFY_TEST_REPLICAS}\n" || app.Spec.Source.Helm.ValueFiles[0] != "overrides.yaml" {
+		t.Errorf("expected the application to be left alone got: %+v", app.Spec.Source.Helm)
+	}
+	if expanded.Spec.Source.Helm.ValueFiles[1] != "ignored.yaml" {
+		t.Errorf("expected ignored value files to be left alone got: %v", expanded.Spec.Source.Helm.ValueFiles)
+	}
+
+	valueFile := expanded.Spec.Source.Helm.ValueFiles[0]
+	b, err := os.ReadFile(valueFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "replicas: 3\npassword: $ecret\nmissing: \"\"\n"; string(b) != expected {
+		t.Errorf("expected the value file to be expanded to %q got: %q", expected, b)
+	}
+
+	cleanup()
+	if _, err := os.Stat(valueFile); !os.IsNotExist(err) {
+		t.Errorf("expected the expanded copy to be removed got: %v", err)
+	}
+
+	app.Spec.Source.Helm.ValueFiles = []string{"missing.yaml"}
+	if _, _, err := expandValues(app, Options{}); err == nil {
+		t.Error("expected a missing value file to fail")
+	}
+}
+
+func TestGenerateHashExpandEnv(t *testing.T) {
+	chart := t.TempDir()
+	if err := os.WriteFile(filepath.Join(chart, "overrides.yaml"), []byte("replicas: ${MANI_DIFFY_TEST_REPLICAS}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash := func(values string, opts Options) string {
+		t.Helper()
+		h, err := GenerateHash(context.Background(), &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{
+				Source: &v1alpha1.ApplicationSource{
+					Path: chart,
+					Helm: &v1alpha1.ApplicationSourceHelm{
+						Values:     values,
+						ValueFiles: []string{"overrides.yaml"},
+					},
+				},
+			},
+		}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	for _, values := range []string{"", "image: ${MANI_DIFFY_TEST_IMAGE}\n"} {
+		t.Setenv("MANI_DIFFY_TEST_REPLICAS", "1")
+		t.Setenv("MANI_DIFFY_TEST_IMAGE", "app:1")
+		verbatim := hash(values, Options{})
+		expanded := hash(values, Options{ExpandEnv: true})
+
+		if values == "" {
+			t.Setenv("MANI_DIFFY_TEST_REPLICAS", "2")
+		} else {
+			t.Setenv("MANI_DIFFY_TEST_IMAGE", "app:2")
+		}
+		if hash(values, Options{}) != verbatim {
+			t.Errorf("expected the environment not to change the hash without -expand-env for %q", values)
+		}
+		if hash(values, Options{ExpandEnv: true}) == expanded {
+			t.Errorf("expected the environment to change the hash with -expand-env for %q", values)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package helm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// ExcludeKinds removes the documents of manifest whose kind is one of kinds,
+// compared case insensitively. The other documents are kept as they are.
+// The manifest is returned unchanged when kinds is empty.
+func ExcludeKinds(manifest []byte, kinds []string) ([]byte, error) {
+	if len(kinds) == 0 {
+		return manifest, nil
+	}
+
+	reader := yamlutil.NewYAMLReader(bufio.NewReader(bytes.NewReader(manifest)))
+	var out bytes.Buffer
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The reader keeps the separator the manifest starts with.
+		doc = bytes.TrimPrefix(doc, []byte("---\n"))
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		var resource struct {
+			Kind string `json:"kind"`
+		}
+		if err := yamlutil.Unmarshal(doc, &resource); err != nil {
+			return nil, fmt.Errorf("error excluding kinds from manifest: %w", err)
+		}
+		if excludedKind(resource.Kind, kinds) {
+			continue
+		}
+
+		out.WriteString("---\n")
+		out.Write(doc)
+		if !bytes.HasSuffix(doc, []byte("\n")) {
+			out.WriteString("\n")
+		}
+	}
+}
+
+func excludedKind(kind string, kinds []string) bool {
+	if kind == "" {
+		return false
+	}
+	for _, k := range kinds {
+		if strings.EqualFold(kind, k) {
+			return true
+		}
+	}
+	return false
+}
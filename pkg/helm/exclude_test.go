@@ -0,0 +1,51 @@
+package helm
+
+import (
+	"testing"
+)
+
+func TestExcludeKinds(t *testing.T) {
+	manifest := `---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+---
+# Source: app/templates/secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: password
+data:
+  password: cm90YXRlZA==
+---
+# Source: app/templates/empty.yaml
+`
+
+	unchanged, err := ExcludeKinds([]byte(manifest), nil)
+	if err != nil || string(unchanged) != manifest {
+		t.Errorf("expected the manifest to be unchanged got: %s %v", unchanged, err)
+	}
+
+	filtered, err := ExcludeKinds([]byte(manifest), []string{"secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+---
+# Source: app/templates/empty.yaml
+`
+	if string(filtered) != expected {
+		t.Errorf("expected the secret to be excluded got:\n%s", filtered)
+	}
+
+	if _, err := ExcludeKinds([]byte("kind: [\n"), []string{"Secret"}); err == nil {
+		t.Error("expected invalid YAML to fail")
+	}
+}
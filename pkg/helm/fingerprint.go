@@ -0,0 +1,133 @@
+package helm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FingerprintCache remembers the hashes of the directories and files read
+// when hashing, along with a fingerprint of the sizes and modification times
+// of their files. As long as the fingerprint of a path stays the same, its
+// hash is reused without reading its files. When it changed the content is
+// hashed again, so it stays the source of truth.
+type FingerprintCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]fingerprintEntry
+	dirty   bool
+}
+
+type fingerprintEntry struct {
+	Fingerprint string `json:"fingerprint"`
+	Sum         string `json:"sum"`
+}
+
+// LoadFingerprintCache reads the fingerprint cache stored in the file at path.
+// A missing file is an empty cache.
+func LoadFingerprintCache(path string) (*FingerprintCache, error) {
+	c := &FingerprintCache{path: path, entries: map[string]fingerprintEntry{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading the fingerprint cache: %w", err)
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, fmt.Errorf("error reading the fingerprint cache %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Save writes the cache back to its file when it changed.
+func (c *FingerprintCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	b, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(c.path, b, 0664); err != nil {
+		return fmt.Errorf("error writing the fingerprint cache: %w", err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// hash returns hashPath(path, rules, newHash), reusing the hash stored for
+// path and algorithm when its fingerprint didn't change. Without a cache it
+// always hashes the content.
+func (c *FingerprintCache) hash(path string, rules *ignoreRules, algorithm string, newHash func() hash.Hash) ([]byte, error) {
+	if c == nil {
+		return hashPath(path, rules, newHash)
+	}
+
+	fingerprint, err := fingerprintPath(path, rules)
+	if err != nil {
+		// Let hashing the content report the error.
+		return hashPath(path, rules, newHash)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	key := algorithm + ":" + abs
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && entry.Fingerprint == fingerprint {
+		if sum, err := hex.DecodeString(entry.Sum); err == nil {
+			return sum, nil
+		}
+	}
+
+	sum, err := hashPath(path, rules, newHash)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[key] = fingerprintEntry{Fingerprint: fingerprint, Sum: hex.EncodeToString(sum)}
+	c.dirty = true
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// fingerprintPath returns a fingerprint of the files hashed for path: their
+// paths, sizes, modes and modification times, walked like they are hashed.
+func fingerprintPath(path string, rules *ignoreRules) (string, error) {
+	m, err := hashDir(path, rules, func(file string) ([]byte, error) {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("%d %d %s", info.Size(), info.ModTime().UnixNano(), info.Mode())), nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	files := make([]string, 0, len(m))
+	for file := range m {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(h, "%s  %s\n", m[file], file)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
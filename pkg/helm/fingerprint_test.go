@@ -0,0 +1,86 @@
+package helm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFingerprintCache(t *testing.T) {
+	chart := t.TempDir()
+	values := filepath.Join(chart, "values.yaml")
+	if err := os.WriteFile(values, []byte("replicas: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(values, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "fingerprints.json")
+	cache, err := LoadFingerprintCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := generalHashFunction(chart, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := cache.hash(chart, nil, HashSHA256, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sum, expected) {
+		t.Errorf("expected the content hash got: %x", sum)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size and modification time, so the content isn't read again.
+	if err := os.WriteFile(values, []byte("replicas: 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(values, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	cache, err = LoadFingerprintCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := cache.hash(chart, nil, HashSHA256, sha256.New); err != nil || !bytes.Equal(sum, expected) {
+		t.Errorf("expected the stored hash to be reused got: %x %v", sum, err)
+	}
+
+	// Another algorithm doesn't reuse the hash of sha256.
+	if sum, err := cache.hash(chart, nil, HashBLAKE3, sha256.New); err != nil || bytes.Equal(sum, expected) {
+		t.Errorf("expected the content to be hashed for another algorithm got: %x %v", sum, err)
+	}
+
+	if err := os.Chtimes(values, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := generalHashFunction(chart, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := cache.hash(chart, nil, HashSHA256, sha256.New); err != nil || !bytes.Equal(sum, changed) || bytes.Equal(sum, expected) {
+		t.Errorf("expected the content to be hashed again once the fingerprint changed got: %x %v", sum, err)
+	}
+
+	// Without a cache the content is always hashed.
+	var none *FingerprintCache
+	if sum, err := none.hash(chart, nil, HashSHA256, sha256.New); err != nil || !bytes.Equal(sum, changed) {
+		t.Errorf("expected the content hash without a cache got: %x %v", sum, err)
+	}
+
+	if _, err := none.hash(filepath.Join(chart, "missing.yaml"), nil, HashSHA256, sha256.New); err == nil {
+		t.Error("expected hashing a missing file to fail")
+	}
+	if _, err := cache.hash(filepath.Join(chart, "missing.yaml"), nil, HashSHA256, sha256.New); err == nil {
+		t.Error("expected hashing a missing file to fail with a cache")
+	}
+}
@@ -0,0 +1,142 @@
+package helm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// DefaultManifestFilename is the name of the file manifests are written to
+// unless Options.ManifestFilename is set.
+const DefaultManifestFilename = "manifest.yaml"
+
+// formatExt is the extension of the manifests written in format, FormatYAML
+// when empty.
+func formatExt(format string) string {
+	if format == FormatJSON {
+		return ".json"
+	}
+	return ".yaml"
+}
+
+// ManifestName is the name of the file holding the manifest of an
+// application written in format, which is compressed when compress is set.
+// The name is filename, DefaultManifestFilename when empty, with the
+// extension of format.
+func ManifestName(filename, format string, compress bool) string {
+	if filename == "" {
+		filename = DefaultManifestFilename
+	}
+	switch ext := filepath.Ext(filename); ext {
+	case ".yaml", ".yml", ".json":
+		filename = strings.TrimSuffix(filename, ext)
+	}
+	name := filename + formatExt(format)
+	if compress {
+		return name + compressedExt
+	}
+	return name
+}
+
+// CheckFormat returns an error unless format is one manifests can be written
+// in.
+func CheckFormat(format string) error {
+	switch format {
+	case "", FormatYAML, FormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format %q, must be %s or %s", format, FormatYAML, FormatJSON)
+	}
+}
+
+// CheckManifestFilename returns an error unless filename can name the file
+// manifests are written to in the output directory of an application.
+func CheckManifestFilename(filename string) error {
+	if filename == "" || filename == "." || filename == ".." || strings.ContainsRune(filename, '/') || strings.ContainsRune(filename, filepath.Separator) {
+		return fmt.Errorf("invalid manifest filename %q, must be the name of a file", filename)
+	}
+	return nil
+}
+
+// toJSON converts the YAML documents of manifest to a JSON array holding one
+// object per document. Documents without anything in them are left out, and
+// a manifest without any object stays empty, so it's still detected as such.
+func toJSON(manifest []byte) ([]byte, error) {
+	dec := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader(manifest), 1000)
+	var docs []json.RawMessage
+	for {
+		var doc json.RawMessage
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("error converting manifest to JSON: %w", err)
+		}
+		if len(doc) == 0 || string(doc) == "null" {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) == 0 {
+		return []byte{}, nil
+	}
+
+	b, err := json.MarshalIndent(docs, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error converting manifest to JSON: %w", err)
+	}
+	return append(b, '\n'), nil
+}
+
+// CountResources returns the number of Kubernetes resources in manifest,
+// written as YAML documents or as the JSON array of FormatJSON. Documents
+// without a kind, e.g. a template gated by a condition, aren't resources.
+func CountResources(manifest []byte) (int, error) {
+	dec := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader(manifest), 1000)
+	var pending []json.RawMessage
+	count := 0
+	for {
+		var doc json.RawMessage
+		if len(pending) > 0 {
+			doc, pending = pending[0], pending[1:]
+		} else if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				return count, nil
+			}
+			return count, fmt.Errorf("error counting resources: %w", err)
+		}
+		doc = bytes.TrimSpace(doc)
+		if len(doc) == 0 || string(doc) == "null" {
+			continue
+		}
+		if bytes.HasPrefix(doc, []byte("[")) {
+			var docs []json.RawMessage
+			if err := json.Unmarshal(doc, &docs); err != nil {
+				return count, fmt.Errorf("error counting resources: %w", err)
+			}
+			pending = append(docs, pending...)
+			continue
+		}
+
+		var resource struct {
+			Kind string `json:"kind"`
+		}
+		if err := json.Unmarshal(doc, &resource); err != nil {
+			return count, fmt.Errorf("error counting resources: %w", err)
+		}
+		if resource.Kind != "" {
+			count++
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package helm
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteToFileJSON(t *testing.T) {
+	manifest := `---
+# Source: app/templates/app.yaml
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: child
+spec:
+  source:
+    path: charts/child
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 1000000
+---
+# Source: app/templates/empty.yaml
+`
+	opts := Options{OutputFormat: FormatJSON}
+
+	output := filepath.Join(t.TempDir(), "app")
+	if err := writeToFile([]byte(manifest), "", output, opts); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(output, ManifestName("", FormatJSON, false))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []map[string]interface{}
+	if err := json.Unmarshal(b, &docs); err != nil {
+		t.Fatalf("expected a JSON array got: %s %v", b, err)
+	}
+	if len(docs) != 2 || docs[1]["kind"] != "Deployment" {
+		t.Errorf("expected the two resources got: %s", b)
+	}
+	if want := `"replicas": 1000000`; !strings.Contains(string(b), want) {
+		t.Errorf("expected integers to be kept as they are got: %s", b)
+	}
+
+	apps, err := Read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps[0].ObjectMeta.Name != "child" {
+		t.Errorf("expected the documents of the JSON manifest to be read got: %v", apps)
+	}
+
+	emptyOutput := filepath.Join(t.TempDir(), "empty")
+	if err := writeToFile([]byte("---\n# Source: app/templates/empty.yaml\n"), "", emptyOutput, opts); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := EmptyManifest(filepath.Join(emptyOutput, ManifestName("", FormatJSON, false)))
+	if err != nil || !empty {
+		t.Errorf("expected a manifest without resources to be empty got: %t %v", empty, err)
+	}
+
+	split := t.TempDir()
+	if err := writeToFile([]byte(manifest), "", split, Options{OutputFormat: FormatJSON, SplitManifests: true}); err != nil {
+		t.Fatal(err)
+	}
+	b, err = os.ReadFile(filepath.Join(split, "deployment-web.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil || doc["kind"] != "Deployment" {
+		t.Errorf("expected the resource as a JSON object got: %s %v", b, err)
+	}
+	empty, err = EmptyManifestDir(split)
+	if err != nil || empty {
+		t.Errorf("expected the split manifest not to be empty got: %t %v", empty, err)
+	}
+
+	if err := CheckFormat("toml"); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
+
+func TestManifestFilename(t *testing.T) {
+	for _, tc := range []struct {
+		filename string
+		format   string
+		compress bool
+		expected string
+	}{
+		{expected: "manifest.yaml"},
+		{filename: "rendered.yaml", expected: "rendered.yaml"},
+		{filename: "rendered.yml", expected: "rendered.yaml"},
+		{filename: "00-rendered", expected: "00-rendered.yaml"},
+		{filename: "rendered.yaml", format: FormatJSON, expected: "rendered.json"},
+		{filename: "rendered.yaml", compress: true, expected: "rendered.yaml.gz"},
+	} {
+		if name := ManifestName(tc.filename, tc.format, tc.compress); name != tc.expected {
+			t.Errorf("expected %q in %q to be named %s got: %s", tc.filename, tc.format, tc.expected, name)
+		}
+	}
+
+	output := t.TempDir()
+	if err := writeToFile([]byte("kind: ConfigMap\n"), "", output, Options{ManifestFilename: "rendered.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "rendered.yaml")); err != nil {
+		t.Errorf("expected the manifest to be written to rendered.yaml: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(output, DefaultManifestFilename)); !os.IsNotExist(err) {
+		t.Errorf("expected no %s to be written got: %v", DefaultManifestFilename, err)
+	}
+
+	for _, filename := range []string{"", "..", "apps/manifest.yaml"} {
+		if err := CheckManifestFilename(filename); err == nil {
+			t.Errorf("expected %q to be an invalid manifest filename", filename)
+		}
+	}
+	if err := CheckManifestFilename("rendered.yaml"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCountResources(t *testing.T) {
+	for _, tc := range []struct {
+		manifest string
+		expected int
+	}{
+		{manifest: "", expected: 0},
+		{manifest: "---\n# Source: chart/templates/empty.yaml\n", expected: 0},
+		{manifest: "kind: ConfigMap\n---\nkind: Secret\n", expected: 2},
+		{manifest: "[\n  {\"kind\": \"ConfigMap\"},\n  {\"kind\": \"Secret\"}\n]\n", expected: 2},
+	} {
+		count, err := CountResources([]byte(tc.manifest))
+		if err != nil || count != tc.expected {
+			t.Errorf("expected %d resources in %q got: %d %v", tc.expected, tc.manifest, count, err)
+		}
+	}
+
+	if _, err := CountResources([]byte("kind: ConfigMap\n---\nkind: [\n")); err == nil {
+		t.Error("expected a malformed manifest to fail")
+	}
+}
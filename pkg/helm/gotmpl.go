@@ -0,0 +1,132 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// gotmplExt is the extension of the value files rendered as Go templates with
+// Options.GotmplValues, e.g. values.yaml.gotmpl like helmfile reads them.
+const gotmplExt = ".gotmpl"
+
+// LoadGotmplData reads the data the value files are rendered with from the
+// YAML file at path.
+func LoadGotmplData(path string) (map[string]interface{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading gotmpl data: %w", err)
+	}
+	data := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("error parsing gotmpl data %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// gotmplValueFile reports whether the value file at path is rendered as a Go
+// template before helm reads it.
+func gotmplValueFile(path string, opts Options) bool {
+	return opts.GotmplValues && strings.HasSuffix(path, gotmplExt)
+}
+
+// renderGotmpl renders the value file at path as a Go template with data as
+// its dot. Like helmfile, `env` and `requiredEnv` read the environment, and a
+// key missing from data is an error instead of rendering as `<no value>`.
+func renderGotmpl(path string, data map[string]interface{}) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading values: %w", err)
+	}
+	tmpl, err := texttemplate.New(filepath.Base(path)).
+		Option("missingkey=error").
+		Funcs(texttemplate.FuncMap{
+			"env": os.Getenv,
+			"requiredEnv": func(name string) (string, error) {
+				value, ok := os.LookupEnv(name)
+				if !ok || value == "" {
+					return "", fmt.Errorf("required environment variable %s is not set", name)
+				}
+				return value, nil
+			},
+		}).
+		Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing values %s: %w", path, err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, fmt.Errorf("error rendering values %s: %w", path, err)
+	}
+	return out.Bytes(), nil
+}
+
+// valueFileContent returns what helm reads of the value file at path once it's
+// rendered as a Go template and has its placeholders expanded, depending on
+// opts.
+func valueFileContent(path string, opts Options) ([]byte, error) {
+	if !gotmplValueFile(path, opts) {
+		if opts.ExpandEnv {
+			return expandValueFile(path)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading values: %w", err)
+		}
+		return b, nil
+	}
+	b, err := renderGotmpl(path, opts.GotmplData)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ExpandEnv {
+		b = []byte(expandEnv(string(b)))
+	}
+	return b, nil
+}
+
+// renderGotmplValues returns a copy of helmInfo whose gotmpl value files are
+// replaced by temporary copies rendered with Options.GotmplData, removed by
+// the returned function once the chart is templated. The other value files
+// are left alone.
+func renderGotmplValues(helmInfo *v1alpha1.Application, opts Options) (*v1alpha1.Application, func(), error) {
+	rendered := helmInfo.DeepCopy()
+	source := rendered.Spec.Source
+
+	var copies []string
+	cleanup := func() {
+		for _, file := range copies {
+			os.Remove(file)
+		}
+	}
+	for i, valueFile := range source.Helm.ValueFiles {
+		if ignoredValueFile(valueFile, opts.IgnoreValueFiles) || !gotmplValueFile(valueFile, opts) {
+			continue
+		}
+		b, err := renderGotmpl(ValueFilePath(helmInfo.Spec.Source, valueFile), opts.GotmplData)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		file, err := createTempFile(string(b))
+		if file != "" {
+			copies = append(copies, file)
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		// Absolute, since helm runs in the chart directory.
+		if source.Helm.ValueFiles[i], err = filepath.Abs(file); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	return rendered, cleanup, nil
+}
@@ -0,0 +1,114 @@
+package helm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestRenderGotmplValues(t *testing.T) {
+	t.Setenv("MANI_DIFFY_TEST_REGION", "us-east-1")
+	chart := t.TempDir()
+	files := map[string]string{
+		"values.yaml.gotmpl":  "replicas: {{ .replicas }}\nregion: {{ env \"MANI_DIFFY_TEST_REGION\" }}\n",
+		"overrides.yaml":      "replicas: {{ .replicas }}\n",
+		"data.yaml":           "replicas: 3\n",
+		"missing.yaml.gotmpl": "replicas: {{ .missing }}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(chart, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := LoadGotmplData(filepath.Join(chart, "data.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: chart,
+				Helm: &v1alpha1.ApplicationSourceHelm{
+					ValueFiles: []string{"values.yaml.gotmpl", "overrides.yaml"},
+				},
+			},
+		},
+	}
+	opts := Options{GotmplValues: true, GotmplData: data}
+
+	rendered, cleanup, err := renderGotmplValues(app, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Spec.Source.Helm.ValueFiles[0] != "values.yaml.gotmpl" {
+		t.Errorf("expected the application to be left alone got: %v", app.Spec.Source.Helm.ValueFiles)
+	}
+	if rendered.Spec.Source.Helm.ValueFiles[1] != "overrides.yaml" {
+		t.Errorf("expected the other value files to be left alone got: %v", rendered.Spec.Source.Helm.ValueFiles)
+	}
+
+	valueFile := rendered.Spec.Source.Helm.ValueFiles[0]
+	b, err := os.ReadFile(valueFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "replicas: 3\nregion: us-east-1\n"; string(b) != expected {
+		t.Errorf("expected the value file to be rendered to %q got: %q", expected, b)
+	}
+
+	cleanup()
+	if _, err := os.Stat(valueFile); !os.IsNotExist(err) {
+		t.Errorf("expected the rendered copy to be removed got: %v", err)
+	}
+
+	app.Spec.Source.Helm.ValueFiles = []string{"missing.yaml.gotmpl"}
+	if _, _, err := renderGotmplValues(app, opts); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("expected a key missing from the data to fail got: %v", err)
+	}
+}
+
+func TestGenerateHashGotmplValues(t *testing.T) {
+	chart := t.TempDir()
+	for name, content := range map[string]string{
+		"values.yaml.gotmpl": "replicas: {{ .replicas }}\n",
+		"overrides.yaml":     "replicas: 1\n",
+	} {
+		if err := os.WriteFile(filepath.Join(chart, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func(valueFile string, opts Options) string {
+		t.Helper()
+		h, err := GenerateHash(context.Background(), &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{
+				Source: &v1alpha1.ApplicationSource{
+					Path: chart,
+					Helm: &v1alpha1.ApplicationSourceHelm{
+						ValueFiles: []string{valueFile},
+					},
+				},
+			},
+		}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	// A no-op without gotmpl value files.
+	if hash("overrides.yaml", Options{}) != hash("overrides.yaml", Options{GotmplValues: true}) {
+		t.Error("expected -gotmpl-values to keep the hash of sources without gotmpl value files")
+	}
+
+	three := hash("values.yaml.gotmpl", Options{GotmplValues: true, GotmplData: map[string]interface{}{"replicas": 3}})
+	if three == hash("values.yaml.gotmpl", Options{GotmplValues: true, GotmplData: map[string]interface{}{"replicas": 5}}) {
+		t.Error("expected changing the data to change the hash")
+	}
+	if three != hash("values.yaml.gotmpl", Options{GotmplValues: true, GotmplData: map[string]interface{}{"replicas": 3}}) {
+		t.Error("expected the same data to keep the hash")
+	}
+}
@@ -1,24 +1,30 @@
 package helm
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
 	"github.com/chime/mani-diffy/pkg/kustomize"
+	"github.com/zeebo/blake3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
 )
 
@@ -31,6 +37,25 @@ func VerifyRenderDir(autoGenerationPath string) error {
 	return nil
 }
 
+// CheckHelmAvailable verifies that the helm binary is on the PATH and returns
+// its version, so a missing helm is reported once instead of failing every
+// application.
+func CheckHelmAvailable(ctx context.Context) (string, error) {
+	path, err := exec.LookPath("helm")
+	if err != nil {
+		return "", fmt.Errorf("helm was not found on the PATH, install it from https://helm.sh/docs/intro/install/: %w", err)
+	}
+
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, path, "version", "--short")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error running %s version: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 func CreateDir(dirName string) error {
 	err := os.MkdirAll(dirName, os.ModePerm)
 	if err != nil {
@@ -39,27 +64,71 @@ func CreateDir(dirName string) error {
 	return nil
 }
 
-func buildParams(payload *v1alpha1.Application, ignoreValueFile string) (string, string) {
+func buildParams(payload *v1alpha1.Application, ignoreValueFiles []string) (string, string, string, string, string) {
 	helmParameters := payload.Spec.Source.Helm.Parameters
 	helmFiles := payload.Spec.Source.Helm.ValueFiles
+	helmFileParameters := payload.Spec.Source.Helm.FileParameters
 	setValues := ""
+	setStringValues := ""
 	fileValues := ""
+	setFileValues := ""
+	setJSONValues := ""
 
+	// Parameters forced to strings are passed with --set-string, like Argo
+	// does, so values like numeric looking version tags aren't coerced.
+	// JSON objects and arrays are passed with --set-json, since --set would
+	// split them on their commas.
 	for i := 0; i < len(helmParameters); i++ {
-		setValues += fmt.Sprintf("%s=%s", helmParameters[i].Name, helmParameters[i].Value)
-		if i != len(helmParameters)-1 {
-			setValues += ","
+		parameter := fmt.Sprintf("%s=%s,", helmParameters[i].Name, helmParameters[i].Value)
+		switch {
+		case helmParameters[i].ForceString:
+			setStringValues += parameter
+		case isJSONParameter(helmParameters[i]):
+			setJSONValues += parameter
+		default:
+			setValues += parameter
 		}
-
 	}
+	setValues = strings.TrimRight(setValues, ",")
+	setStringValues = strings.TrimRight(setStringValues, ",")
+	setJSONValues = strings.TrimRight(setJSONValues, ",")
+
 	for i := 0; i < len(helmFiles); i++ {
-		if ignoreValueFile == "" || !strings.Contains(helmFiles[i], ignoreValueFile) {
+		if !ignoredValueFile(helmFiles[i], ignoreValueFiles) {
 			fileValues += fmt.Sprintf("%s,", helmFiles[i])
 		}
 	}
 	fileValues = strings.TrimRight(fileValues, ",")
 
-	return setValues, fileValues
+	for i := 0; i < len(helmFileParameters); i++ {
+		setFileValues += fmt.Sprintf("%s=%s", helmFileParameters[i].Name, helmFileParameters[i].Path)
+		if i != len(helmFileParameters)-1 {
+			setFileValues += ","
+		}
+	}
+
+	return setValues, setStringValues, fileValues, setFileValues, setJSONValues
+}
+
+// isJSONParameter reports whether the value of parameter is a JSON object or
+// array. Parameters forced to strings never are.
+func isJSONParameter(parameter v1alpha1.HelmParameter) bool {
+	if parameter.ForceString {
+		return false
+	}
+	value := strings.TrimSpace(parameter.Value)
+	return (strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[")) && json.Valid([]byte(value))
+}
+
+// ignoredValueFile reports whether the value file name contains any of the
+// non-empty patterns.
+func ignoredValueFile(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern != "" && strings.Contains(name, pattern) {
+			return true
+		}
+	}
+	return false
 }
 
 func createTempFile(payload string) (string, error) {
@@ -84,56 +153,398 @@ func IsMissingDependencyErr(err error) bool {
 		strings.Contains(err.Error(), "found in Chart.yaml, but missing in charts/ directory")
 }
 
-func installDependencies(chartDirectory string) error {
-	log.Println("Updating dependencies for " + chartDirectory)
-	cmd := exec.Command(
+// Options configures how charts are templated.
+type Options struct {
+	// SkipRenderKey is set to CONSCIOUSLY_NOT_RENDERED for every chart.
+	SkipRenderKey string
+	// IgnoreValueFiles excludes value files whose name contains any of them.
+	IgnoreValueFiles []string
+	// DependencyUpdateRetries is how many times a failed `helm dependency
+	// update` is retried before giving up.
+	DependencyUpdateRetries int
+	// KubeVersion is the Kubernetes version charts see in
+	// .Capabilities.KubeVersion.
+	KubeVersion string
+	// APIVersions are added to the API versions charts see in
+	// .Capabilities.APIVersions.
+	APIVersions []string
+	// Validate checks that the rendered manifest only holds Kubernetes
+	// objects before it is written.
+	Validate bool
+	// ValidateValuesSchema checks the values of every chart shipping a
+	// values.schema.json against it before helm is called.
+	ValidateValuesSchema bool
+	// SplitManifests writes every resource to its own file instead of a
+	// single manifest.yaml.
+	SplitManifests bool
+	// SkipDependencyUpdate never runs `helm dependency update`, e.g. when
+	// the dependencies are vendored in charts/.
+	SkipDependencyUpdate bool
+	// DependencyStrategy is how missing dependencies are fetched,
+	// DependencyStrategyUpdate when empty.
+	DependencyStrategy string
+	// DependencyCacheDir, when set, is where dependencies are cached so they
+	// are only fetched once for all the charts depending on them.
+	DependencyCacheDir string
+	// FailOnEmpty treats a chart rendering nothing as an error instead of
+	// writing an empty manifest.
+	FailOnEmpty bool
+	// HashAlgorithm is the checksum used for the hashes, HashSHA256 when
+	// empty.
+	HashAlgorithm string
+	// DefaultNamespace is the namespace charts are rendered in when the
+	// Application has no destination namespace.
+	DefaultNamespace string
+	// NamespaceOverrides are the namespaces charts are rendered in instead
+	// of the destination namespace, keyed by the name of the Application.
+	NamespaceOverrides map[string]string
+	// IncludeCRDs renders the CRDs charts ship, like Argo does.
+	IncludeCRDs bool
+	// Compress writes manifests compressed with gzip at CompressionLevel,
+	// e.g. manifest.yaml.gz instead of manifest.yaml.
+	Compress         bool
+	CompressionLevel int
+	// PostRenderer is the binary helm pipes the rendered manifest through
+	// with its own --post-renderer.
+	PostRenderer string
+	// OutputFormat is the format manifests are written in, FormatYAML when
+	// empty. FormatJSON writes manifest.json.
+	OutputFormat string
+	// ManifestFilename is the name of the file manifests are written to,
+	// DefaultManifestFilename when empty. See ManifestName.
+	ManifestFilename string
+	// ConfinePaths fails the sources whose chart, value files or file
+	// parameters resolve outside of the working directory, e.g. with
+	// `../../../etc/passwd`, before helm reads them.
+	ConfinePaths bool
+	// ValuesPrecedence is what wins when the value files and the inline
+	// values set the same key, ValuesPrecedenceInline when empty.
+	ValuesPrecedence string
+	// Fingerprints, when set, skips hashing the content of the directories
+	// and files whose sizes and modification times didn't change.
+	Fingerprints *FingerprintCache
+	// ExpandEnv expands the `${VAR}` placeholders of the inline values and
+	// the value files with the environment before helm reads them, like a
+	// config management plugin running envsubst would. The expanded values
+	// are hashed, so changing the environment renders the chart again.
+	ExpandEnv bool
+	// GotmplValues renders the value files ending in .gotmpl as Go
+	// templates with GotmplData before helm reads them, like helmfile does.
+	// The rendered values are hashed, so changing the data renders the
+	// chart again.
+	GotmplValues bool
+	GotmplData   map[string]interface{}
+	// IncludeHidden hashes every file of a chart, including the ones its
+	// .helmignore lists, which helm leaves out.
+	IncludeHidden bool
+	// ProvenanceHeader starts the YAML manifests written with a comment
+	// recording Version, the mani-diffy version, the chart of every Helm
+	// source, the hash of the application and, unless NoTimestamp is set,
+	// the time of the render. JSON manifests have no comments.
+	ProvenanceHeader bool
+	Version          string
+	NoTimestamp      bool
+	// MaxManifestSize, when set, is the size in bytes over which the
+	// manifest of an application fails to render instead of being written,
+	// e.g. because a chart inlines a huge ConfigMap by mistake.
+	MaxManifestSize int64
+	// ExcludeKinds are the kinds of the resources left out of the written
+	// manifest, e.g. Secrets with values that change on every render.
+	ExcludeKinds []string
+	// Normalize and NormalizeDrop are only hashed, so switching them
+	// renders the applications again. The manifests are normalized once
+	// written, without the labels and annotations NormalizeDrop names.
+	Normalize     bool
+	NormalizeDrop []string
+}
+
+const (
+	HashSHA256 = "sha256"
+	HashBLAKE3 = "blake3"
+)
+
+// HashFunc returns the constructor for the hash named algorithm. An empty
+// name is sha256, the algorithm mani-diffy always used.
+func HashFunc(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case "", HashSHA256:
+		return sha256.New, nil
+	case HashBLAKE3:
+		return func() hash.Hash { return blake3.New() }, nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q, must be %s or %s", algorithm, HashSHA256, HashBLAKE3)
+	}
+}
+
+const (
+	ValuesPrecedenceInline = "inline"
+	ValuesPrecedenceFiles  = "files"
+)
+
+// CheckValuesPrecedence returns an error unless precedence is one of the
+// values precedences.
+func CheckValuesPrecedence(precedence string) error {
+	switch precedence {
+	case "", ValuesPrecedenceInline, ValuesPrecedenceFiles:
+		return nil
+	default:
+		return fmt.Errorf("unsupported values precedence %q, must be %s or %s", precedence, ValuesPrecedenceInline, ValuesPrecedenceFiles)
+	}
+}
+
+const (
+	// DependencyStrategyUpdate fetches the dependencies of charts with
+	// `helm dependency update`, which resolves their version constraints
+	// again and may bump them.
+	DependencyStrategyUpdate = "update"
+	// DependencyStrategyBuild fetches the dependencies of charts with a lock
+	// with `helm dependency build`, which uses the versions it pins. Charts
+	// without one still use `helm dependency update`.
+	DependencyStrategyBuild = "build"
+)
+
+// CheckDependencyStrategy returns an error unless strategy is one of the
+// dependency strategies.
+func CheckDependencyStrategy(strategy string) error {
+	switch strategy {
+	case "", DependencyStrategyUpdate, DependencyStrategyBuild:
+		return nil
+	default:
+		return fmt.Errorf("unsupported dependency strategy %q, must be %s or %s", strategy, DependencyStrategyBuild, DependencyStrategyUpdate)
+	}
+}
+
+// dependencyUpdateBackoff is how long to wait before retrying a failed
+// dependency update. It doubles after every attempt.
+var dependencyUpdateBackoff = time.Second
+
+// dependencyCommand is the `helm dependency` command fetching the
+// dependencies of the chart in chartDirectory with strategy: build, which
+// fetches the versions its lock pins, when strategy is
+// DependencyStrategyBuild and the chart has a lock, and update otherwise.
+func dependencyCommand(chartDirectory, strategy string) string {
+	if strategy != DependencyStrategyBuild {
+		return DependencyStrategyUpdate
+	}
+	for _, lock := range []string{"Chart.lock", "requirements.lock"} {
+		if _, err := os.Stat(filepath.Join(chartDirectory, lock)); err == nil {
+			return DependencyStrategyBuild
+		}
+	}
+	return DependencyStrategyUpdate
+}
+
+func installDependencies(ctx context.Context, chartDirectory, strategy string) error {
+	command := dependencyCommand(chartDirectory, strategy)
+	slog.Info("Updating dependencies", "chart", chartDirectory, "command", command)
+	cmd := exec.CommandContext(
+		ctx,
 		"helm",
 		"dependency",
-		"update",
+		command,
 	)
 	cmd.Dir = chartDirectory
+
+	var errb bytes.Buffer
+	cmd.Stderr = &errb
+
 	err := cmd.Run()
 	if err != nil {
-		return fmt.Errorf("error updating dependencies for %s: %w", chartDirectory, err)
+		return fmt.Errorf("error running helm dependency %s for %s: %w: %s", command, chartDirectory, err, strings.TrimSpace(errb.String()))
 	}
 
 	return nil
 
 }
 
-func template(helmInfo *v1alpha1.Application, skipRenderKey string, ignoreValueFile string) ([]byte, error) {
+// updateDependencies runs installDependencies, retrying with exponential
+// backoff since dependency updates fail on flaky networks.
+func updateDependencies(ctx context.Context, chartDirectory, strategy string, retries int) error {
+	backoff := dependencyUpdateBackoff
+	err := installDependencies(ctx, chartDirectory, strategy)
+	for attempt := 1; err != nil && attempt <= retries; attempt++ {
+		slog.Warn("Dependency update failed, retrying", "chart", chartDirectory, "error", err, "backoff", backoff, "attempt", attempt, "retries", retries)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = installDependencies(ctx, chartDirectory, strategy)
+	}
+	return err
+}
+
+// template renders the chart of helmInfo. A chart at Spec.Source.Path is
+// rendered from the local working tree: the repository at Spec.Source.RepoURL
+// isn't fetched and Spec.Source.TargetRevision isn't checked out, it only
+// contributes to the hash so that changing it invalidates the cache. A remote
+// chart, Spec.Source.Chart without a path, is pulled from Spec.Source.RepoURL
+// first, with Spec.Source.TargetRevision as its version.
+//
+// When the chart is missing dependencies they are updated, unless dependency
+// updates are disabled, and the chart is templated once more. A chart that is
+// still broken after that is an error.
+func template(ctx context.Context, helmInfo *v1alpha1.Application, opts Options) ([]byte, error) {
+	if remoteChart(helmInfo.Spec.Source) {
+		pulled, cleanup, err := pullChart(ctx, helmInfo)
+		if err != nil {
+			return []byte{}, fmt.Errorf("error templating manifest for %s: %w", helmInfo.ObjectMeta.Name, err)
+		}
+		defer cleanup()
+		helmInfo = pulled
+	}
+
+	switch version := helmInfo.Spec.Source.Helm.Version; version {
+	case "", "3", "v3":
+	case "2", "v2":
+		// Charts are always templated with helm 3, which renders helm 2
+		// charts differently than Argo would.
+		return []byte{}, fmt.Errorf(
+			"error templating manifest for %s: helm %s is not supported, only helm 3 charts can be rendered",
+			helmInfo.ObjectMeta.Name,
+			version,
+		)
+	default:
+		return []byte{}, fmt.Errorf("error templating manifest for %s: unknown helm version %q", helmInfo.ObjectMeta.Name, version)
+	}
 
+	if opts.GotmplValues {
+		rendered, cleanup, err := renderGotmplValues(helmInfo, opts)
+		if err != nil {
+			return []byte{}, fmt.Errorf("error templating manifest for %s: %w", helmInfo.ObjectMeta.Name, err)
+		}
+		defer cleanup()
+		helmInfo = rendered
+	}
+
+	if opts.ExpandEnv {
+		expanded, cleanup, err := expandValues(helmInfo, opts)
+		if err != nil {
+			return []byte{}, fmt.Errorf("error templating manifest for %s: %w", helmInfo.ObjectMeta.Name, err)
+		}
+		defer cleanup()
+		helmInfo = expanded
+	}
+
+	if opts.ValidateValuesSchema {
+		if err := validateValuesSchema(helmInfo, opts); err != nil {
+			return []byte{}, fmt.Errorf("invalid values for %s: %w", helmInfo.ObjectMeta.Name, err)
+		}
+	}
+
+	out, stderr, err := helmTemplate(ctx, helmInfo, opts)
+	if err != nil && !opts.SkipDependencyUpdate && IsMissingDependencyErr(errors.New(stderr)) {
+		if err := resolveDependencies(ctx, helmInfo.Spec.Source.Path, opts); err != nil {
+			return []byte{}, fmt.Errorf("error templating manifest for %s: %w", helmInfo.ObjectMeta.Name, err)
+		}
+		out, stderr, err = helmTemplate(ctx, helmInfo, opts)
+	}
+	if err != nil {
+		return []byte{}, fmt.Errorf(
+			"error templating manifest for %s: %w: %s",
+			helmInfo.ObjectMeta.Name,
+			err,
+			strings.TrimSpace(stderr),
+		)
+	}
+	addWarnings(ctx, stderr)
+
+	return out, nil
+}
+
+// releaseName is the release name Argo renders the chart of app with: the
+// release name of its Helm source, or the name of the application.
+func releaseName(app *v1alpha1.Application) string {
+	if source := app.Spec.Source; source != nil && source.Helm != nil && source.Helm.ReleaseName != "" {
+		return source.Helm.ReleaseName
+	}
+	return app.ObjectMeta.Name
+}
+
+// helmTemplate runs `helm template` once, returning its stdout and stderr.
+func helmTemplate(ctx context.Context, helmInfo *v1alpha1.Application, opts Options) ([]byte, string, error) {
 	chartPath := strings.Split(helmInfo.Spec.Source.Path, "/")
 	chart := fmt.Sprint("../" + chartPath[len(chartPath)-1])
 
-	setValues, fileValues := buildParams(helmInfo, ignoreValueFile)
+	setValues, setStringValues, fileValues, setFileValues, setJSONValues := buildParams(helmInfo, opts.IgnoreValueFiles)
 
 	tmpFile := ""
 	if helmInfo.Spec.Source.Helm.Values != "" {
 		dataFile, err := createTempFile(helmInfo.Spec.Source.Helm.Values)
 		defer os.Remove(dataFile)
 		if err != nil {
-			log.Println(err)
+			slog.Error("Unable to write values", "app", helmInfo.ObjectMeta.Name, "error", err)
 		}
 		tmpFile = dataFile
 	}
 
-	cmd := exec.Command(
+	// The last -f wins.
+	valueFiles := []string{"-f", fileValues, "-f", tmpFile}
+	if opts.ValuesPrecedence == ValuesPrecedenceFiles {
+		valueFiles = []string{"-f", tmpFile, "-f", fileValues}
+	}
+	cmd := exec.CommandContext(
+		ctx,
 		"helm",
-		"template",
-		chart,
-		"--set",
-		setValues,
-		"-f",
-		fileValues,
-		"-f",
-		tmpFile,
-		"-n",
-		helmInfo.Spec.Destination.Namespace,
+		append([]string{
+			"template",
+			releaseName(helmInfo),
+			chart,
+			"--set",
+			setValues,
+		}, valueFiles...)...,
 	)
 
-	if skipRenderKey != "" {
-		cmd.Args = append(cmd.Args, "--set", fmt.Sprintf("%s=%s", skipRenderKey, "CONSCIOUSLY_NOT_RENDERED"))
+	namespace := helmInfo.Spec.Destination.Namespace
+	if override, ok := opts.NamespaceOverrides[helmInfo.ObjectMeta.Name]; ok {
+		namespace = override
+	}
+	if namespace == "" {
+		namespace = opts.DefaultNamespace
+	}
+	if namespace != "" {
+		cmd.Args = append(cmd.Args, "-n", namespace)
+	}
+
+	if opts.IncludeCRDs {
+		cmd.Args = append(cmd.Args, "--include-crds")
+	}
+
+	// Argo skips the CRDs of these apps, even when the others include them.
+	if helmInfo.Spec.Source.Helm.SkipCrds {
+		cmd.Args = append(cmd.Args, "--skip-crds")
+	}
+
+	if helmInfo.Spec.Source.Helm.PassCredentials {
+		cmd.Args = append(cmd.Args, "--pass-credentials")
+	}
+
+	if opts.PostRenderer != "" {
+		cmd.Args = append(cmd.Args, "--post-renderer", opts.PostRenderer)
+	}
+
+	if setStringValues != "" {
+		cmd.Args = append(cmd.Args, "--set-string", setStringValues)
+	}
+
+	if setFileValues != "" {
+		cmd.Args = append(cmd.Args, "--set-file", setFileValues)
+	}
+
+	if setJSONValues != "" {
+		cmd.Args = append(cmd.Args, "--set-json", setJSONValues)
+	}
+
+	if opts.SkipRenderKey != "" {
+		cmd.Args = append(cmd.Args, "--set", fmt.Sprintf("%s=%s", opts.SkipRenderKey, "CONSCIOUSLY_NOT_RENDERED"))
+	}
+
+	if opts.KubeVersion != "" {
+		cmd.Args = append(cmd.Args, "--kube-version", opts.KubeVersion)
+	}
+	for _, apiVersion := range opts.APIVersions {
+		cmd.Args = append(cmd.Args, "--api-versions", apiVersion)
 	}
 
 	cmd.Dir = helmInfo.Spec.Source.Path
@@ -142,42 +553,135 @@ func template(helmInfo *v1alpha1.Application, skipRenderKey string, ignoreValueF
 	cmd.Stdout = &outb
 	cmd.Stderr = &errb
 
-	if err := cmd.Run(); err != nil {
-		if IsMissingDependencyErr(errors.New(errb.String())) {
-			if err := installDependencies(helmInfo.Spec.Source.Path); err != nil {
-				return template(helmInfo, skipRenderKey, ignoreValueFile)
-			}
-		} else {
-			return []byte{}, fmt.Errorf("error templating manifest: %w %v", err, errb.String())
+	err := cmd.Run()
+	return outb.Bytes(), errb.String(), err
+}
+
+// writeToFile writes manifest to location, see Options.SplitManifests.
+// Every YAML file written starts with header, when it isn't empty.
+func writeToFile(manifest []byte, header, location string, opts Options) error {
+	if err := CreateDir(location); err != nil {
+		return err
+	}
+
+	if opts.SplitManifests {
+		return writeSplit(manifest, header, location, opts)
+	}
+
+	if opts.OutputFormat == FormatJSON {
+		var err error
+		if manifest, err = toJSON(manifest); err != nil {
+			return err
 		}
+	} else if header != "" {
+		manifest = append([]byte(header), manifest...)
 	}
+	return writeManifest(filepath.Join(location, ManifestName(opts.ManifestFilename, opts.OutputFormat, false)), manifest, opts)
+}
+
+// writeSplit writes every document in manifest to its own file in location,
+// named after the kind and name of the resource like `helm template
+// --output-dir` does.
+func writeSplit(manifest []byte, header, location string, opts Options) error {
+	reader := yamlutil.NewYAMLReader(bufio.NewReader(bytes.NewReader(manifest)))
+	written := make(map[string]bool)
+	for {
+		doc, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var resource struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}
+		if err := yamlutil.Unmarshal(doc, &resource); err != nil {
+			return fmt.Errorf("error splitting manifest: %w", err)
+		}
+		if resource.Kind == "" {
+			// Nothing was rendered, e.g. a template gated by a condition.
+			continue
+		}
 
-	return outb.Bytes(), nil
+		base := strings.ToLower(resource.Kind) + "-" + resource.Metadata.Name
+		ext := formatExt(opts.OutputFormat)
+		name := base + ext
+		for i := 2; written[name]; i++ {
+			// The same kind and name can appear in different namespaces.
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		written[name] = true
+
+		if opts.OutputFormat == FormatJSON {
+			converted, err := yamlutil.ToJSON(doc)
+			if err != nil {
+				return fmt.Errorf("error converting %s to JSON: %w", name, err)
+			}
+			var indented bytes.Buffer
+			if err := json.Indent(&indented, converted, "", "  "); err != nil {
+				return fmt.Errorf("error converting %s to JSON: %w", name, err)
+			}
+			doc = append(indented.Bytes(), '\n')
+		} else if header != "" {
+			doc = append([]byte(header), doc...)
+		}
+
+		if err := writeManifest(filepath.Join(location, name), doc, opts); err != nil {
+			return err
+		}
+	}
 }
 
-func writeToFile(manifest []byte, location string) error {
-	if err := CreateDir(location); err != nil {
-		return err
+// EmptyManifestDir is EmptyManifest for manifests split into one file per
+// resource. The manifest in dir is empty when none of its YAML or JSON files
+// hold anything. Subdirectories, which hold the output of other applications, are
+// left out.
+func EmptyManifestDir(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Not rendered yet
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking if %s is empty: %w", dir, err)
 	}
 
-	return os.WriteFile(
-		fmt.Sprintf(
-			"%s/%s",
-			location,
-			"manifest.yaml",
-		),
-		manifest,
-		0664,
-	)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), compressedExt)
+		if ext := filepath.Ext(name); entry.IsDir() || (ext != ".yaml" && ext != ".json") {
+			continue
+		}
+		empty, err := EmptyManifest(filepath.Join(dir, entry.Name()))
+		if err != nil || !empty {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
+// statManifest is os.Stat, replaced in tests to simulate the errors of other
+// platforms.
+var statManifest = os.Stat
+
+// EmptyManifest reports whether the manifest file is empty. A missing manifest
+// is not empty, since the output of applications that only hold other
+// applications has none.
 func EmptyManifest(manifest string) (bool, error) {
-	fileInfo, err := os.Stat(manifest)
+	if strings.HasSuffix(manifest, compressedExt) {
+		return emptyCompressedManifest(manifest)
+	}
+
+	fileInfo, err := statManifest(manifest)
+	if errors.Is(err, fs.ErrNotExist) {
+		// the root dirs don't have manifest.yaml files
+		return false, nil
+	}
 	if err != nil {
-		if strings.Contains(err.Error(), "manifest.yaml: no such file or directory") {
-			// the root dirs don't have manifest.yaml files
-			return false, nil
-		}
 		return false, fmt.Errorf("error checking if %s is empty: %w", manifest, err)
 	}
 
@@ -189,37 +693,190 @@ func EmptyManifest(manifest string) (bool, error) {
 
 }
 
-func GenerateHash(crd *v1alpha1.Application, ignoreValueFile string) (string, error) {
-	finalHash := sha256.New()
+func GenerateHash(ctx context.Context, crd *v1alpha1.Application, opts Options) (string, error) {
+	newHash, err := HashFunc(opts.HashAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	finalHash := newHash()
 
-	crdHash, err := generateHashOnCrd(crd)
+	crdHash, err := generateHashOnCrd(crd, newHash)
 	if err != nil {
 		return "", err
 	}
 	fmt.Fprintf(finalHash, "%x\n", crdHash)
 
-	if crd.Spec.Source.Kustomize != nil {
-		return "", kustomize.ErrNotSupported
+	// The capabilities change what charts render. They are only hashed when
+	// set, so hashes from before they existed stay valid.
+	if opts.KubeVersion != "" || len(opts.APIVersions) > 0 {
+		fmt.Fprintf(finalHash, "kubeVersion=%s apiVersions=%q\n", opts.KubeVersion, opts.APIVersions)
 	}
-
-	if crd.Spec.Source.Path != "" {
-		chartHash, err := generalHashFunction(crd.Spec.Source.Path)
+	// Same for the options changing what helm template is called with.
+	if opts.DefaultNamespace != "" || opts.IncludeCRDs {
+		fmt.Fprintf(finalHash, "defaultNamespace=%s includeCRDs=%t\n", opts.DefaultNamespace, opts.IncludeCRDs)
+	}
+	if namespace, ok := opts.NamespaceOverrides[crd.ObjectMeta.Name]; ok {
+		fmt.Fprintf(finalHash, "namespaceOverride=%s\n", namespace)
+	}
+	// And for the compression, so switching it renders the manifests again.
+	if opts.Compress {
+		fmt.Fprintf(finalHash, "compressionLevel=%d\n", opts.CompressionLevel)
+	}
+	if len(opts.ExcludeKinds) > 0 {
+		fmt.Fprintf(finalHash, "excludeKinds=%q\n", opts.ExcludeKinds)
+	}
+	if opts.OutputFormat != "" && opts.OutputFormat != FormatYAML {
+		fmt.Fprintf(finalHash, "outputFormat=%s\n", opts.OutputFormat)
+	}
+	if opts.ValuesPrecedence != "" && opts.ValuesPrecedence != ValuesPrecedenceInline {
+		fmt.Fprintf(finalHash, "valuesPrecedence=%s\n", opts.ValuesPrecedence)
+	}
+	if opts.ManifestFilename != "" && opts.ManifestFilename != DefaultManifestFilename {
+		fmt.Fprintf(finalHash, "manifestFilename=%s\n", opts.ManifestFilename)
+	}
+	if opts.SplitManifests {
+		fmt.Fprintf(finalHash, "splitManifests=%t\n", opts.SplitManifests)
+	}
+	if opts.Normalize {
+		fmt.Fprintf(finalHash, "normalize=%t normalizeDrop=%q\n", opts.Normalize, opts.NormalizeDrop)
+	}
+	if opts.ProvenanceHeader {
+		// The version isn't hashed, so upgrading doesn't render every
+		// application again.
+		fmt.Fprintf(finalHash, "provenanceHeader=%t noTimestamp=%t\n", opts.ProvenanceHeader, opts.NoTimestamp)
+	}
+	if opts.PostRenderer != "" {
+		// The post renderer changes what every chart renders, so a change
+		// to it invalidates the cache too.
+		path, err := exec.LookPath(opts.PostRenderer)
+		if err != nil {
+			return "", fmt.Errorf("error finding the helm post renderer: %w", err)
+		}
+		postRendererHash, err := opts.Fingerprints.hash(path, nil, opts.HashAlgorithm, newHash)
 		if err != nil {
 			return "", err
 		}
+		fmt.Fprintf(finalHash, "postRenderer=%s %x\n", opts.PostRenderer, postRendererHash)
+	}
+
+	sources, err := Sources(crd)
+	if err != nil {
+		return "", err
+	}
+	for _, source := range sources {
+		if IsHelm(source.Spec.Source) {
+			fmt.Fprintf(finalHash, "releaseName=%s\n", releaseName(source))
+		}
+		if err := hashSource(ctx, finalHash, newHash, source.Spec.Source, opts); err != nil {
+			return "", err
+		}
+	}
+
+	sum := hex.EncodeToString(finalHash.Sum(nil))
+	if opts.HashAlgorithm != "" && opts.HashAlgorithm != HashSHA256 {
+		// Prefixed so a hash never matches one stored by another algorithm,
+		// while the sha256 hashes stored before this option existed stay
+		// valid.
+		sum = opts.HashAlgorithm + ":" + sum
+	}
+	return sum, nil
+}
+
+// ValueFilePath returns the path of the value file of source, as helm reads
+// it: relative to the chart. Like Argo, the value files of remote charts are
+// read from the pulled chart, so their path is empty, except for the
+// `$<ref>/` ones, which are read from the working directory.
+func ValueFilePath(source *v1alpha1.ApplicationSource, valueFile string) string {
+	if filepath.IsAbs(valueFile) {
+		return filepath.Clean(valueFile)
+	}
+	if remoteChart(source) {
+		if path, ok := refPath(valueFile); ok {
+			return filepath.Clean(path)
+		}
+		return ""
+	}
+	return filepath.Join(source.Path, valueFile)
+}
+
+// hashSource writes the hash of everything a single source renders from to
+// finalHash. Every file under the source path is part of the hash, so the
+// chart's own values.yaml and any file it reads, whether or not the
+// Application lists it, invalidate the cache when they change.
+func hashSource(ctx context.Context, finalHash io.Writer, newHash func() hash.Hash, source *v1alpha1.ApplicationSource, opts Options) error {
+	if source.Kustomize != nil {
+		return kustomize.ErrNotSupported
+	}
+
+	// Where the source comes from is part of crd.String() as well, but hash
+	// it explicitly so a change to it always invalidates the cache.
+	fmt.Fprintf(finalHash, "repoURL=%s chart=%s targetRevision=%s\n", source.RepoURL, source.Chart, source.TargetRevision)
+
+	// A target revision that isn't an exact version follows the releases
+	// of the chart, so the version it resolves to is hashed too. Exact
+	// versions are already hashed above and keep their hashes.
+	if remoteChart(source) && !exactVersion.MatchString(source.TargetRevision) {
+		version, err := remoteChartVersion(ctx, source)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(finalHash, "chartVersion=%s\n", version)
+	}
+
+	if source.Path != "" {
+		// Files the chart's .helmignore lists aren't rendered, so they
+		// don't change the hash. Every file of other sources is copied,
+		// so they all do.
+		var rules *ignoreRules
+		if IsHelm(source) {
+			var err error
+			if rules, err = chartIgnoreRules(source.Path, opts.IncludeHidden); err != nil {
+				return err
+			}
+		}
+		chartHash, err := opts.Fingerprints.hash(source.Path, rules, opts.HashAlgorithm, newHash)
+		if err != nil {
+			return err
+		}
 		fmt.Fprintf(finalHash, "%x\n", chartHash)
 	}
 
-	if crd.Spec.Source.Helm != nil && len(crd.Spec.Source.Helm.ValueFiles) > 0 {
-		oHash := sha256.New()
-		overrideFiles := crd.Spec.Source.Helm.ValueFiles
-		matchDots := regexp.MustCompile(`\.\.\/`)
+	if dir := source.Directory; dir != nil {
+		fmt.Fprintf(finalHash, "recurse=%t include=%q exclude=%q\n", dir.Recurse, dir.Include, dir.Exclude)
+	}
+
+	if source.Helm != nil && len(source.Helm.ValueFiles) > 0 {
+		oHash := newHash()
+		overrideFiles := source.Helm.ValueFiles
 		for i := 0; i < len(overrideFiles); i++ {
-			if ignoreValueFile == "" || !strings.Contains(overrideFiles[i], ignoreValueFile) {
-				trimmedFilename := matchDots.ReplaceAllString(overrideFiles[i], "")
-				oHashReturned, err := generalHashFunction(trimmedFilename)
+			path := ValueFilePath(source, overrideFiles[i])
+			if path == "" {
+				// Shipped with the remote chart, whose version is
+				// hashed.
+				continue
+			}
+			if !ignoredValueFile(overrideFiles[i], opts.IgnoreValueFiles) {
+				valueFile, err := filepath.Abs(path)
 				if err != nil {
-					return "", err
+					return err
+				}
+				var oHashReturned []byte
+				if opts.ExpandEnv || gotmplValueFile(valueFile, opts) {
+					// What helm reads is the rendered or expanded
+					// file, which changes with the data and the
+					// environment too.
+					b, err := valueFileContent(valueFile, opts)
+					if err != nil {
+						return err
+					}
+					h := newHash()
+					_, _ = h.Write(b)
+					oHashReturned = h.Sum(nil)
+				} else {
+					oHashReturned, err = opts.Fingerprints.hash(valueFile, nil, opts.HashAlgorithm, newHash)
+					if err != nil {
+						return err
+					}
 				}
 				fmt.Fprintf(oHash, "%x\n", oHashReturned)
 			}
@@ -228,13 +885,57 @@ func GenerateHash(crd *v1alpha1.Application, ignoreValueFile string) (string, er
 		fmt.Fprintf(finalHash, "%x\n", overrideHash)
 	}
 
-	return hex.EncodeToString(finalHash.Sum(nil)), nil
+	if source.Helm != nil {
+		// Forcing a parameter to a string changes what it renders to. Only
+		// hashed when used, so hashes from before it was supported stay
+		// valid.
+		var forced, jsonValues []string
+		for _, parameter := range source.Helm.Parameters {
+			if parameter.ForceString {
+				forced = append(forced, parameter.Name)
+			}
+			if isJSONParameter(parameter) {
+				jsonValues = append(jsonValues, parameter.Name)
+			}
+		}
+		if len(forced) > 0 {
+			fmt.Fprintf(finalHash, "forceString=%q\n", forced)
+		}
+		// Same for the parameters passed with --set-json.
+		if len(jsonValues) > 0 {
+			fmt.Fprintf(finalHash, "setJSON=%q\n", jsonValues)
+		}
+		if source.Helm.SkipCrds {
+			fmt.Fprintf(finalHash, "skipCrds=%t\n", source.Helm.SkipCrds)
+		}
+		if opts.ExpandEnv {
+			fmt.Fprintf(finalHash, "expandedValues=%q\n", expandEnv(source.Helm.Values))
+		}
+
+		// File parameters are read relative to the chart, like helm does
+		// when templating.
+		for _, parameter := range source.Helm.FileParameters {
+			fileHash, err := opts.Fingerprints.hash(filepath.Join(source.Path, parameter.Path), nil, opts.HashAlgorithm, newHash)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(finalHash, "%x\n", fileHash)
+		}
+	}
+
+	return nil
 }
 
-func generalHashFunction(dirFilepath string) ([]byte, error) {
-	m, err := sha256Dir(dirFilepath)
+func generalHashFunction(dirFilepath string, newHash func() hash.Hash) ([]byte, error) {
+	return hashPath(dirFilepath, nil, newHash)
+}
+
+// hashPath hashes the file or directory at dirFilepath like
+// generalHashFunction, leaving out the files rules ignores.
+func hashPath(dirFilepath string, rules *ignoreRules, newHash func() hash.Hash) ([]byte, error) {
+	m, err := hashDir(dirFilepath, rules, contentSum(newHash))
 	if err != nil {
-		log.Println(err)
+		slog.Error("Unable to hash", "path", dirFilepath, "error", err)
 		return []byte{}, err
 	}
 	var paths []string
@@ -243,24 +944,21 @@ func generalHashFunction(dirFilepath string) ([]byte, error) {
 	}
 	// Not sure if needed but I'm sorting for deterministic behavior
 	sort.Strings(paths)
-	hash := sha256.New()
+	h := newHash()
 	for _, path := range paths {
 		// if a single file, just return the hash
 		if len(paths) == 1 {
-			value := m[path]
-			slice := value[:]
-			return slice, nil
+			return m[path], nil
 		}
-		fmt.Fprintf(hash, "%x  %s\n", m[path], path)
+		fmt.Fprintf(h, "%x  %s\n", m[path], path)
 	}
-	// log.Printf("FINAL HASH: %v\n", hex.EncodeToString(hash.Sum(nil)))
-	return hash.Sum(nil), nil
+	return h.Sum(nil), nil
 }
 
-// A result is the product of reading and summing a file using MD5.
+// A result is the product of reading and summing a file.
 type result struct {
 	path string
-	sum  [sha256.Size]byte
+	sum  []byte
 	err  error
 }
 
@@ -269,6 +967,13 @@ type nonRegularFile struct {
 	isDir    bool
 }
 
+// ResolveSymlink returns the file a symlink points to and whether that file
+// is a directory, resolving it the same way symlinks are resolved when hashing.
+func ResolveSymlink(filePath string) (string, bool, error) {
+	fileData, err := resolvesTo(filePath)
+	return fileData.fileName, fileData.isDir, err
+}
+
 func resolvesTo(filePath string) (nonRegularFile, error) {
 	fileData := nonRegularFile{}
 	info, err := os.Lstat(filePath)
@@ -287,7 +992,9 @@ func resolvesTo(filePath string) (nonRegularFile, error) {
 		if err != nil {
 			return fileData, fmt.Errorf("failed to follow symlink: %w", err)
 		}
-		fileName = strings.ReplaceAll(filePath, info.Name(), fileName)
+		if !filepath.IsAbs(fileName) {
+			fileName = filepath.Join(filepath.Dir(filePath), fileName)
+		}
 		fileData.fileName = fileName
 		fileInfo, err := os.Lstat(fileName)
 		if err != nil {
@@ -301,38 +1008,60 @@ func resolvesTo(filePath string) (nonRegularFile, error) {
 	return fileData, nil
 }
 
+// contentSum returns a function summing the content of a file with newHash.
+func contentSum(newHash func() hash.Hash) func(path string) ([]byte, error) {
+	return func(path string) ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		h := newHash()
+		_, _ = h.Write(data)
+		return h.Sum(nil), nil
+	}
+}
+
 // sumFiles starts goroutines to walk the directory tree at root and digest each
-// regular file.  These goroutines send the results of the digests on the result
+// regular file with sum.  These goroutines send the results of the digests on the result
 // channel and send the result of the walk on the error channel.  If done is
 // closed, sumFiles abandons its work.
-func sumFiles(done <-chan struct{}, root string) (<-chan result, <-chan error) {
+//
+// Symlinked directories are followed, and their files are reported under the
+// link.  Links pointing back up the tree are skipped so they don't loop
+// forever.  Files and directories rules ignores are skipped.
+func sumFiles(done <-chan struct{}, root string, rules *ignoreRules, sum func(path string) ([]byte, error)) (<-chan result, <-chan error) {
 	// For each regular file, start a goroutine that sums the file and sends
 	// the result on c.  Send the result of the walk on errc.
 	c := make(chan result)
 	errc := make(chan error, 1)
 	go func() { // HL
 		var wg sync.WaitGroup
-		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return fmt.Errorf("error walking the file path %s: %w", root, err)
+		// ancestors are the resolved directories being walked.
+		var ancestors []string
+		if info, err := os.Lstat(root); err == nil && info.IsDir() {
+			if resolved, err := filepath.EvalSymlinks(root); err == nil {
+				ancestors = append(ancestors, resolved)
+			}
+		}
+		visit := func(path string, info os.FileInfo) error {
+			if info.IsDir() {
+				return nil
 			}
 			if !info.Mode().IsRegular() {
-				resolvedInfo, err := resolvesTo(root)
+				resolvedInfo, err := resolvesTo(path)
 				if err != nil {
 					return err
 				}
 				if resolvedInfo.isDir {
-					// TODO: figure out how to handle dirs and
-					// symlinked dirs
 					return nil
 				}
 				path = resolvedInfo.fileName
 			}
 			wg.Add(1)
 			go func() { // HL
-				data, err := os.ReadFile(path)
+				s, err := sum(path)
 				select {
-				case c <- result{path, sha256.Sum256(data), err}: // HL
+				case c <- result{path, s, err}: // HL
 				case <-done: // HL
 				}
 				wg.Done()
@@ -344,7 +1073,53 @@ func sumFiles(done <-chan struct{}, root string) (<-chan result, <-chan error) {
 			default:
 				return nil
 			}
-		})
+		}
+		var walk func(dir, name string, ancestors []string) error
+		walk = func(dir, name string, ancestors []string) error {
+			return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return fmt.Errorf("error walking the file path %s: %w", root, err)
+				}
+				if dir != name {
+					// Inside a linked directory, report the path under the link.
+					rel, err := filepath.Rel(dir, path)
+					if err != nil {
+						return err
+					}
+					path = filepath.Join(name, rel)
+				}
+				if rules != nil {
+					rel, err := filepath.Rel(root, path)
+					if err != nil {
+						return err
+					}
+					isDir := info.IsDir()
+					if info.Mode()&fs.ModeSymlink != 0 {
+						if targetInfo, err := os.Stat(path); err == nil {
+							isDir = targetInfo.IsDir()
+						}
+					}
+					if rules.ignored(filepath.ToSlash(rel), isDir) {
+						if info.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+				}
+				if info.Mode()&fs.ModeSymlink != 0 {
+					if target, err := filepath.EvalSymlinks(path); err == nil {
+						if targetInfo, err := os.Stat(target); err == nil && targetInfo.IsDir() {
+							if SymlinkLoops(target, path, ancestors) {
+								return nil
+							}
+							return walk(target, path, append(ancestors, target))
+						}
+					}
+				}
+				return visit(path, info)
+			})
+		}
+		err := walk(root, root, ancestors)
 		// Walk has returned, so all calls to wg.Add are done.  Start a
 		// goroutine to close c once all the sends are done.
 		go func() { // HL
@@ -357,19 +1132,38 @@ func sumFiles(done <-chan struct{}, root string) (<-chan result, <-chan error) {
 	return c, errc
 }
 
-// sha256Dir reads all the files in the file tree rooted at root and returns a map
-// from file path to the sha256 sum of the file's contents.  If the directory walk
-// fails or any read operation fails, sha256Dir returns an error.  In that case,
-// sha256Dir does not wait for inflight read operations to complete.
-func sha256Dir(root string) (map[string][sha256.Size]byte, error) {
-	// sha256Dir closes the done channel when it returns; it may do so before
+// SymlinkLoops reports whether following the link at path to the directory
+// target leads back to the directory holding the link or to one of ancestors,
+// the resolved directories being walked.
+func SymlinkLoops(target, path string, ancestors []string) bool {
+	within := func(dir string) bool {
+		rel, err := filepath.Rel(target, dir)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil && within(dir) {
+		return true
+	}
+	for _, ancestor := range ancestors {
+		if within(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashDir reads all the files in the file tree rooted at root and returns a map
+// from file path to the sum of the file.  If the directory walk
+// fails or any read operation fails, hashDir returns an error.  In that case,
+// hashDir does not wait for inflight read operations to complete.
+func hashDir(root string, rules *ignoreRules, sum func(path string) ([]byte, error)) (map[string][]byte, error) {
+	// hashDir closes the done channel when it returns; it may do so before
 	// receiving all the values from c and errc.
 	done := make(chan struct{}) // HLdone
 	defer close(done)           // HLdone
 
-	c, errc := sumFiles(done, root) // HLdone
+	c, errc := sumFiles(done, root, rules, sum) // HLdone
 
-	m := make(map[string][sha256.Size]byte)
+	m := make(map[string][]byte)
 	for r := range c { // HLrange
 		if r.err != nil {
 			return nil, r.err
@@ -382,8 +1176,8 @@ func sha256Dir(root string) (map[string][sha256.Size]byte, error) {
 	return m, nil
 }
 
-func generateHashOnCrd(crd *v1alpha1.Application) (string, error) {
-	hash := sha256.New()
+func generateHashOnCrd(crd *v1alpha1.Application, newHash func() hash.Hash) (string, error) {
+	hash := newHash()
 	crdString := crd.String()
 	crdByte := []byte(crdString)
 	if _, err := hash.Write(crdByte); err != nil {
@@ -393,40 +1187,133 @@ func generateHashOnCrd(crd *v1alpha1.Application) (string, error) {
 	return hex.EncodeToString(sum), nil
 }
 
-func Run(crd *v1alpha1.Application, output string, skipRenderKey string, ignoreValueFile string) error {
-	manifest, err := template(crd, skipRenderKey, ignoreValueFile)
+// Run renders every Helm source of crd and writes the combined manifest to
+// output.
+func Run(ctx context.Context, crd *v1alpha1.Application, output string, opts Options) error {
+	sources, err := Sources(crd)
 	if err != nil {
-		log.Printf(
-			"error generating manifest for %s error: %v\n",
-			crd.ObjectMeta.Name,
-			string(manifest),
-		)
 		return err
 	}
-	err = writeToFile(manifest, output)
+
+	var manifest []byte
+	for _, source := range sources {
+		if !IsHelm(source.Spec.Source) {
+			continue
+		}
+
+		if opts.ConfinePaths {
+			if err := checkConfined(source.Spec.Source, ".", opts.IgnoreValueFiles); err != nil {
+				return fmt.Errorf("error generating manifest for %s: %w", crd.ObjectMeta.Name, err)
+			}
+		}
+
+		out, err := template(ctx, source, opts)
+		if err != nil {
+			slog.Error("Error generating manifest", "app", crd.ObjectMeta.Name, "error", err)
+			return err
+		}
+		manifest = append(manifest, out...)
+		if opts.MaxManifestSize > 0 && int64(len(manifest)) > opts.MaxManifestSize {
+			return fmt.Errorf("error generating manifest for %s: the manifest is %d bytes, over the limit of %d bytes", crd.ObjectMeta.Name, len(manifest), opts.MaxManifestSize)
+		}
+	}
+
+	manifest, err = ExcludeKinds(manifest, opts.ExcludeKinds)
+	if err != nil {
+		return fmt.Errorf("error generating manifest for %s: %w", crd.ObjectMeta.Name, err)
+	}
+
+	if opts.FailOnEmpty && len(bytes.TrimSpace(manifest)) == 0 {
+		return fmt.Errorf("error generating manifest for %s: nothing was rendered", crd.ObjectMeta.Name)
+	}
+
+	if opts.Validate {
+		if err := Validate(manifest); err != nil {
+			return fmt.Errorf("invalid manifest for %s: %w", crd.ObjectMeta.Name, err)
+		}
+	}
+
+	var header string
+	if opts.ProvenanceHeader && len(bytes.TrimSpace(manifest)) > 0 {
+		// Left out of empty manifests, so they are still detected as such.
+		if header, err = provenanceHeader(ctx, crd, sources, opts); err != nil {
+			return fmt.Errorf("error generating manifest for %s: %w", crd.ObjectMeta.Name, err)
+		}
+	}
+
+	err = writeToFile(manifest, header, output, opts)
 	return err
 }
 
 func Read(inputCRD string) ([]*v1alpha1.Application, error) {
+	crdSpecs, _, err := ReadAll(inputCRD)
+	return crdSpecs, err
+}
+
+// ReadAll reads every document in inputCRD, returning ApplicationSets
+// separately from the other documents, which are decoded as Applications.
+func ReadAll(inputCRD string) ([]*v1alpha1.Application, []*v1alpha1.ApplicationSet, error) {
 	crdSpecs := make([]*v1alpha1.Application, 0)
-	yamlFile, err := os.ReadFile(inputCRD)
+	appSets := make([]*v1alpha1.ApplicationSet, 0)
+	yamlFile, err := ReadManifest(inputCRD)
 	if err != nil {
 		// log.Fatalf("Error reading crd: %s %v", inputCRD, err)
-		return crdSpecs, fmt.Errorf("error reading crd: %s %w", inputCRD, err)
+		return crdSpecs, appSets, fmt.Errorf("error reading crd: %s %w", inputCRD, err)
 	}
 
-	dec := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader(yamlFile), 1000)
+	return Decode(bytes.NewReader(yamlFile))
+}
+
+// Decode reads every document in r like ReadAll does.
+func Decode(r io.Reader) ([]*v1alpha1.Application, []*v1alpha1.ApplicationSet, error) {
+	crdSpecs := make([]*v1alpha1.Application, 0)
+	appSets := make([]*v1alpha1.ApplicationSet, 0)
+
+	dec := yamlutil.NewYAMLOrJSONDecoder(r, 1000)
+	var pending []json.RawMessage
 	for {
-		app := v1alpha1.Application{}
-		if err := dec.Decode(&app); err != nil {
+		var doc json.RawMessage
+		if len(pending) > 0 {
+			doc, pending = pending[0], pending[1:]
+		} else if err := dec.Decode(&doc); err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
 			// panic(fmt.Errorf("document decode failed: %w", err))
-			return crdSpecs, fmt.Errorf("document decode failed: %w", err)
+			return crdSpecs, appSets, fmt.Errorf("document decode failed: %w", err)
+		}
+
+		if bytes.HasPrefix(bytes.TrimSpace(doc), []byte("[")) {
+			// The manifests written with FormatJSON hold an array of
+			// documents.
+			var docs []json.RawMessage
+			if err := json.Unmarshal(doc, &docs); err != nil {
+				return crdSpecs, appSets, fmt.Errorf("document decode failed: %w", err)
+			}
+			pending = append(docs, pending...)
+			continue
+		}
+
+		typeMeta := metav1.TypeMeta{}
+		if err := json.Unmarshal(doc, &typeMeta); err != nil {
+			return crdSpecs, appSets, fmt.Errorf("document decode failed: %w", err)
+		}
+
+		if typeMeta.Kind == "ApplicationSet" {
+			appSet := v1alpha1.ApplicationSet{}
+			if err := json.Unmarshal(doc, &appSet); err != nil {
+				return crdSpecs, appSets, fmt.Errorf("document decode failed: %w", err)
+			}
+			appSets = append(appSets, &appSet)
+			continue
+		}
+
+		app := v1alpha1.Application{}
+		if err := json.Unmarshal(doc, &app); err != nil {
+			return crdSpecs, appSets, fmt.Errorf("document decode failed: %w", err)
 		}
 		crdSpecs = append(crdSpecs, &app)
 	}
 
-	return crdSpecs, nil
+	return crdSpecs, appSets, nil
 }
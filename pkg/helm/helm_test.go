@@ -1,12 +1,21 @@
 package helm
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/chime/mani-diffy/pkg/kustomize"
 )
 
 func TestRead(t *testing.T) {
@@ -45,7 +54,7 @@ func TestBuildParameters(t *testing.T) {
 		t.Error(err)
 	}
 	crd := data[0]
-	setValues, fileValues := buildParams(crd, "")
+	setValues, _, fileValues, _, _ := buildParams(crd, nil)
 
 	if setValues != "region=us-east-1" {
 		t.Error("setValues is not correct")
@@ -63,7 +72,7 @@ func TestBuildParameters2(t *testing.T) {
 		t.Error(err)
 	}
 	crd := data[0]
-	setValues, fileValues := buildParams(crd, "")
+	setValues, _, fileValues, _, _ := buildParams(crd, nil)
 
 	if setValues != "region=us-east-1,testName=testValue" {
 		t.Error("setValues is not correct")
@@ -81,7 +90,7 @@ func TestBuildParametersIgnoreValueFile(t *testing.T) {
 		t.Error(err)
 	}
 	crd := data[0]
-	setValues, fileValues := buildParams(crd, "overrides/service/bar/test.yaml")
+	setValues, _, fileValues, _, _ := buildParams(crd, []string{"overrides/service/bar/test.yaml"})
 
 	if setValues != "env=test" {
 		t.Error("setValues is not correct")
@@ -91,6 +100,117 @@ func TestBuildParametersIgnoreValueFile(t *testing.T) {
 		t.Error("fileValues is not correct")
 	}
 
+	_, _, fileValues, _, _ = buildParams(crd, []string{"", "secrets.yaml", "bar/test.yaml", "bar/base.yaml"})
+	if fileValues != "" {
+		t.Errorf("expected every matching value file to be ignored got: %s", fileValues)
+	}
+}
+
+func TestBuildParametersForceString(t *testing.T) {
+	data, err := Read("test_files/crdData_testfile_force_string.yaml")
+	if err != nil {
+		t.Error(err)
+	}
+	crd := data[0]
+	setValues, setStringValues, _, _, _ := buildParams(crd, nil)
+
+	if setValues != "region=us-east-1,replicas=2" {
+		t.Errorf("setValues is not correct: %s", setValues)
+	}
+
+	if setStringValues != "image.tag=1.10,build=0042" {
+		t.Errorf("setStringValues is not correct: %s", setStringValues)
+	}
+
+	crd.Spec.Source.Path = t.TempDir()
+	crd.Spec.Source.Helm.ValueFiles = nil
+	hash, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crd.Spec.Source.Helm.Parameters[1].ForceString = false
+	unforced, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == unforced {
+		t.Error("expected forcing a parameter to a string to change the hash")
+	}
+}
+
+func TestBuildParametersFileParameters(t *testing.T) {
+	data, err := Read("test_files/crdData_testfile_file_parameters.yaml")
+	if err != nil {
+		t.Error(err)
+	}
+	crd := data[0]
+	setValues, _, fileValues, setFileValues, _ := buildParams(crd, nil)
+
+	if setValues != "region=us-east-1" {
+		t.Error("setValues is not correct")
+	}
+
+	if fileValues != "../../overrides/bootstrap/prod-cluster.yaml" {
+		t.Error("fileValues is not correct")
+	}
+
+	if setFileValues != "tls.cert=files/tls.crt,config.script=files/init.sh" {
+		t.Error("setFileValues is not correct")
+	}
+
+}
+
+func TestBuildParametersJSON(t *testing.T) {
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: t.TempDir(),
+				Helm: &v1alpha1.ApplicationSourceHelm{
+					Parameters: []v1alpha1.HelmParameter{
+						{Name: "region", Value: "us-east-1"},
+						{Name: "resources", Value: `{"limits": {"cpu": "1", "memory": "1Gi"}}`},
+						{Name: "hosts", Value: `["a.example.com", "b.example.com"]`},
+						{Name: "annotation", Value: `{"kept": "as a string"}`, ForceString: true},
+						{Name: "broken", Value: "{not json"},
+					},
+				},
+			},
+		},
+	}
+	setValues, setStringValues, _, _, setJSONValues := buildParams(crd, nil)
+
+	if setValues != "region=us-east-1,broken={not json" {
+		t.Errorf("setValues is not correct: %s", setValues)
+	}
+
+	if setStringValues != `annotation={"kept": "as a string"}` {
+		t.Errorf("setStringValues is not correct: %s", setStringValues)
+	}
+
+	if setJSONValues != `resources={"limits": {"cpu": "1", "memory": "1Gi"}},hosts=["a.example.com", "b.example.com"]` {
+		t.Errorf("setJSONValues is not correct: %s", setJSONValues)
+	}
+
+	values, err := mergedValues(crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits, ok := values["resources"].(map[string]interface{})["limits"].(map[string]interface{}); !ok || limits["memory"] != "1Gi" {
+		t.Errorf("expected the JSON value to be merged as an object got: %v", values["resources"])
+	}
+
+	hash, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crd.Spec.Source.Helm.Parameters[1].ForceString = true
+	forced, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == forced {
+		t.Error("expected passing a parameter with --set-json to change the hash")
+	}
 }
 
 func TestCreateTempFile(t *testing.T) {
@@ -142,7 +262,7 @@ func TestTemplate(t *testing.T) {
 	if err := os.Chdir("../../"); err != nil {
 		t.Error(err)
 	}
-	_, err = template(crdSpec, "", "")
+	_, err = template(context.Background(), crdSpec, Options{})
 	if err != nil {
 		log.Println(err)
 		t.Error("Template failed to render a template")
@@ -162,7 +282,7 @@ apiVersion: argoproj.io/v1alpha1
 kind: Application
 `
 
-	manifest, _ := template(crdSpec, "", "")
+	manifest, _ := template(context.Background(), crdSpec, Options{})
 	if strings.Contains(string(manifest), comparisonString) != true {
 		t.Error("Template failed to render a template with expected content")
 	}
@@ -176,7 +296,7 @@ func TestTemplateContentSkipRenderKey(t *testing.T) {
 	app := data[0]
 
 	// Call template with a key to override
-	manifest, _ := template(app, "appTag", "")
+	manifest, _ := template(context.Background(), app, Options{SkipRenderKey: "appTag"})
 
 	// Verify the rendered manifest contains the override
 	if !strings.Contains(string(manifest), "appTag: CONSCIOUSLY_NOT_RENDERED") {
@@ -204,9 +324,10 @@ func TestGeneralHashFunction(t *testing.T) {
 	}
 
 	for _, tt := range testFiles {
+		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			hash, err := generalHashFunction(tt.file) //nolint:govet
+			hash, err := generalHashFunction(tt.file, sha256.New) //nolint:govet
 			h := hex.EncodeToString(hash)
 			expectedHash := tt.hash //nolint:govet
 			if err != nil || h != expectedHash {
@@ -223,7 +344,7 @@ func TestGenerateHashOnCrd(t *testing.T) {
 	}
 	crd := data[0]
 
-	hash, err := generateHashOnCrd(crd)
+	hash, err := generateHashOnCrd(crd, sha256.New)
 	if err != nil || hash != "7bfd65e963e76680dc5160b6a55c04c3d9780c84aee1413ae710e4b5279cfe14" {
 		t.Errorf("Failed to generate correctly, got %s", hash)
 	}
@@ -290,15 +411,15 @@ func TestDifferenceInTwoDifferentFiles(t *testing.T) {
 		t.Error(err2)
 	}
 
-	crd1Hash, _ := generateHashOnCrd(data[0])
-	crd2Hash, _ := generateHashOnCrd(data2[0])
+	crd1Hash, _ := generateHashOnCrd(data[0], sha256.New)
+	crd2Hash, _ := generateHashOnCrd(data2[0], sha256.New)
 	if crd1Hash == crd2Hash {
 		t.Error("Failed to generate two different hashes")
 	}
 }
 
 func TestGenerateHashOnChart(t *testing.T) {
-	hash, _ := generalHashFunction("demo/charts/app-of-apps")
+	hash, _ := generalHashFunction("demo/charts/app-of-apps", sha256.New)
 	h := hex.EncodeToString(hash)
 	actualHash := "13aa148adefa3d633e5ce95584d3c95297a4417977837040cd67f0afbca17b5a"
 	if h != actualHash {
@@ -371,7 +492,7 @@ func TestEmptyManifest(t *testing.T) {
 			name:     "Check missing file",
 			manifest: "pkg/helm/test_files/i_dont_exist.yaml",
 			expected: false,
-			err:      errors.New("stat pkg/helm/test_files/i_dont_exist.yaml: no such file or directory"),
+			err:      nil,
 		},
 	}
 
@@ -379,9 +500,7 @@ func TestEmptyManifest(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			got, err := EmptyManifest(tt.manifest)
 			if !errors.Is(err, tt.err) {
-				if !strings.Contains(err.Error(), "no such file or directory") {
-					t.Errorf("unexpected error got: %v wanted: %v", tt.err, err)
-				}
+				t.Errorf("unexpected error got: %v wanted: %v", err, tt.err)
 			}
 			if got != tt.expected {
 				t.Errorf("got: %t wanted: %t", got, tt.expected)
@@ -390,3 +509,1142 @@ func TestEmptyManifest(t *testing.T) {
 	}
 
 }
+
+// notFoundError is a "not found" error with the text Windows uses, which
+// matches fs.ErrNotExist like syscall.Errno does there.
+type notFoundError struct{}
+
+func (notFoundError) Error() string { return "The system cannot find the file specified." }
+
+func (notFoundError) Is(target error) bool { return target == fs.ErrNotExist }
+
+func TestEmptyManifestStatErrors(t *testing.T) {
+	t.Cleanup(func() { statManifest = os.Stat })
+
+	manifest := filepath.Join("output", "app", "manifest.yaml")
+	statManifest = func(name string) (fs.FileInfo, error) {
+		return nil, &fs.PathError{Op: "GetFileAttributesEx", Path: name, Err: notFoundError{}}
+	}
+	if empty, err := EmptyManifest(manifest); err != nil || empty {
+		t.Errorf("expected a missing manifest not to be empty got: %t %v", empty, err)
+	}
+
+	statManifest = func(name string) (fs.FileInfo, error) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrPermission}
+	}
+	if _, err := EmptyManifest(manifest); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected other errors to be returned got: %v", err)
+	}
+}
+
+func TestGenerateHashDirectoryOptions(t *testing.T) {
+	directories := []*v1alpha1.ApplicationSourceDirectory{
+		nil,
+		{},
+		{Recurse: true},
+		{Recurse: true, Include: "*.yaml"},
+		{Recurse: true, Exclude: "*.yaml"},
+	}
+
+	seen := make(map[string]int)
+	for i, dir := range directories {
+		crd := &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{
+				Source: &v1alpha1.ApplicationSource{Directory: dir},
+			},
+		}
+		hash, err := GenerateHash(context.Background(), crd, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j, ok := seen[hash]; ok {
+			t.Errorf("directory options %d and %d generated the same hash", j, i)
+		}
+		seen[hash] = i
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	apps, appSets, err := ReadAll("pkg/helm/test_files/applicationset_testfile.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(apps) != 1 || apps[0].ObjectMeta.Name != "prod-cluster" {
+		t.Errorf("Failed to read applications: %v", apps)
+	}
+
+	if len(appSets) != 1 || len(appSets[0].Spec.Generators[0].List.Elements) != 2 {
+		t.Errorf("Failed to read application sets: %v", appSets)
+	}
+}
+
+func TestGenerateHashTargetRevision(t *testing.T) {
+	hashes := make(map[string]bool)
+	for _, revision := range []string{"", "HEAD", "v1.0.0"} {
+		crd := &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{
+				Source: &v1alpha1.ApplicationSource{TargetRevision: revision},
+			},
+		}
+		hash, err := GenerateHash(context.Background(), crd, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashes[hash] {
+			t.Errorf("target revision %q generated a duplicate hash", revision)
+		}
+		hashes[hash] = true
+	}
+}
+
+func TestGenerateHashSourceOrigin(t *testing.T) {
+	hashes := make(map[string]bool)
+	for _, source := range []v1alpha1.ApplicationSource{
+		{RepoURL: "https://github.com/chime/mani-diffy.git"},
+		{RepoURL: "https://mirror.example.com/chime/mani-diffy.git"},
+		// Pinned, so the hash doesn't need to pull the chart.
+		{RepoURL: "https://mirror.example.com/chime/mani-diffy.git", Chart: "redis", TargetRevision: "18.1.0"},
+	} {
+		source := source
+		crd := &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{Source: &source},
+		}
+		hash, err := GenerateHash(context.Background(), crd, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashes[hash] {
+			t.Errorf("source %+v generated a duplicate hash", source)
+		}
+		hashes[hash] = true
+	}
+}
+
+func TestCheckHelmAvailable(t *testing.T) {
+	bin := t.TempDir()
+	t.Setenv("PATH", bin)
+	if _, err := CheckHelmAvailable(context.Background()); err == nil || !strings.Contains(err.Error(), "helm was not found") {
+		t.Errorf("expected a missing helm to fail got: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(bin, "helm"), []byte("#!/bin/sh\necho v3.14.0+g3fc9f4b\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	version, err := CheckHelmAvailable(context.Background())
+	if err != nil || version != "v3.14.0+g3fc9f4b" {
+		t.Errorf("expected the version of helm got: %q %v", version, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(bin, "helm"), []byte("#!/bin/sh\necho broken >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckHelmAvailable(context.Background()); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected a broken helm to fail got: %v", err)
+	}
+}
+
+func TestTemplateRemoteChart(t *testing.T) {
+	// A fake helm recording how it was called.
+	bin := t.TempDir()
+	calls := filepath.Join(bin, "calls")
+	script := `#!/bin/sh
+echo "$@" >> ` + calls + `
+if [ "$1" = pull ]; then
+	while [ "$1" != --untardir ]; do shift; done
+	mkdir -p "$2/redis"
+	exit 0
+fi
+pwd >> ` + calls + `
+echo "kind: ConfigMap"
+`
+	if err := os.WriteFile(filepath.Join(bin, "helm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for repo, pull := range map[string]string{
+		"https://charts.bitnami.com/bitnami":        "pull redis --repo https://charts.bitnami.com/bitnami --version 18.1.0 --untar --untardir ",
+		"registry-1.docker.io/bitnamicharts":        "pull oci://registry-1.docker.io/bitnamicharts/redis --version 18.1.0 --untar --untardir ",
+		"oci://registry-1.docker.io/bitnamicharts/": "pull oci://registry-1.docker.io/bitnamicharts/redis --version 18.1.0 --untar --untardir ",
+	} {
+		if err := os.Remove(calls); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+
+		crd := &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{
+				Source: &v1alpha1.ApplicationSource{
+					RepoURL:        repo,
+					Chart:          "redis",
+					TargetRevision: "18.1.0",
+				},
+			},
+		}
+		crd.ObjectMeta.Name = "redis"
+
+		out, err := template(context.Background(), crd, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != "kind: ConfigMap\n" {
+			t.Errorf("expected the pulled chart to be templated got: %s", out)
+		}
+
+		b, err := os.ReadFile(calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != 3 || !strings.HasPrefix(lines[0], pull) || !strings.HasPrefix(lines[1], "template redis ../redis") {
+			t.Fatalf("unexpected helm calls for %s: %q", repo, lines)
+		}
+		chart := lines[2]
+		if filepath.Base(chart) != "redis" {
+			t.Errorf("expected the chart to be templated in the pulled directory got: %s", chart)
+		}
+		if _, err := os.Stat(chart); !os.IsNotExist(err) {
+			t.Errorf("expected the pulled chart to be removed: %v", err)
+		}
+	}
+}
+
+func TestTemplateRemoteChartValueFiles(t *testing.T) {
+	// A fake helm pulling a chart shipping values-prod.yaml, and printing
+	// the value files it's templated with.
+	bin := t.TempDir()
+	script := `#!/bin/sh
+if [ "$1" = pull ]; then
+	while [ "$1" != --untardir ]; do shift; done
+	mkdir -p "$2/redis"
+	echo "replicas: 3" > "$2/redis/values-prod.yaml"
+	exit 0
+fi
+while [ "$1" != -f ]; do shift; done
+echo "$2"
+`
+	if err := os.WriteFile(filepath.Join(bin, "helm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Sources: v1alpha1.ApplicationSources{
+				{
+					RepoURL:        "https://charts.bitnami.com/bitnami",
+					Chart:          "redis",
+					TargetRevision: "18.1.0",
+					Helm: &v1alpha1.ApplicationSourceHelm{
+						ValueFiles: []string{"values-prod.yaml", "$values/overrides/redis.yaml"},
+					},
+				},
+				{RepoURL: "https://github.com/chime/mani-diffy", Ref: "values"},
+			},
+		},
+	}
+	crd.ObjectMeta.Name = "redis"
+	sources, err := Sources(crd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := template(context.Background(), sources[0], Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := filepath.Abs("overrides/redis.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first is read from the pulled chart, where helm runs.
+	if expected := "values-prod.yaml," + ref + "\n"; string(out) != expected {
+		t.Errorf("expected the value files %q got: %q", expected, out)
+	}
+}
+
+func TestGenerateHashRemoteChartVersion(t *testing.T) {
+	// A fake helm showing the latest release of the chart, recording its
+	// calls and failing anything else.
+	bin := t.TempDir()
+	calls := filepath.Join(t.TempDir(), "calls")
+	script := `#!/bin/sh
+[ "$1 $2" = "show chart" ] || exit 1
+echo "$@" >> ` + calls + `
+printf 'apiVersion: v2\nname: redis\nversion: %s\n' "$MANI_DIFFY_TEST_LATEST"
+`
+	if err := os.WriteFile(filepath.Join(bin, "helm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	hash := func(ctx context.Context, revision string) string {
+		t.Helper()
+		h, err := GenerateHash(ctx, &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{
+				Source: &v1alpha1.ApplicationSource{
+					RepoURL:        "https://charts.bitnami.com/bitnami",
+					Chart:          "redis",
+					TargetRevision: revision,
+				},
+			},
+		}, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	for _, revision := range []string{"", "^18.1.0", "18.x"} {
+		t.Setenv("MANI_DIFFY_TEST_LATEST", "18.1.0")
+		before := hash(context.Background(), revision)
+		t.Setenv("MANI_DIFFY_TEST_LATEST", "18.2.0")
+		if hash(context.Background(), revision) == before {
+			t.Errorf("expected a new release to change the hash of %q", revision)
+		}
+	}
+
+	// A context caching the versions resolves each chart once.
+	if err := os.Remove(calls); err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithChartVersions(context.Background())
+	before := hash(ctx, "^18.1.0")
+	t.Setenv("MANI_DIFFY_TEST_LATEST", "18.3.0")
+	if hash(ctx, "^18.1.0") != before {
+		t.Error("expected the cached version to be hashed")
+	}
+	hash(ctx, "18.x")
+	b, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "show chart redis --repo https://charts.bitnami.com/bitnami --version ^18.1.0\n" +
+		"show chart redis --repo https://charts.bitnami.com/bitnami --version 18.x\n"
+	if string(b) != expected {
+		t.Errorf("expected helm to be called with:\n%s\ngot:\n%s", expected, b)
+	}
+
+	// Resolving the version stops with the context.
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := GenerateHash(canceled, &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{RepoURL: "https://charts.bitnami.com/bitnami", Chart: "redis"},
+		},
+	}, Options{}); err == nil {
+		t.Error("expected a canceled context to fail resolving the version")
+	}
+
+	// Exact versions are hashed without resolving them.
+	t.Setenv("PATH", t.TempDir())
+	hash(context.Background(), "18.1.0")
+	hash(context.Background(), "v18.1.0-rc.1")
+}
+
+func TestTemplateHelmVersion(t *testing.T) {
+	for version, expected := range map[string]string{
+		"v2": "helm v2 is not supported",
+		"2":  "helm 2 is not supported",
+		"v4": "unknown helm version",
+	} {
+		crd := &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{
+				Source: &v1alpha1.ApplicationSource{
+					Path: "demo/charts/app-of-apps",
+					Helm: &v1alpha1.ApplicationSourceHelm{Version: version},
+				},
+			},
+		}
+		crd.ObjectMeta.Name = "legacy-app"
+
+		_, err := template(context.Background(), crd, Options{})
+		if err == nil || !strings.Contains(err.Error(), expected) || !strings.Contains(err.Error(), "legacy-app") {
+			t.Errorf("expected version %s to be rejected got: %v", version, err)
+		}
+	}
+}
+
+func TestGenerateHashMultipleSources(t *testing.T) {
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Sources: v1alpha1.ApplicationSources{
+				{
+					Path: "demo/charts",
+					Helm: &v1alpha1.ApplicationSourceHelm{
+						ValueFiles: []string{"$values/pkg/helm/test_files/crdData_override_testfile.yaml"},
+					},
+				},
+				{Ref: "values"},
+			},
+		},
+	}
+
+	hash, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crd.Spec.Sources[0].Helm.ValueFiles[0] = "$values/pkg/helm/test_files/crdData_testfile.yaml"
+	hash2, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash == hash2 {
+		t.Error("Failed to generate different hashes for different ref value files")
+	}
+
+	crd.Spec.Sources = append(crd.Spec.Sources, v1alpha1.ApplicationSource{Kustomize: &v1alpha1.ApplicationSourceKustomize{}})
+	if _, err := GenerateHash(context.Background(), crd, Options{}); !errors.Is(err, kustomize.ErrNotSupported) {
+		t.Errorf("expected kustomize sources to be unsupported got: %v", err)
+	}
+}
+
+func TestTemplateErrorIncludesAppName(t *testing.T) {
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: "pkg/helm/test_files/does-not-exist",
+				Helm: &v1alpha1.ApplicationSourceHelm{},
+			},
+		},
+	}
+	crd.ObjectMeta.Name = "broken-app"
+
+	_, err := template(context.Background(), crd, Options{})
+	if err == nil || !strings.Contains(err.Error(), "broken-app") {
+		t.Errorf("expected the error to name the application got: %v", err)
+	}
+}
+
+func TestUpdateDependenciesRetries(t *testing.T) {
+	defer func(backoff time.Duration) { dependencyUpdateBackoff = backoff }(dependencyUpdateBackoff)
+	dependencyUpdateBackoff = 10 * time.Millisecond
+
+	// Not a chart, so every dependency update fails.
+	start := time.Now()
+	if err := updateDependencies(context.Background(), t.TempDir(), DependencyStrategyUpdate, 2); err == nil {
+		t.Fatal("expected the dependency update to fail")
+	}
+
+	// Two retries wait for the backoff and then twice the backoff.
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("expected the retries to back off got: %s", elapsed)
+	}
+}
+
+func TestGenerateHashCapabilities(t *testing.T) {
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: "demo/charts/app-of-apps",
+				Helm: &v1alpha1.ApplicationSourceHelm{},
+			},
+		},
+	}
+
+	crd.ObjectMeta.Name = "app-of-apps"
+
+	hashes := map[string]bool{}
+	for _, opts := range []Options{
+		{},
+		{KubeVersion: "1.27.0"},
+		{KubeVersion: "1.28.0"},
+		{KubeVersion: "1.28.0", APIVersions: []string{"monitoring.coreos.com/v1"}},
+		{KubeVersion: "1.28.0", APIVersions: []string{"monitoring.coreos.com/v1", "cert-manager.io/v1"}},
+		{DefaultNamespace: "apps"},
+		{IncludeCRDs: true},
+		{ExcludeKinds: []string{"Secret"}},
+		{ExcludeKinds: []string{"Secret", "ConfigMap"}},
+		{OutputFormat: FormatJSON},
+		{ManifestFilename: "rendered.yaml"},
+		{SplitManifests: true},
+		{Normalize: true},
+		{Normalize: true, NormalizeDrop: []string{"helm.sh/chart"}},
+		{ValuesPrecedence: ValuesPrecedenceFiles},
+		{NamespaceOverrides: map[string]string{"app-of-apps": "staging"}},
+	} {
+		hash, err := GenerateHash(context.Background(), crd, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashes[hash] {
+			t.Errorf("expected %+v to change the hash", opts)
+		}
+		hashes[hash] = true
+	}
+
+	// Overriding the namespace of another app leaves the hash alone.
+	hash, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateHash(context.Background(), crd, Options{NamespaceOverrides: map[string]string{"other-app": "staging"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != other {
+		t.Error("expected the namespace override of another app not to change the hash")
+	}
+}
+
+func TestGenerateHashFileParameters(t *testing.T) {
+	chart := t.TempDir()
+	cert := filepath.Join(chart, "tls.crt")
+	if err := os.WriteFile(cert, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: chart,
+				Helm: &v1alpha1.ApplicationSourceHelm{
+					FileParameters: []v1alpha1.HelmFileParameter{{Name: "tls.cert", Path: "tls.crt"}},
+				},
+			},
+		},
+	}
+
+	hash, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(cert, []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash == hash2 {
+		t.Error("Failed to generate different hashes for different file parameters")
+	}
+}
+
+func TestWriteToFileSplit(t *testing.T) {
+	manifest := `---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+---
+# Source: app/templates/empty.yaml
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+  namespace: other
+`
+	output := filepath.Join(t.TempDir(), "app")
+	if err := writeToFile([]byte(manifest), "", output, Options{SplitManifests: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if expected := []string{"deployment-app.yaml", "service-app-2.yaml", "service-app.yaml"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected files got: %v wanted: %v", names, expected)
+	}
+
+	b, err := os.ReadFile(filepath.Join(output, "deployment-app.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "# Source: app/templates/deployment.yaml\napiVersion: apps/v1\n") {
+		t.Errorf("unexpected content got:\n%s", b)
+	}
+
+	empty, err := EmptyManifestDir(output)
+	if err != nil || empty {
+		t.Errorf("expected the split manifest not to be empty got: %t %v", empty, err)
+	}
+
+	// An empty render writes no files.
+	emptyOutput := filepath.Join(t.TempDir(), "empty")
+	if err := writeToFile([]byte{}, "", emptyOutput, Options{SplitManifests: true}); err != nil {
+		t.Fatal(err)
+	}
+	empty, err = EmptyManifestDir(emptyOutput)
+	if err != nil || !empty {
+		t.Errorf("expected the split manifest to be empty got: %t %v", empty, err)
+	}
+
+	empty, err = EmptyManifestDir(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || empty {
+		t.Errorf("expected a missing output not to be empty got: %t %v", empty, err)
+	}
+}
+
+func TestRunFailOnEmpty(t *testing.T) {
+	// A fake helm rendering nothing, like a chart without templates.
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "helm"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	chart := filepath.Join(t.TempDir(), "empty-chart")
+	if err := os.MkdirAll(chart, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(chart, "Chart.yaml"), []byte("apiVersion: v2\nname: empty-chart\nversion: 0.1.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: chart,
+				Helm: &v1alpha1.ApplicationSourceHelm{},
+			},
+		},
+	}
+	crd.ObjectMeta.Name = "empty-app"
+
+	output := filepath.Join(t.TempDir(), "empty-app")
+	err := Run(context.Background(), crd, output, Options{FailOnEmpty: true})
+	if err == nil || !strings.Contains(err.Error(), "empty-app: nothing was rendered") {
+		t.Errorf("expected the empty render to fail got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "manifest.yaml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no manifest to be written got: %v", err)
+	}
+}
+
+func TestRunMaxManifestSize(t *testing.T) {
+	// A fake helm rendering a single ConfigMap.
+	bin := t.TempDir()
+	script := "#!/bin/sh\nprintf 'apiVersion: v1\\nkind: ConfigMap\\nmetadata:\\n  name: big\\n'\n"
+	if err := os.WriteFile(filepath.Join(bin, "helm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: t.TempDir(),
+				Helm: &v1alpha1.ApplicationSourceHelm{},
+			},
+		},
+	}
+	crd.ObjectMeta.Name = "big-app"
+	opts := Options{SkipDependencyUpdate: true}
+
+	output := filepath.Join(t.TempDir(), "big-app")
+	opts.MaxManifestSize = 10
+	err := Run(context.Background(), crd, output, opts)
+	if err == nil || !strings.Contains(err.Error(), "big-app: the manifest is 53 bytes, over the limit of 10 bytes") {
+		t.Errorf("expected the oversized manifest to fail got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "manifest.yaml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no manifest to be written got: %v", err)
+	}
+
+	opts.MaxManifestSize = 53
+	if err := Run(context.Background(), crd, output, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "manifest.yaml")); err != nil {
+		t.Errorf("expected a manifest within the limit to be written: %v", err)
+	}
+}
+
+func TestGenerateHashChartFiles(t *testing.T) {
+	chart := t.TempDir()
+	files := map[string]string{
+		"Chart.yaml":                "apiVersion: v2\nname: app\nversion: 0.1.0\n",
+		"values.yaml":               "replicas: 1\n",
+		"overrides/production.yaml": "replicas: 3\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(chart, name)), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(chart, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: chart,
+				Helm: &v1alpha1.ApplicationSourceHelm{},
+			},
+		},
+	}
+
+	hashes := map[string]bool{}
+	// Neither file is listed in the Application.
+	for _, edit := range []string{"", "values.yaml", "overrides/production.yaml"} {
+		if edit != "" {
+			if err := os.WriteFile(filepath.Join(chart, edit), []byte("replicas: 5\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		hash, err := GenerateHash(context.Background(), crd, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashes[hash] {
+			t.Errorf("expected editing %s to change the hash", edit)
+		}
+		hashes[hash] = true
+	}
+}
+
+func TestGenerateHashAlgorithm(t *testing.T) {
+	chart := t.TempDir()
+	if err := os.WriteFile(filepath.Join(chart, "values.yaml"), []byte("replicas: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: chart,
+				Helm: &v1alpha1.ApplicationSourceHelm{},
+			},
+		},
+	}
+
+	sha, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicit, err := GenerateHash(context.Background(), crd, Options{HashAlgorithm: HashSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha != explicit {
+		t.Errorf("expected sha256 to be the default got %s and %s", sha, explicit)
+	}
+
+	b3, err := GenerateHash(context.Background(), crd, Options{HashAlgorithm: HashBLAKE3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b3, "blake3:") || b3 == sha {
+		t.Errorf("expected a prefixed blake3 hash got %s", b3)
+	}
+	again, err := GenerateHash(context.Background(), crd, Options{HashAlgorithm: HashBLAKE3})
+	if err != nil || again != b3 {
+		t.Errorf("expected blake3 hashes to be stable got %s and %s", b3, again)
+	}
+
+	if _, err := GenerateHash(context.Background(), crd, Options{HashAlgorithm: "md5"}); err == nil {
+		t.Error("expected an unsupported algorithm to fail")
+	}
+}
+
+func TestGeneralHashFunctionSymlinkedDir(t *testing.T) {
+	tmp := t.TempDir()
+	shared := filepath.Join(tmp, "shared")
+	chart := filepath.Join(tmp, "chart")
+	for _, dir := range []string{shared, chart} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(shared, "overrides.yaml"), []byte("replicas: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(chart, "values.yaml"), []byte("replicas: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(shared, filepath.Join(chart, "shared")); err != nil {
+		t.Fatal(err)
+	}
+	// Links back up the tree must not be followed forever.
+	if err := os.Symlink(chart, filepath.Join(chart, "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".", filepath.Join(shared, "self")); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := generalHashFunction(chart, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(shared, "overrides.yaml"), []byte("replicas: 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := generalHashFunction(chart, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reflect.DeepEqual(hash, hash2) {
+		t.Error("expected editing a file in a symlinked directory to change the hash")
+	}
+}
+
+func TestGeneralHashFunctionNestedSymlink(t *testing.T) {
+	tmp := t.TempDir()
+	chart := filepath.Join(tmp, "chart")
+	if err := os.MkdirAll(filepath.Join(chart, "templates"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	shared := filepath.Join(tmp, "shared.yaml")
+	if err := os.WriteFile(shared, []byte("replicas: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(chart, "Chart.yaml"), []byte("name: chart\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../shared.yaml", filepath.Join(chart, "templates", "shared.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := generalHashFunction(chart, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(shared, []byte("replicas: 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := generalHashFunction(chart, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reflect.DeepEqual(hash, hash2) {
+		t.Error("expected editing the target of a nested symlink to change the hash")
+	}
+}
+
+func TestReleaseName(t *testing.T) {
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: t.TempDir(),
+				Helm: &v1alpha1.ApplicationSourceHelm{},
+			},
+		},
+	}
+	crd.ObjectMeta.Name = "app"
+
+	if name := releaseName(crd); name != "app" {
+		t.Errorf("expected the application name to be the release name got: %s", name)
+	}
+	hash, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crd.Spec.Source.Helm.ReleaseName = "release"
+	if name := releaseName(crd); name != "release" {
+		t.Errorf("expected the release name of the source got: %s", name)
+	}
+	hash2, err := GenerateHash(context.Background(), crd, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash == hash2 {
+		t.Error("expected the release name to change the hash")
+	}
+}
+
+func TestGenerateHashPostRenderer(t *testing.T) {
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: t.TempDir(),
+				Helm: &v1alpha1.ApplicationSourceHelm{},
+			},
+		},
+	}
+	postRenderer := filepath.Join(t.TempDir(), "post-render")
+
+	hashes := map[string]bool{}
+	for _, script := range []string{"", "#!/bin/sh\ncat\n", "#!/bin/sh\nkustomize build .\n"} {
+		opts := Options{}
+		if script != "" {
+			if err := os.WriteFile(postRenderer, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			opts.PostRenderer = postRenderer
+		}
+		hash, err := GenerateHash(context.Background(), crd, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashes[hash] {
+			t.Errorf("expected the post renderer %q to change the hash", script)
+		}
+		hashes[hash] = true
+	}
+
+	if _, err := GenerateHash(context.Background(), crd, Options{PostRenderer: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("expected a missing post renderer to fail")
+	}
+}
+
+func TestTemplateArgs(t *testing.T) {
+	// A fake helm printing how it was called.
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho \"$@\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "helm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	for _, tc := range []struct {
+		helm     v1alpha1.ApplicationSourceHelm
+		opts     Options
+		expected []string
+		skipped  []string
+	}{
+		{skipped: []string{"--skip-crds", "--pass-credentials"}},
+		{helm: v1alpha1.ApplicationSourceHelm{ValueFiles: []string{"values-prod.yaml"}}, expected: []string{"-f values-prod.yaml -f "}},
+		{helm: v1alpha1.ApplicationSourceHelm{ValueFiles: []string{"values-prod.yaml"}}, opts: Options{ValuesPrecedence: ValuesPrecedenceFiles}, expected: []string{"-f  -f values-prod.yaml"}},
+		{opts: Options{DefaultNamespace: "apps", NamespaceOverrides: map[string]string{"app": "staging"}}, expected: []string{"-n staging"}, skipped: []string{"-n apps"}},
+		{opts: Options{DefaultNamespace: "apps", NamespaceOverrides: map[string]string{"other-app": "staging"}}, expected: []string{"-n apps"}, skipped: []string{"-n staging"}},
+		{helm: v1alpha1.ApplicationSourceHelm{SkipCrds: true}, opts: Options{IncludeCRDs: true}, expected: []string{"--include-crds", "--skip-crds"}},
+		{helm: v1alpha1.ApplicationSourceHelm{PassCredentials: true}, expected: []string{"--pass-credentials"}, skipped: []string{"--skip-crds"}},
+	} {
+		helm := tc.helm
+		crd := &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{
+				Source: &v1alpha1.ApplicationSource{Path: t.TempDir(), Helm: &helm},
+			},
+		}
+		crd.ObjectMeta.Name = "app"
+
+		out, err := template(context.Background(), crd, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, flag := range tc.expected {
+			if !strings.Contains(string(out), flag) {
+				t.Errorf("expected helm to be called with %s for %+v got: %s", flag, tc.helm, out)
+			}
+		}
+		for _, flag := range tc.skipped {
+			if strings.Contains(string(out), flag) {
+				t.Errorf("expected helm not to be called with %s for %+v got: %s", flag, tc.helm, out)
+			}
+		}
+	}
+}
+
+func TestGenerateHashSkipCrds(t *testing.T) {
+	chart := t.TempDir()
+	hashes := map[string]bool{}
+	for _, skipCrds := range []bool{false, true} {
+		crd := &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{
+				Source: &v1alpha1.ApplicationSource{
+					Path: chart,
+					Helm: &v1alpha1.ApplicationSourceHelm{SkipCrds: skipCrds},
+				},
+			},
+		}
+		hash, err := GenerateHash(context.Background(), crd, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashes[hash] {
+			t.Errorf("expected skipCrds=%t to change the hash", skipCrds)
+		}
+		hashes[hash] = true
+	}
+}
+
+func TestGenerateHashHelmIgnore(t *testing.T) {
+	chart := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(chart, "templates"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(chart, "ci"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{
+		".helmignore":             "# Files helm leaves out\n*.md\nci/\n",
+		"Chart.yaml":              "name: chart\n",
+		"README.md":               "# chart\n",
+		"ci/values.yaml":          "replicas: 1\n",
+		"templates/configmap.yml": "kind: ConfigMap\n",
+		"templates/.swp":          "editor\n",
+	} {
+		if err := os.WriteFile(filepath.Join(chart, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{
+				Path: chart,
+				Helm: &v1alpha1.ApplicationSourceHelm{},
+			},
+		},
+	}
+	// The same files read as a directory source, which is copied whole.
+	directory := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{Path: chart},
+		},
+	}
+	hash := func(opts Options) string {
+		t.Helper()
+		h, err := GenerateHash(context.Background(), crd, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	hashDirectory := func() string {
+		t.Helper()
+		h, err := GenerateHash(context.Background(), directory, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	ignoring := hash(Options{})
+	copied := hashDirectory()
+	all := hash(Options{IncludeHidden: true})
+
+	for file, content := range map[string]string{
+		"README.md":      "# renamed chart\n",
+		"ci/values.yaml": "replicas: 2\n",
+		"templates/.swp": "editor again\n",
+	} {
+		if err := os.WriteFile(filepath.Join(chart, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := hash(Options{}); h != ignoring {
+		t.Error("expected the files the .helmignore lists not to change the hash")
+	}
+	if h := hash(Options{IncludeHidden: true}); h == all {
+		t.Error("expected -include-hidden to hash the files the .helmignore lists")
+	}
+	if h := hashDirectory(); h == copied {
+		t.Error("expected every file of a directory source to change its hash")
+	}
+
+	if err := os.WriteFile(filepath.Join(chart, "templates", "configmap.yml"), []byte("kind: Secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if h := hash(Options{}); h == ignoring {
+		t.Error("expected the rendered files to change the hash")
+	}
+
+	if err := os.WriteFile(filepath.Join(chart, ".helmignore"), []byte("**/*.md\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateHash(context.Background(), crd, Options{}); err == nil {
+		t.Error("expected an unsupported .helmignore pattern to fail")
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	rules := &ignoreRules{}
+	for _, rule := range []string{"*.md", "/ci/", "docs/*.txt"} {
+		if err := rules.add(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		rel      string
+		isDir    bool
+		expected bool
+	}{
+		{rel: "README.md", expected: true},
+		{rel: "templates/NOTES.md", expected: true},
+		{rel: "ci", isDir: true, expected: true},
+		{rel: "ci", expected: false},
+		{rel: "templates/ci", isDir: true, expected: false},
+		{rel: "docs/a.txt", expected: true},
+		{rel: "a.txt", expected: false},
+		{rel: "values.yaml", expected: false},
+	} {
+		if ignored := rules.ignored(tc.rel, tc.isDir); ignored != tc.expected {
+			t.Errorf("expected %s (dir: %t) to be ignored: %t got: %t", tc.rel, tc.isDir, tc.expected, ignored)
+		}
+	}
+
+	var none *ignoreRules
+	if none.ignored("README.md", false) {
+		t.Error("expected no rules to ignore nothing")
+	}
+}
+
+func TestGenerateHashValueFilePaths(t *testing.T) {
+	// ../x.yaml and ../../x.yaml used to both be hashed as x.yaml.
+	root := t.TempDir()
+	chart := filepath.Join(root, "charts", "app")
+	if err := os.MkdirAll(chart, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for file, values := range map[string]string{
+		filepath.Join(root, "charts", "x.yaml"): "replicas: 1\n",
+		filepath.Join(root, "x.yaml"):           "replicas: 2\n",
+	} {
+		if err := os.WriteFile(file, []byte(values), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hashes := map[string]string{}
+	for _, valueFile := range []string{"../x.yaml", "../../x.yaml"} {
+		crd := &v1alpha1.Application{
+			Spec: v1alpha1.ApplicationSpec{
+				Source: &v1alpha1.ApplicationSource{
+					Path: chart,
+					Helm: &v1alpha1.ApplicationSourceHelm{ValueFiles: []string{valueFile}},
+				},
+			},
+		}
+		hash, err := GenerateHash(context.Background(), crd, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[valueFile] = hash
+	}
+	if hashes["../x.yaml"] == hashes["../../x.yaml"] {
+		t.Error("expected value files with the same trimmed name to hash differently")
+	}
+
+	for _, tc := range []struct {
+		source   v1alpha1.ApplicationSource
+		file     string
+		expected string
+	}{
+		{source: v1alpha1.ApplicationSource{Path: "charts/app"}, file: "../../values/app.yaml", expected: "values/app.yaml"},
+		{source: v1alpha1.ApplicationSource{Path: "charts/app"}, file: "values-prod.yaml", expected: "charts/app/values-prod.yaml"},
+		{source: v1alpha1.ApplicationSource{Path: "charts/app"}, file: "/etc/values.yaml", expected: "/etc/values.yaml"},
+		{source: v1alpha1.ApplicationSource{Chart: "redis"}, file: "values-prod.yaml", expected: ""},
+		{source: v1alpha1.ApplicationSource{Chart: "redis"}, file: "$values/./values/redis.yaml", expected: "values/redis.yaml"},
+		{source: v1alpha1.ApplicationSource{Chart: "redis"}, file: "/etc/values.yaml", expected: "/etc/values.yaml"},
+	} {
+		source := tc.source
+		if path := ValueFilePath(&source, tc.file); path != tc.expected {
+			t.Errorf("expected %s of %+v to be read from %s got: %s", tc.file, tc.source, tc.expected, path)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package helm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// helmIgnoreFile lists the files of a chart helm leaves out when loading it.
+const helmIgnoreFile = ".helmignore"
+
+// ignoreRules are the rules of a .helmignore file, matched like helm does:
+// patterns are globs, matched against the base name of a file unless they
+// contain a slash, a trailing slash only matches directories and a leading !
+// negates the pattern.
+type ignoreRules struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	glob    string
+	base    bool
+	negate  bool
+	mustDir bool
+}
+
+// chartIgnoreRules returns the files helm ignores in the chart at path: the
+// ones its .helmignore lists and hidden files under templates. It returns nil
+// when includeHidden is set, or path isn't a directory, so every file is
+// hashed.
+func chartIgnoreRules(path string, includeHidden bool) (*ignoreRules, error) {
+	if includeHidden {
+		return nil, nil
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		// Let hashing report the error.
+		return nil, nil
+	}
+
+	rules := &ignoreRules{}
+	// Helm always leaves these out.
+	if err := rules.add("templates/.?*"); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(path, helmIgnoreFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(b, []byte("\xEF\xBB\xBF"))))
+	for s.Scan() {
+		if err := rules.add(s.Text()); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", filepath.Join(path, helmIgnoreFile), err)
+		}
+	}
+	return rules, s.Err()
+}
+
+func (r *ignoreRules) add(rule string) error {
+	rule = strings.TrimSpace(rule)
+	if rule == "" || strings.HasPrefix(rule, "#") {
+		return nil
+	}
+	if strings.Contains(rule, "**") {
+		return fmt.Errorf("%q: double-star (**) syntax is not supported", rule)
+	}
+	if _, err := filepath.Match(rule, "abc"); err != nil {
+		return fmt.Errorf("%q: %w", rule, err)
+	}
+
+	p := ignorePattern{}
+	if strings.HasPrefix(rule, "!") {
+		p.negate = true
+		rule = rule[1:]
+	}
+	if strings.HasSuffix(rule, "/") {
+		p.mustDir = true
+		rule = strings.TrimSuffix(rule, "/")
+	}
+	p.base = !strings.Contains(rule, "/")
+	p.glob = strings.TrimPrefix(rule, "/")
+	r.patterns = append(r.patterns, p)
+	return nil
+}
+
+// ignored reports whether helm leaves out the file at rel, its slash
+// separated path relative to the chart. A nil r ignores nothing.
+func (r *ignoreRules) ignored(rel string, isDir bool) bool {
+	if r == nil || rel == "" || rel == "." {
+		return false
+	}
+	for _, p := range r.patterns {
+		name := rel
+		if p.base {
+			name = filepath.Base(rel)
+		}
+		matched, _ := filepath.Match(p.glob, name)
+		if p.negate {
+			// Like helm, a negated pattern ignores everything it doesn't
+			// match.
+			if (p.mustDir && !isDir) || !matched {
+				return true
+			}
+			continue
+		}
+		if p.mustDir && !isDir {
+			continue
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+// now is the time recorded in provenance headers.
+var now = time.Now
+
+type hashKey struct{}
+
+// WithHash returns a context carrying hash, the hash of the application
+// rendered with it, so the provenance header records it instead of hashing
+// the application again.
+func WithHash(ctx context.Context, hash string) context.Context {
+	return context.WithValue(ctx, hashKey{}, hash)
+}
+
+// provenanceHeader returns the comment starting the manifests of crd with
+// Options.ProvenanceHeader, rendered from the Helm sources among sources. The
+// hash is the one carried by ctx, or else generated.
+func provenanceHeader(ctx context.Context, crd *v1alpha1.Application, sources []*v1alpha1.Application, opts Options) (string, error) {
+	hash, ok := ctx.Value(hashKey{}).(string)
+	if !ok {
+		var err error
+		if hash, err = GenerateHash(ctx, crd, opts); err != nil {
+			return "", err
+		}
+	}
+
+	version := opts.Version
+	if version == "" {
+		version = "unknown"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by mani-diffy %s\n", version)
+	for _, source := range sources {
+		s := source.Spec.Source
+		switch {
+		case !IsHelm(s):
+		case remoteChart(s):
+			fmt.Fprintf(&b, "# Source: %s %s@%s\n", s.RepoURL, s.Chart, s.TargetRevision)
+		default:
+			fmt.Fprintf(&b, "# Source: %s\n", s.Path)
+		}
+	}
+	fmt.Fprintf(&b, "# Hash: %s\n", hash)
+	if !opts.NoTimestamp {
+		fmt.Fprintf(&b, "# Rendered at: %s\n", now().UTC().Format(time.RFC3339))
+	}
+	return b.String(), nil
+}
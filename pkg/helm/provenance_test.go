@@ -0,0 +1,97 @@
+package helm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestProvenanceHeader(t *testing.T) {
+	defer func(n func() time.Time) { now = n }(now)
+	now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	chart := t.TempDir()
+	manifests := t.TempDir()
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Sources: v1alpha1.ApplicationSources{
+				{Path: chart, Helm: &v1alpha1.ApplicationSourceHelm{}},
+				{RepoURL: "https://charts.example.com", Chart: "redis", TargetRevision: "17.3.7"},
+				{Path: manifests},
+			},
+		},
+	}
+	crd.ObjectMeta.Name = "app"
+	sources, err := Sources(crd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{ProvenanceHeader: true, Version: "v1.2.0"}
+	hash, err := GenerateHash(context.Background(), crd, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := provenanceHeader(context.Background(), crd, sources, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# Generated by mani-diffy v1.2.0\n" +
+		"# Source: " + chart + "\n" +
+		"# Source: https://charts.example.com redis@17.3.7\n" +
+		"# Hash: " + hash + "\n" +
+		"# Rendered at: 2024-05-01T12:00:00Z\n"
+	if header != expected {
+		t.Errorf("expected the header %q got: %q", expected, header)
+	}
+
+	opts.NoTimestamp = true
+	if header, err := provenanceHeader(context.Background(), crd, sources, opts); err != nil || strings.Contains(header, "Rendered at") {
+		t.Errorf("expected no timestamp got: %q %v", header, err)
+	}
+
+	// The hash already generated is recorded as is, without hashing the
+	// sources again.
+	if err := os.RemoveAll(chart); err != nil {
+		t.Fatal(err)
+	}
+	if header, err := provenanceHeader(WithHash(context.Background(), "abc"), crd, sources, opts); err != nil || !strings.Contains(header, "# Hash: abc\n") {
+		t.Errorf("expected the hash of the context got: %q %v", header, err)
+	}
+}
+
+func TestWriteToFileHeader(t *testing.T) {
+	header := "# Generated by mani-diffy v1.2.0\n"
+	manifest := "---\n# Source: app/templates/a.yaml\nkind: ConfigMap\nmetadata:\n  name: a\n---\n# Source: app/templates/b.yaml\nkind: Secret\nmetadata:\n  name: b\n"
+
+	output := t.TempDir()
+	if err := writeToFile([]byte(manifest), header, output, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(output, DefaultManifestFilename)); err != nil || string(b) != header+manifest {
+		t.Errorf("expected the manifest to start with the header got: %s %v", b, err)
+	}
+
+	split := t.TempDir()
+	if err := writeToFile([]byte(manifest), header, split, Options{SplitManifests: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"configmap-a.yaml", "secret-b.yaml"} {
+		if b, err := os.ReadFile(filepath.Join(split, file)); err != nil || !strings.HasPrefix(string(b), header) {
+			t.Errorf("expected %s to start with the header got: %s %v", file, b, err)
+		}
+	}
+
+	json := t.TempDir()
+	if err := writeToFile([]byte(manifest), header, json, Options{OutputFormat: FormatJSON}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(json, "manifest.json")); err != nil || strings.Contains(string(b), "#") {
+		t.Errorf("expected no header in a JSON manifest got: %s %v", b, err)
+	}
+}
@@ -0,0 +1,153 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// exactVersion matches the target revisions naming a single chart version,
+// e.g. `1.2.3` or `v1.2.3-rc.1`, unlike ranges like `^1.2` or `1.x`.
+var exactVersion = regexp.MustCompile(`^v?[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// IsHelm reports whether source is rendered with Helm: either its Helm options
+// are set, or it references a chart in a Helm or OCI repository.
+func IsHelm(source *v1alpha1.ApplicationSource) bool {
+	return source.Helm != nil || remoteChart(source)
+}
+
+// remoteChart reports whether source references a chart in a Helm or OCI
+// repository instead of a chart in this repository.
+func remoteChart(source *v1alpha1.ApplicationSource) bool {
+	return source.Chart != "" && source.Path == ""
+}
+
+// chartArgs are the arguments of the helm commands referencing the remote
+// chart of source: the chart, its repository and, like Argo, the target
+// revision as its version.
+func chartArgs(source *v1alpha1.ApplicationSource) []string {
+	var args []string
+	if repo := source.RepoURL; strings.HasPrefix(repo, "http://") || strings.HasPrefix(repo, "https://") {
+		args = append(args, source.Chart, "--repo", repo)
+	} else {
+		// Argo leaves the scheme out of OCI repositories.
+		repo = "oci://" + strings.TrimPrefix(repo, "oci://")
+		args = append(args, strings.TrimSuffix(repo, "/")+"/"+source.Chart)
+	}
+	if source.TargetRevision != "" {
+		args = append(args, "--version", source.TargetRevision)
+	}
+	return args
+}
+
+// pullChart pulls the remote chart of app into a temporary directory with
+// `helm pull`. It returns a copy of app pointing at the pulled chart, and a
+// function removing it once it has been templated.
+func pullChart(ctx context.Context, app *v1alpha1.Application) (*v1alpha1.Application, func(), error) {
+	source := app.Spec.Source
+	dir, err := os.MkdirTemp("", "chart-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating chart directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	args := append([]string{"pull"}, chartArgs(source)...)
+	args = append(args, "--untar", "--untardir", dir)
+
+	slog.Info("Pulling chart", "app", app.ObjectMeta.Name, "repo", source.RepoURL, "chart", source.Chart, "version", source.TargetRevision)
+	cmd := exec.CommandContext(ctx, "helm", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("error pulling chart %s from %s: %w: %s", source.Chart, source.RepoURL, err, strings.TrimSpace(stderr.String()))
+	}
+
+	pulled := app.DeepCopy()
+	pulled.Spec.Source.Path = filepath.Join(dir, path.Base(source.Chart))
+	if pulled.Spec.Source.Helm == nil {
+		pulled.Spec.Source.Helm = &v1alpha1.ApplicationSourceHelm{}
+	}
+	// Like Argo, value files are read from the pulled chart, where helm
+	// runs. The `$<ref>/` ones are in the working directory instead.
+	for i, valueFile := range pulled.Spec.Source.Helm.ValueFiles {
+		path, ok := refPath(valueFile)
+		if !ok {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		pulled.Spec.Source.Helm.ValueFiles[i] = abs
+	}
+	return pulled, cleanup, nil
+}
+
+type chartVersionsKey struct{}
+
+// chartVersions caches the versions remote charts resolve to, keyed by their
+// repository, chart and target revision.
+type chartVersions struct {
+	mu       sync.Mutex
+	versions map[[3]string]string
+}
+
+// WithChartVersions returns a context caching the versions the remote charts
+// with a range or no target revision resolve to, so each of them is only
+// resolved once while ctx is used, e.g. during a single run. A release
+// published meanwhile is picked up by the next run.
+func WithChartVersions(ctx context.Context) context.Context {
+	return context.WithValue(ctx, chartVersionsKey{}, &chartVersions{versions: make(map[[3]string]string)})
+}
+
+// remoteChartVersion returns the version of the chart a render of the remote
+// chart of source pulls, read from its Chart.yaml with `helm show chart`. A
+// range or an empty target revision resolves to a newer chart once it's
+// released, which renders differently. The version is cached by ctx, if
+// it caches them.
+func remoteChartVersion(ctx context.Context, source *v1alpha1.ApplicationSource) (string, error) {
+	key := [3]string{source.RepoURL, source.Chart, source.TargetRevision}
+	cache, _ := ctx.Value(chartVersionsKey{}).(*chartVersions)
+	if cache != nil {
+		cache.mu.Lock()
+		version, ok := cache.versions[key]
+		cache.mu.Unlock()
+		if ok {
+			return version, nil
+		}
+	}
+
+	slog.Debug("Resolving chart version", "repo", source.RepoURL, "chart", source.Chart, "version", source.TargetRevision)
+	cmd := exec.CommandContext(ctx, "helm", append([]string{"show", "chart"}, chartArgs(source)...)...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error reading the version of chart %s from %s: %w: %s", source.Chart, source.RepoURL, err, strings.TrimSpace(stderr.String()))
+	}
+	var chart struct {
+		Version string `yaml:"version"`
+	}
+	if err := yaml.Unmarshal(b, &chart); err != nil {
+		return "", fmt.Errorf("error reading the version of chart %s: %w", source.Chart, err)
+	}
+
+	if cache != nil {
+		cache.mu.Lock()
+		cache.versions[key] = chart.Version
+		cache.mu.Unlock()
+	}
+	return chart.Version, nil
+}
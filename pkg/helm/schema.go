@@ -0,0 +1,191 @@
+package helm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/xeipuuv/gojsonschema"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// schemaFile is the JSON schema charts can ship for their values.
+const schemaFile = "values.schema.json"
+
+// validateValuesSchema checks the values helmInfo templates its chart with
+// against the chart's values.schema.json, before helm is called. Charts
+// without a schema are always valid. Only the schema of the chart itself is
+// checked, the ones of its dependencies are left to helm.
+func validateValuesSchema(helmInfo *v1alpha1.Application, opts Options) error {
+	chart := helmInfo.Spec.Source.Path
+	schemaPath := filepath.Join(chart, schemaFile)
+	schema, err := os.ReadFile(schemaPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	values, err := mergedValues(helmInfo, opts)
+	if err != nil {
+		return err
+	}
+
+	result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewGoLoader(values))
+	if err != nil {
+		return fmt.Errorf("error validating values against %s: %w", schemaPath, err)
+	}
+	if result.Valid() {
+		return nil
+	}
+
+	var failures []string
+	for _, e := range result.Errors() {
+		failures = append(failures, fmt.Sprintf("%s: %s", e.Field(), e.Description()))
+	}
+	return fmt.Errorf("values don't match %s:\n- %s", schemaPath, strings.Join(failures, "\n- "))
+}
+
+// mergedValues returns the values helm templates the chart of helmInfo with:
+// the chart's values.yaml, overridden by the value files, the inline values
+// and the parameters, in that order. With ValuesPrecedenceFiles the value
+// files override the inline values instead. Parameters using helm's index syntax,
+// e.g. `list[0]`, are left out.
+func mergedValues(helmInfo *v1alpha1.Application, opts Options) (map[string]interface{}, error) {
+	chart := helmInfo.Spec.Source.Path
+	source := helmInfo.Spec.Source.Helm
+
+	// The documents to merge, in order.
+	type document struct {
+		name string
+		b    []byte
+	}
+	var docs, valueFiles []document
+	chartValues := filepath.Join(chart, "values.yaml")
+	b, err := os.ReadFile(chartValues)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// Charts don't need a values.yaml.
+	case err != nil:
+		return nil, fmt.Errorf("error reading values: %w", err)
+	default:
+		docs = append(docs, document{name: "values from " + chartValues, b: b})
+	}
+	for _, valueFile := range source.ValueFiles {
+		if ignoredValueFile(valueFile, opts.IgnoreValueFiles) {
+			continue
+		}
+		if !filepath.IsAbs(valueFile) {
+			// Value files are relative to the chart, like helm is run.
+			valueFile = filepath.Join(chart, valueFile)
+		}
+		b, err := os.ReadFile(valueFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading values: %w", err)
+		}
+		valueFiles = append(valueFiles, document{name: "values from " + valueFile, b: b})
+	}
+	inline := document{name: "the inline values", b: []byte(source.Values)}
+	if opts.ValuesPrecedence == ValuesPrecedenceFiles {
+		docs = append(append(docs, inline), valueFiles...)
+	} else {
+		docs = append(append(docs, valueFiles...), inline)
+	}
+
+	values := map[string]interface{}{}
+	for _, doc := range docs {
+		if err := mergeValues(values, doc.b); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", doc.name, err)
+		}
+	}
+
+	for _, parameter := range source.Parameters {
+		if strings.Contains(parameter.Name, "[") {
+			continue
+		}
+		var value interface{} = parameter.Value
+		switch {
+		case isJSONParameter(parameter):
+			if err := json.Unmarshal([]byte(parameter.Value), &value); err != nil {
+				return nil, fmt.Errorf("error reading the JSON value of %s: %w", parameter.Name, err)
+			}
+		case !parameter.ForceString:
+			value = typedValue(parameter.Value)
+		}
+		setValue(values, strings.Split(parameter.Name, "."), value)
+	}
+	return values, nil
+}
+
+// mergeValues merges the YAML document b into values like helm coalesces
+// value files: maps are merged recursively, other values replace the ones in
+// values, and null removes a key.
+func mergeValues(values map[string]interface{}, b []byte) error {
+	var override map[string]interface{}
+	if err := yaml.Unmarshal(b, &override); err != nil {
+		return err
+	}
+	coalesce(values, override)
+	return nil
+}
+
+func coalesce(dst, src map[string]interface{}) {
+	for key, value := range src {
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+		srcMap, srcIsMap := value.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			coalesce(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// setValue sets the value at the dotted path of a --set parameter.
+func setValue(values map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := values[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			values[key] = next
+		}
+		values = next
+	}
+	if value == nil {
+		delete(values, path[len(path)-1])
+		return
+	}
+	values[path[len(path)-1]] = value
+}
+
+// typedValue converts the value of a --set parameter like helm does: booleans,
+// null and integers without leading zeros are typed, everything else is a
+// string.
+func typedValue(value string) interface{} {
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if len(value) > 1 && value[0] == '0' {
+		return value
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i
+	}
+	return value
+}
@@ -0,0 +1,106 @@
+package helm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestValidateValuesSchema(t *testing.T) {
+	dir := t.TempDir()
+	chart := filepath.Join(dir, "charts", "app")
+	if err := os.MkdirAll(chart, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{
+		filepath.Join(chart, "values.yaml"): "replicas: 1\nimage:\n  repository: nginx\n  tag: latest\n",
+		filepath.Join(chart, schemaFile): `{
+  "type": "object",
+  "properties": {
+    "replicas": {"type": "integer"},
+    "image": {
+      "type": "object",
+      "required": ["repository"],
+      "properties": {"tag": {"type": "string"}}
+    }
+  }
+}`,
+		filepath.Join(dir, "overrides", "app.yaml"): "image:\n  tag: \"1.25\"\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := func(helm v1alpha1.ApplicationSourceHelm) *v1alpha1.Application {
+		crd := &v1alpha1.Application{Spec: v1alpha1.ApplicationSpec{Source: &v1alpha1.ApplicationSource{Path: chart, Helm: &helm}}}
+		crd.ObjectMeta.Name = "app"
+		return crd
+	}
+
+	valid := []v1alpha1.ApplicationSourceHelm{
+		{},
+		{ValueFiles: []string{"../../overrides/app.yaml"}},
+		{Parameters: []v1alpha1.HelmParameter{{Name: "replicas", Value: "3"}, {Name: "image.tag", Value: "2", ForceString: true}}},
+		// Ignored value files aren't part of the values.
+		{ValueFiles: []string{"../../overrides/secrets.yaml"}},
+	}
+	for _, helm := range valid {
+		if err := validateValuesSchema(app(helm), Options{IgnoreValueFiles: []string{"secrets.yaml"}}); err != nil {
+			t.Errorf("expected %+v to be valid got: %v", helm, err)
+		}
+	}
+
+	invalid := map[string]v1alpha1.ApplicationSourceHelm{
+		"replicas: Invalid type":        {Values: "replicas: many\n"},
+		"image.tag: Invalid type":       {Parameters: []v1alpha1.HelmParameter{{Name: "image.tag", Value: "2"}}},
+		"image: repository is required": {Values: "image:\n  repository: null\n"},
+	}
+	for expected, helm := range invalid {
+		err := validateValuesSchema(app(helm), Options{})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %+v to fail with %q got: %v", helm, expected, err)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(chart, schemaFile)); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateValuesSchema(app(v1alpha1.ApplicationSourceHelm{Values: "replicas: many\n"}), Options{}); err != nil {
+		t.Errorf("expected charts without a schema to be valid got: %v", err)
+	}
+}
+
+func TestMergedValuesPrecedence(t *testing.T) {
+	chart := t.TempDir()
+	if err := os.WriteFile(filepath.Join(chart, "values.yaml"), []byte("replicas: 1\nregion: us-east-1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(chart, "values-prod.yaml"), []byte("replicas: 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	crd := &v1alpha1.Application{Spec: v1alpha1.ApplicationSpec{Source: &v1alpha1.ApplicationSource{
+		Path: chart,
+		Helm: &v1alpha1.ApplicationSourceHelm{ValueFiles: []string{"values-prod.yaml"}, Values: "replicas: 3\n"},
+	}}}
+
+	for precedence, expected := range map[string]int{
+		"":                     3,
+		ValuesPrecedenceInline: 3,
+		ValuesPrecedenceFiles:  2,
+	} {
+		values, err := mergedValues(crd, Options{ValuesPrecedence: precedence})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if values["replicas"] != expected || values["region"] != "us-east-1" {
+			t.Errorf("expected replicas to be %d with the %q precedence got: %v", expected, precedence, values)
+		}
+	}
+}
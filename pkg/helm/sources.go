@@ -0,0 +1,85 @@
+package helm
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+// Sources returns a copy of crd for each of its sources, with Spec.Source set
+// to that source. Applications with a single source are returned as is.
+//
+// Value files of the form `$<ref>/<path>` are resolved against the source
+// named <ref>. Argo resolves these against the root of the referenced
+// repository, which mani-diffy assumes is the repository it runs in, so the
+// path is rewritten relative to the chart directory helm runs from. Remote
+// charts are pulled elsewhere, so theirs are kept for pullChart to resolve.
+// Sources that only provide a ref are not returned.
+func Sources(crd *v1alpha1.Application) ([]*v1alpha1.Application, error) {
+	if !crd.Spec.HasMultipleSources() {
+		if crd.Spec.Source == nil {
+			return nil, fmt.Errorf("application %s has no source", crd.ObjectMeta.Name)
+		}
+		return []*v1alpha1.Application{crd}, nil
+	}
+
+	refs := make(map[string]bool)
+	for _, source := range crd.Spec.Sources {
+		if source.Ref != "" {
+			refs[source.Ref] = true
+		}
+	}
+
+	var apps []*v1alpha1.Application
+	for i := range crd.Spec.Sources {
+		source := crd.Spec.Sources[i].DeepCopy()
+		if source.Ref != "" && source.Path == "" && source.Chart == "" {
+			continue
+		}
+
+		if source.Helm != nil {
+			for j, valueFile := range source.Helm.ValueFiles {
+				resolved, err := resolveRef(valueFile, source, refs)
+				if err != nil {
+					return nil, fmt.Errorf("error resolving value file %s of %s: %w", valueFile, crd.ObjectMeta.Name, err)
+				}
+				source.Helm.ValueFiles[j] = resolved
+			}
+		}
+
+		app := crd.DeepCopy()
+		app.Spec.Source = source
+		app.Spec.Sources = nil
+		apps = append(apps, app)
+	}
+
+	return apps, nil
+}
+
+func resolveRef(valueFile string, source *v1alpha1.ApplicationSource, refs map[string]bool) (string, error) {
+	if !strings.HasPrefix(valueFile, "$") {
+		return valueFile, nil
+	}
+
+	ref, path, _ := strings.Cut(strings.TrimPrefix(valueFile, "$"), "/")
+	if !refs[ref] {
+		return "", fmt.Errorf("unknown source ref %s", ref)
+	}
+	if remoteChart(source) {
+		return valueFile, nil
+	}
+
+	return filepath.Rel(source.Path, path)
+}
+
+// refPath returns the path of a `$<ref>/<path>` value file, relative to the
+// working directory, and whether valueFile is one.
+func refPath(valueFile string) (string, bool) {
+	if !strings.HasPrefix(valueFile, "$") {
+		return "", false
+	}
+	_, path, _ := strings.Cut(valueFile, "/")
+	return path, true
+}
@@ -0,0 +1,112 @@
+package helm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func multiSourceApplication(valueFile string) *v1alpha1.Application {
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Sources: v1alpha1.ApplicationSources{
+				{
+					Path: "charts/service",
+					Helm: &v1alpha1.ApplicationSourceHelm{
+						ValueFiles: []string{"values.yaml", valueFile},
+					},
+				},
+				{
+					RepoURL: "https://github.com/chime/mani-diffy",
+					Ref:     "values",
+				},
+				{
+					Path:      "manifests",
+					Directory: &v1alpha1.ApplicationSourceDirectory{},
+				},
+			},
+		},
+	}
+	crd.ObjectMeta.Name = "multi-source"
+	return crd
+}
+
+func TestSources(t *testing.T) {
+	crd := multiSourceApplication("$values/overrides/service/prod.yaml")
+
+	sources, err := Sources(crd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sources) != 2 {
+		t.Fatalf("expected ref only sources to be dropped got: %d sources", len(sources))
+	}
+
+	for _, source := range sources {
+		if source.ObjectMeta.Name != "multi-source" || source.Spec.HasMultipleSources() {
+			t.Errorf("expected a single source copy of the application got: %v", source)
+		}
+	}
+
+	got := sources[0].Spec.Source.Helm.ValueFiles
+	want := []string{"values.yaml", "../../overrides/service/prod.yaml"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("value files got: %v wanted: %v", got, want)
+	}
+
+	if sources[1].Spec.Source.Path != "manifests" {
+		t.Errorf("unexpected second source: %v", sources[1].Spec.Source)
+	}
+
+	// The original application must be left untouched.
+	if crd.Spec.Sources[0].Helm.ValueFiles[1] != "$values/overrides/service/prod.yaml" {
+		t.Error("expected the application to be left untouched")
+	}
+}
+
+func TestSourcesRemoteChart(t *testing.T) {
+	crd := multiSourceApplication("$values/overrides/service/prod.yaml")
+	crd.Spec.Sources[0].Path = ""
+	crd.Spec.Sources[0].RepoURL = "https://charts.example.com"
+	crd.Spec.Sources[0].Chart = "service"
+
+	sources, err := Sources(crd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Left for pullChart, since the chart is pulled elsewhere.
+	got := sources[0].Spec.Source.Helm.ValueFiles
+	want := []string{"values.yaml", "$values/overrides/service/prod.yaml"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("value files got: %v wanted: %v", got, want)
+	}
+}
+
+func TestSourcesUnknownRef(t *testing.T) {
+	if _, err := Sources(multiSourceApplication("$missing/overrides/service/prod.yaml")); err == nil {
+		t.Error("expected an unknown ref to return an error")
+	}
+}
+
+func TestSourcesSingleSource(t *testing.T) {
+	crd := &v1alpha1.Application{
+		Spec: v1alpha1.ApplicationSpec{
+			Source: &v1alpha1.ApplicationSource{Path: "charts/service"},
+		},
+	}
+
+	sources, err := Sources(crd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0] != crd {
+		t.Errorf("expected the application to be returned as is got: %v", sources)
+	}
+
+	if _, err := Sources(&v1alpha1.Application{}); err == nil {
+		t.Error("expected an application without a source to return an error")
+	}
+}
@@ -0,0 +1,43 @@
+package helm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Validate checks that every document in manifest is a Kubernetes object,
+// i.e. it has an apiVersion, a kind and a metadata.name. Documents are
+// numbered from 1 in the returned error.
+func Validate(manifest []byte) error {
+	dec := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader(manifest), 1000)
+	for i := 1; ; i++ {
+		var doc struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Metadata   struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("document %d is not valid YAML: %w", i, err)
+		}
+
+		switch {
+		case doc.APIVersion == "" && doc.Kind == "" && doc.Metadata.Name == "":
+			return fmt.Errorf("document %d is empty", i)
+		case doc.APIVersion == "":
+			return fmt.Errorf("document %d has no apiVersion", i)
+		case doc.Kind == "":
+			return fmt.Errorf("document %d has no kind", i)
+		case doc.Metadata.Name == "":
+			return fmt.Errorf("document %d (%s) has no metadata.name", i, doc.Kind)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package helm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := `---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`
+
+	tests := []struct {
+		name     string
+		manifest string
+		expected string
+	}{
+		{name: "valid", manifest: valid + valid},
+		{name: "no documents", manifest: ""},
+		{name: "empty document", manifest: valid + "---\n# Source: app/templates/empty.yaml\n", expected: "document 2 is empty"},
+		{name: "no apiVersion", manifest: valid + "---\nkind: ConfigMap\nmetadata:\n  name: config\n", expected: "document 2 has no apiVersion"},
+		{name: "no kind", manifest: "apiVersion: v1\nmetadata:\n  name: config\n", expected: "document 1 has no kind"},
+		{name: "no name", manifest: valid + valid + "---\napiVersion: v1\nkind: Secret\nmetadata: {}\n", expected: "document 3 (Secret) has no metadata.name"},
+		{name: "invalid YAML", manifest: valid + "---\nkind: [\n", expected: "document 2 is not valid YAML"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate([]byte(tt.manifest))
+			if tt.expected == "" {
+				if err != nil {
+					t.Errorf("expected the manifest to be valid got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected %q got: %v", tt.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package helm
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+type warningsKey struct{}
+
+type warnings struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+// WithWarnings returns a context collecting the warnings helm prints when
+// templating a chart succeeds, like the ones about deprecated APIs, and a
+// function returning the warnings collected so far.
+func WithWarnings(ctx context.Context) (context.Context, func() []string) {
+	w := &warnings{}
+	return context.WithValue(ctx, warningsKey{}, w), func() []string {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return append([]string(nil), w.warnings...)
+	}
+}
+
+// addWarnings adds every line of stderr to the warnings collected by ctx, if
+// any are.
+func addWarnings(ctx context.Context, stderr string) {
+	w, ok := ctx.Value(warningsKey{}).(*warnings)
+	if !ok {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, line := range strings.Split(stderr, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			w.warnings = append(w.warnings, line)
+		}
+	}
+}
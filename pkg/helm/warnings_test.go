@@ -0,0 +1,29 @@
+package helm
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestWithWarnings(t *testing.T) {
+	// Nothing is collected without WithWarnings.
+	addWarnings(context.Background(), "coalesce.go:220: warning: skipped value\n")
+
+	ctx, warnings := WithWarnings(context.Background())
+	if got := warnings(); len(got) != 0 {
+		t.Errorf("expected no warnings got: %v", got)
+	}
+
+	addWarnings(ctx, "coalesce.go:220: warning: skipped value\n\n")
+	addWarnings(ctx, "")
+	addWarnings(ctx, "walker.go:74: found symbolic link in path\n")
+
+	expected := []string{
+		"coalesce.go:220: warning: skipped value",
+		"walker.go:74: found symbolic link in path",
+	}
+	if got := warnings(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v got: %v", expected, got)
+	}
+}
@@ -0,0 +1,9 @@
+package plugin
+
+import (
+	"errors"
+)
+
+// ErrNotSupported is returned for the sources rendered by a config management
+// plugin, which only run inside Argo.
+var ErrNotSupported = errors.New("config management plugins not supported")
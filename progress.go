@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// discover records that an application was found during the walk, whether or
+// not it ends up being rendered.
+func (s *Summary) discover() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discovered++
+}
+
+// statusCounts returns how many applications recorded in s have each status.
+// The caller holds s.mu.
+func (s *Summary) statusCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, app := range s.Apps {
+		counts[app.Status]++
+	}
+	return counts
+}
+
+// logProgress logs how far the walk recorded in s got.
+func (s *Summary) logProgress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := s.statusCounts()
+	slog.Info(
+		"Progress",
+		"discovered", s.discovered,
+		"visited", len(s.Apps),
+		"rendered", counts[StatusRendered],
+		"cache_hit", counts[StatusCacheHit],
+		"skipped", counts[StatusSkipped],
+		"failed", counts[StatusFailed],
+		"elapsed", time.Since(s.start).Round(time.Second),
+	)
+}
+
+// logFinished logs the totals of the walk recorded in s once the run is over,
+// whether or not it failed, along with how long the run took.
+func (s *Summary) logFinished(duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := s.statusCounts()
+	slog.Info(
+		"mani-diffy finished",
+		"discovered", s.discovered,
+		"rendered", counts[StatusRendered],
+		"cache_hit", counts[StatusCacheHit],
+		"skipped", counts[StatusSkipped],
+		"failed", counts[StatusFailed],
+		"duration", duration,
+	)
+}
+
+// logSkipped logs how many applications were skipped because their source is
+// not supported, for each kind of source, along with their names when names
+// is set.
+func (s *Summary) logSkipped(names bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	skipped := map[string][]string{}
+	for _, app := range s.Apps {
+		if app.Status == StatusSkipped {
+			skipped[app.unsupported] = append(skipped[app.unsupported], app.Name)
+		}
+	}
+
+	kinds := make([]string, 0, len(skipped))
+	for kind := range skipped {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		apps := skipped[kind]
+		msg := fmt.Sprintf("Skipped %d %s apps", len(apps), kind)
+		if !names {
+			slog.Warn(msg)
+			continue
+		}
+		sort.Strings(apps)
+		slog.Warn(msg, "apps", apps)
+	}
+}
+
+// reportProgress logs the progress of the walk recorded in s every interval
+// until the returned function is called.
+func reportProgress(s *Summary, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				s.logProgress()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
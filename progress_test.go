@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportProgress(t *testing.T) {
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	summary := NewSummary()
+	for i := 0; i < 3; i++ {
+		summary.discover()
+	}
+	summary.Add(AppResult{Name: "rendered", Status: StatusRendered})
+	summary.Add(AppResult{Name: "cached", Status: StatusCacheHit})
+
+	stop := reportProgress(summary, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	logged := out.String()
+	if !strings.Contains(logged, "msg=Progress discovered=3 visited=2 rendered=1 cache_hit=1 skipped=0 failed=0") {
+		t.Errorf("expected the progress to be logged got: %s", logged)
+	}
+
+	// Nothing is logged once stopped.
+	out.Reset()
+	time.Sleep(5 * time.Millisecond)
+	if out.Len() != 0 {
+		t.Errorf("expected nothing to be logged after stopping got: %s", out.String())
+	}
+}
+
+func TestLogSkipped(t *testing.T) {
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	summary := NewSummary()
+	summary.logSkipped(true)
+	if out.Len() != 0 {
+		t.Errorf("expected nothing to be logged without skipped apps got: %s", out.String())
+	}
+
+	summary.Add(AppResult{Name: "kustomize-b", Status: StatusSkipped, unsupported: "kustomize"})
+	summary.Add(AppResult{Name: "rendered", Status: StatusRendered})
+	summary.Add(AppResult{Name: "kustomize-a", Status: StatusSkipped, unsupported: "kustomize"})
+	summary.Add(AppResult{Name: "jsonnet", Status: StatusSkipped, unsupported: "config management plugin"})
+
+	summary.logSkipped(false)
+	if logged := out.String(); !strings.Contains(logged, `msg="Skipped 2 kustomize apps"`) || !strings.Contains(logged, `msg="Skipped 1 config management plugin apps"`) || strings.Contains(logged, "apps=") {
+		t.Errorf("expected only the number of skipped apps to be logged got: %s", logged)
+	}
+
+	out.Reset()
+	summary.logSkipped(true)
+	if logged := out.String(); !strings.Contains(logged, `msg="Skipped 2 kustomize apps" apps="[kustomize-a kustomize-b]"`) || !strings.Contains(logged, `msg="Skipped 1 config management plugin apps" apps=[jsonnet]`) {
+		t.Errorf("expected the skipped apps to be listed got: %s", logged)
+	}
+}
+
+func TestLogFinished(t *testing.T) {
+	var out bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	summary := NewSummary()
+	for i := 0; i < 4; i++ {
+		summary.discover()
+	}
+	summary.Add(AppResult{Name: "rendered", Status: StatusRendered})
+	summary.Add(AppResult{Name: "cached", Status: StatusCacheHit})
+	summary.Add(AppResult{Name: "failed", Status: StatusFailed})
+
+	summary.logFinished(3 * time.Second)
+	if logged := out.String(); !strings.Contains(logged, `msg="mani-diffy finished" discovered=4 rendered=1 cache_hit=1 skipped=0 failed=1 duration=3s`) {
+		t.Errorf("expected the totals to be logged got: %s", logged)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chime/mani-diffy/pkg/helm"
+)
+
+// RenderFile renders the applications in file into outputPath like a walk
+// would, but regardless of their hashes and without their descendants, e.g.
+// to debug one that fails. Nothing else is touched: no hash store is read or
+// written and no output is pruned.
+func (w *Walker) RenderFile(ctx context.Context, file, outputPath string) error {
+	crds, err := helm.Read(file)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, crd := range crds {
+		if ctx.Err() != nil {
+			break
+		}
+		if crd.Kind != "Application" {
+			continue
+		}
+		path, err := appOutput(outputPath, crd)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		w.rewritePaths(crd)
+
+		err = w.renderWithTimeout(ctx, crd, path)
+		if _, ok := unsupportedSource(err); ok {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, newRenderError(crd, path, err))
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// printOutput writes every file of the output in dir to out, in lexical order
+// and separated by a comment naming the file, e.g. to print what RenderFile
+// rendered into a temporary directory.
+func printOutput(out io.Writer, dir string) error {
+	files, err := readFiles(dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		content := files[name]
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		if _, err := fmt.Fprintf(out, "---\n# %s\n%s", filepath.ToSlash(name), content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
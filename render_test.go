@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestRenderFile(t *testing.T) {
+	root := t.TempDir()
+	output := filepath.Join(t.TempDir(), "output")
+	writeApplications(t, root, "apps.yaml", "app", "parent")
+
+	renderer := &fakeRenderer{t: t, children: map[string][]string{"parent": {"child"}}}
+	w := &Walker{
+		CopySource: renderer.Render,
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			t.Fatal("expected nothing to be hashed")
+			return "", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+	if err := w.RenderFile(context.Background(), filepath.Join(root, "apps.yaml"), output); err != nil {
+		t.Fatal(err)
+	}
+
+	// The descendants are left out.
+	if expected := []string{"app", "parent"}; !reflect.DeepEqual(renderer.rendered, expected) {
+		t.Errorf("expected %v to be rendered got: %v", expected, renderer.rendered)
+	}
+	if _, err := os.Stat(filepath.Join(output, sumFileName)); err == nil {
+		t.Error("expected no hash to be written")
+	}
+
+	var out strings.Builder
+	if err := printOutput(&out, output); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "---\n# parent/apps.yaml\napiVersion: argoproj.io/v1alpha1\n") || !strings.Contains(out.String(), "name: child\n") {
+		t.Errorf("expected the output of parent to be printed got: %s", out.String())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/chime/mani-diffy/pkg/helm"
+	"github.com/chime/mani-diffy/pkg/kustomize"
+	"github.com/chime/mani-diffy/pkg/plugin"
+)
+
+// SourceRenderer renders the applications Match reports true for, e.g. the
+// ones using an in-house source type.
+type SourceRenderer struct {
+	Match  func(*v1alpha1.Application) bool
+	Render Renderer
+}
+
+// renderer returns the renderer of application: the first of Renderers
+// matching it, or else the first built-in one, which always matches.
+func (w *Walker) renderer(application *v1alpha1.Application) Renderer {
+	// Appending to Renderers itself could write to the caller's array,
+	// which concurrent renders share.
+	builtin := w.builtinRenderers()
+	rs := make([]SourceRenderer, 0, len(w.Renderers)+len(builtin))
+	rs = append(rs, w.Renderers...)
+	rs = append(rs, builtin...)
+	for _, r := range rs {
+		if r.Match(application) {
+			return r.Render
+		}
+	}
+	return nil
+}
+
+// builtinRenderers are the renderers of the sources supported out of the box,
+// in order: multiple sources, Helm, the unsupported Kustomize and plugin
+// sources, and copying any other source as is.
+func (w *Walker) builtinRenderers() []SourceRenderer {
+	return []SourceRenderer{
+		{
+			Match: func(application *v1alpha1.Application) bool {
+				return application.Spec.HasMultipleSources()
+			},
+			Render: w.renderSources,
+		},
+		{
+			Match: func(application *v1alpha1.Application) bool {
+				// Remote charts need no helm block.
+				return helm.IsHelm(application.Spec.Source)
+			},
+			Render: w.HelmTemplate,
+		},
+		{
+			Match: func(application *v1alpha1.Application) bool {
+				return application.Spec.Source.Kustomize != nil
+			},
+			Render: func(_ context.Context, application *v1alpha1.Application, _ string) error {
+				slog.Warn("kustomize not supported", "app", application.ObjectMeta.Name)
+				return kustomize.ErrNotSupported
+			},
+		},
+		{
+			Match: func(application *v1alpha1.Application) bool {
+				return application.Spec.Source.Plugin != nil
+			},
+			Render: func(_ context.Context, application *v1alpha1.Application, _ string) error {
+				// Copying the source would pass it off as the rendered
+				// output.
+				return pluginError(application, application.Spec.Source)
+			},
+		},
+		{
+			Match: func(*v1alpha1.Application) bool {
+				return true
+			},
+			Render: w.CopySource,
+		},
+	}
+}
+
+// unsupportedSource returns the kind of source err reports as not supported,
+// if any. The applications using one are skipped instead of failing the run,
+// whichever renderer they matched.
+func unsupportedSource(err error) (string, bool) {
+	switch {
+	case errors.Is(err, kustomize.ErrNotSupported):
+		return "kustomize", true
+	case errors.Is(err, plugin.ErrNotSupported):
+		return "config management plugin", true
+	}
+	return "", false
+}
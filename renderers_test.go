@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestWalkRenderers(t *testing.T) {
+	root := t.TempDir()
+	apps := `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: jsonnet-app
+spec:
+  source:
+    path: jsonnet/app
+    plugin:
+      name: jsonnet
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: helm-app
+spec:
+  source:
+    path: charts/app
+    helm: {}
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: remote-app
+spec:
+  source:
+    repoURL: https://charts.example.com
+    chart: app
+    targetRevision: 1.2.3
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: plain-app
+spec:
+  source:
+    path: manifests/app
+`
+	if err := os.WriteFile(filepath.Join(root, "apps.yaml"), []byte(apps), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var rendered []string
+	renderer := func(kind string) Renderer {
+		return func(_ context.Context, application *v1alpha1.Application, output string) error {
+			rendered = append(rendered, kind+":"+application.ObjectMeta.Name)
+			return os.MkdirAll(output, os.ModePerm)
+		}
+	}
+	w := &Walker{
+		CopySource:   renderer("copy"),
+		HelmTemplate: renderer("helm"),
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		Renderers: []SourceRenderer{
+			{
+				Match: func(application *v1alpha1.Application) bool {
+					plugin := application.Spec.Source.Plugin
+					return plugin != nil && plugin.Name == "jsonnet"
+				},
+				Render: renderer("jsonnet"),
+			},
+			{
+				// Registered after the jsonnet renderer, so it only
+				// gets the apps that one doesn't match.
+				Match: func(application *v1alpha1.Application) bool {
+					return application.Spec.Source.Plugin != nil
+				},
+				Render: renderer("other-plugin"),
+			},
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	if _, err := w.Walk(context.Background(), root, t.TempDir(), InfiniteDepth, NewMemoryHashStore()); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"jsonnet:jsonnet-app", "helm:helm-app", "helm:remote-app", "copy:plain-app"}; !reflect.DeepEqual(rendered, expected) {
+		t.Errorf("expected %v got: %v", expected, rendered)
+	}
+}
+
+func TestRendererKeepsRenderers(t *testing.T) {
+	// Spare capacity a plain append would write the built-in renderers to.
+	renderers := make([]SourceRenderer, 1, 8)
+	renderers[0] = SourceRenderer{
+		Match: func(*v1alpha1.Application) bool {
+			return false
+		},
+	}
+	w := &Walker{Renderers: renderers}
+
+	application := &v1alpha1.Application{Spec: v1alpha1.ApplicationSpec{Source: &v1alpha1.ApplicationSource{Path: "manifests/app"}}}
+	w.renderer(application)
+	if spare := renderers[:2][1]; spare.Match != nil || spare.Render != nil {
+		t.Error("expected the caller's renderers not to be written to")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+// pathRewrite replaces the matches of pattern in the source paths of the
+// applications with replacement, which may refer to the groups of pattern
+// like regexp.ReplaceAllString.
+type pathRewrite struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// parsePathRewrite parses a `<regexp>=<replacement>` rewrite, split on the
+// first `=`.
+func parsePathRewrite(s string) (pathRewrite, error) {
+	pattern, replacement, ok := strings.Cut(s, "=")
+	if !ok {
+		return pathRewrite{}, fmt.Errorf("invalid path rewrite %q, must be <regexp>=<replacement>", s)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return pathRewrite{}, fmt.Errorf("invalid path rewrite %q: %w", s, err)
+	}
+	return pathRewrite{pattern: re, replacement: replacement}, nil
+}
+
+// rewritePaths applies the path rewrites, in order, to the path of every
+// source of crd, before anything reads them.
+func (w *Walker) rewritePaths(crd *v1alpha1.Application) {
+	if len(w.pathRewrites) == 0 {
+		return
+	}
+	rewrite := func(source *v1alpha1.ApplicationSource) {
+		if source == nil || source.Path == "" {
+			return
+		}
+		for _, r := range w.pathRewrites {
+			source.Path = r.pattern.ReplaceAllString(source.Path, r.replacement)
+		}
+	}
+	rewrite(crd.Spec.Source)
+	for i := range crd.Spec.Sources {
+		rewrite(&crd.Spec.Sources[i])
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestWalkPathRewrite(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	apps := testApplication + `---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: multi-source-app
+spec:
+  sources:
+    - path: charts/first
+    - repoURL: https://charts.example.com
+      chart: remote
+`
+	if err := os.WriteFile(filepath.Join(root, "apps.yaml"), []byte(apps), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var hashed, rendered []string
+	render := func(_ context.Context, application *v1alpha1.Application, _ string) error {
+		if application.Spec.Source != nil {
+			rendered = append(rendered, application.Spec.Source.Path)
+		}
+		return nil
+	}
+	w := &Walker{
+		CopySource:   render,
+		HelmTemplate: render,
+		GenerateHash: func(_ context.Context, application *v1alpha1.Application) (string, error) {
+			if application.Spec.Source != nil {
+				hashed = append(hashed, application.Spec.Source.Path)
+			}
+			for _, source := range application.Spec.Sources {
+				hashed = append(hashed, source.Path)
+			}
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+	for _, rewrite := range []string{"^charts/=vendor/charts/", `/(test-app)$=/$1-v2`} {
+		r, err := parsePathRewrite(rewrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.pathRewrites = append(w.pathRewrites, r)
+	}
+
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, NewMemoryHashStore()); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"vendor/charts/test-app-v2", "vendor/charts/first", ""}
+	if len(hashed) != len(expected) {
+		t.Fatalf("expected %v to be hashed got: %v", expected, hashed)
+	}
+	for i := range expected {
+		if hashed[i] != expected[i] {
+			t.Errorf("expected %v to be hashed got: %v", expected, hashed)
+		}
+	}
+	if len(rendered) != 2 || rendered[0] != "vendor/charts/test-app-v2" || rendered[1] != "vendor/charts/first" {
+		t.Errorf("expected the rewritten path to be rendered got: %v", rendered)
+	}
+
+	for _, rewrite := range []string{"vendor", "(=src"} {
+		if _, err := parsePathRewrite(rewrite); err == nil {
+			t.Errorf("expected %q to be an invalid rewrite", rewrite)
+		}
+	}
+}
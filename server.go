@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long Serve waits for in-flight renders to finish
+// before giving up on a graceful shutdown.
+const shutdownTimeout = 5 * time.Minute
+
+// Server exposes the walk pipeline over HTTP so renders can be triggered by
+// webhooks.
+type Server struct {
+	// Run renders the tree once. It is called for every render request.
+	Run func() (*Summary, error)
+
+	// mu serializes renders, so overlapping requests queue up behind the
+	// render that is in progress.
+	mu sync.Mutex
+}
+
+// Handler returns the HTTP handler serving `/render` and `/healthz`.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/render", s.render)
+	return mux
+}
+
+func (s *Server) healthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (s *Server) render(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary, err := s.Run()
+	if summary == nil {
+		// The run failed before the walk started.
+		summary = NewSummary()
+		summary.Finish(err)
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		slog.Error("Render failed", "error", err)
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		slog.Error("Unable to write render summary", "error", err)
+	}
+}
+
+// Serve listens on addr until the process receives SIGINT or SIGTERM, then
+// waits for any in-flight render to finish before returning.
+func Serve(addr string, s *Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		slog.Info("Listening", "addr", addr)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
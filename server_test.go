@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestServerRender(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "app.yaml"), []byte(testApplication), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var rendered []string
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			rendered = append(rendered, application.ObjectMeta.Name)
+			if err := os.MkdirAll(output, os.ModePerm); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte("kind: ConfigMap\n"), 0644)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	s := &Server{
+		Run: func() (*Summary, error) {
+			h, err := NewJSONHashStore(filepath.Join(output, "hashes.json"), HashStrategyReadWrite)
+			if err != nil {
+				return nil, err
+			}
+			return w.Walk(context.Background(), root, output, InfiniteDepth, h)
+		},
+	}
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/render", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code got: %d wanted: %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var summary Summary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Error != "" {
+		t.Errorf("unexpected error in summary: %s", summary.Error)
+	}
+	if len(summary.Apps) != 1 || summary.Apps[0].Status != StatusRendered {
+		t.Errorf("unexpected apps in summary: %+v", summary.Apps)
+	}
+	if len(rendered) != 1 || rendered[0] != "test-app" {
+		t.Errorf("unexpected renders got: %v wanted: [test-app]", rendered)
+	}
+	if _, err := os.Stat(filepath.Join(output, "test-app", "manifest.yaml")); err != nil {
+		t.Errorf("expected manifest to be rendered: %v", err)
+	}
+}
+
+func TestServerMethods(t *testing.T) {
+	s := &Server{Run: func() (*Summary, error) { return NewSummary(), nil }}
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /render got: %d wanted: %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	resp, err = http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz got: %d wanted: %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestServerSerializesRenders(t *testing.T) {
+	var running, overlapped int32
+	s := &Server{
+		Run: func() (*Summary, error) {
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.StoreInt32(&overlapped, 1)
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return NewSummary(), nil
+		},
+	}
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(srv.URL+"/render", "application/json", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if overlapped != 0 {
+		t.Error("expected renders to be serialized")
+	}
+}
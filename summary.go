@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chime/mani-diffy/pkg/helm"
+)
+
+const (
+	StatusRendered = "rendered"
+	StatusCacheHit = "cache-hit"
+	StatusSkipped  = "skipped"
+	StatusFailed   = "failed"
+)
+
+// AppResult records what happened to a single Argo application during a walk.
+type AppResult struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Hash     string `json:"hash,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// Warnings are the warnings helm printed while rendering, when they
+	// are collected.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Resources is the number of resources in the output and Bytes the
+	// uncompressed size of its manifests. Both are left out when the
+	// output wasn't measured, and Resources when a manifest couldn't be
+	// parsed.
+	Resources *int   `json:"resources,omitempty"`
+	Bytes     *int64 `json:"bytes,omitempty"`
+
+	// duration is how long rendering took, kept so it can be reported as a
+	// metric.
+	duration time.Duration
+
+	// unsupported is the kind of source a skipped application uses, e.g.
+	// kustomize.
+	unsupported string
+}
+
+// Summary is a machine readable report of a single run of the walker. It is
+// safe for concurrent use.
+type Summary struct {
+	Duration string      `json:"duration"`
+	Error    string      `json:"error,omitempty"`
+	Apps     []AppResult `json:"apps"`
+
+	mu       sync.Mutex
+	start    time.Time
+	duration time.Duration
+
+	// discovered counts the applications found so far, including the ones
+	// that have no result yet.
+	discovered int
+}
+
+func NewSummary() *Summary {
+	return &Summary{
+		Apps:  []AppResult{},
+		start: time.Now(),
+	}
+}
+
+// Add records the result for an application.
+func (s *Summary) Add(result AppResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Apps = append(s.Apps, result)
+}
+
+// Finish records how long the run took and the error it ended with, if any.
+func (s *Summary) Finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.duration = time.Since(s.start)
+	s.Duration = s.duration.String()
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// Write stores the summary as JSON in the file at path.
+func (s *Summary) Write(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0644)
+}
+
+// measureOutput records in result the number of resources and the size of
+// the manifests in path, the output of its application. A manifest that
+// can't be parsed leaves the number of resources unknown instead of failing
+// the walk.
+func (w *Walker) measureOutput(result *AppResult, path string) {
+	var size int64
+	resources := 0
+	parsed := true
+	err := filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !w.isManifest(d) {
+			return err
+		}
+		b, err := helm.ReadManifest(file)
+		if err != nil {
+			return err
+		}
+		size += int64(len(b))
+		count, err := helm.CountResources(b)
+		if err != nil {
+			slog.Debug("Unable to count the resources", "app", result.Name, "path", file, "error", err)
+			parsed = false
+		}
+		resources += count
+		return nil
+	})
+	if err != nil {
+		slog.Debug("Unable to measure the output", "app", result.Name, "error", err)
+		return
+	}
+	result.Bytes = &size
+	if parsed {
+		result.Resources = &resources
+	}
+}
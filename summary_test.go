@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestWalkSummary(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "app.yaml"), []byte(testApplication), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	renderErr := error(nil)
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			if renderErr != nil {
+				return renderErr
+			}
+			if err := os.MkdirAll(output, os.ModePerm); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte("kind: ConfigMap\n"), 0644)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	hashes := filepath.Join(output, "hashes.json")
+	walk := func() (*Summary, error) {
+		h, err := NewJSONHashStore(hashes, HashStrategyReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Walk(context.Background(), root, output, InfiniteDepth, h)
+	}
+
+	summary, err := walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Apps) != 1 || summary.Apps[0].Status != StatusRendered || summary.Apps[0].Hash != "hash" {
+		t.Errorf("expected the first run to render got: %+v", summary.Apps)
+	}
+
+	summary, err = walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Apps) != 1 || summary.Apps[0].Status != StatusCacheHit {
+		t.Errorf("expected the second run to hit the cache got: %+v", summary.Apps)
+	}
+
+	// Force a render that fails and make sure the summary still records it.
+	if err := os.Remove(hashes); err != nil {
+		t.Fatal(err)
+	}
+	renderErr = errors.New("boom")
+	summary, err = walk()
+	if err == nil {
+		t.Fatal("expected the walk to fail")
+	}
+	if len(summary.Apps) != 1 || summary.Apps[0].Status != StatusFailed || summary.Apps[0].Error != "boom" {
+		t.Errorf("expected the failure to be recorded got: %+v", summary.Apps)
+	}
+
+	path := filepath.Join(t.TempDir(), "summary.json")
+	if err := summary.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written Summary
+	if err := json.Unmarshal(b, &written); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(written.Error, "boom") || len(written.Apps) != 1 {
+		t.Errorf("unexpected summary written: %s", b)
+	}
+}
+
+func TestWalkSummaryResources(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "configs", "malformed")
+
+	manifests := map[string]string{
+		"configs":   "kind: ConfigMap\nmetadata:\n  name: a\n---\n# Gated by a condition\n---\nkind: ConfigMap\nmetadata:\n  name: b\n",
+		"malformed": "kind: ConfigMap\n---\nkind: [\n",
+	}
+	w := &Walker{
+		CopySource: func(_ context.Context, application *v1alpha1.Application, output string) error {
+			if err := os.MkdirAll(output, os.ModePerm); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte(manifests[application.ObjectMeta.Name]), 0644)
+		},
+		GenerateHash: func(context.Context, *v1alpha1.Application) (string, error) {
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+	}
+
+	hashes := NewMemoryHashStore()
+	for _, status := range []string{StatusRendered, StatusCacheHit} {
+		// The walk stops before reading the malformed output as
+		// applications.
+		summary, err := w.Walk(context.Background(), root, output, 0, hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(summary.Apps) != 2 {
+			t.Fatalf("expected both apps in the summary got: %+v", summary.Apps)
+		}
+
+		configs, malformed := summary.Apps[0], summary.Apps[1]
+		if configs.Status != status || configs.Resources == nil || *configs.Resources != 2 {
+			t.Errorf("expected the %s app to have 2 resources got: %+v", status, configs)
+		}
+		if configs.Bytes == nil || *configs.Bytes != int64(len(manifests["configs"])) {
+			t.Errorf("expected the size of the manifest of the %s app got: %+v", status, configs)
+		}
+		if malformed.Status != status || malformed.Resources != nil || malformed.Bytes == nil {
+			t.Errorf("expected the resources of the malformed %s app to be unknown got: %+v", status, malformed)
+		}
+	}
+}
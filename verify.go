@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+	"github.com/chime/mani-diffy/pkg/applicationset"
+	"github.com/chime/mani-diffy/pkg/helm"
+)
+
+// Mismatch is an application whose committed output can't be trusted, and
+// why.
+type Mismatch struct {
+	App    string
+	Reason string
+}
+
+// outputDigest returns the digest of the files in path, the output of an
+// application, like it's recorded in the digests of a walk. The hash.sum of
+// the sumfile hash store isn't part of the output.
+func outputDigest(path string) (string, error) {
+	files, err := readFiles(path)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		sum := sha256.Sum256([]byte(files[name]))
+		fmt.Fprintf(h, "%x  %s\n", sum, filepath.ToSlash(name))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordDigest records the digest of the output of the application name,
+// just rendered into path, when digests are kept.
+func (w *Walker) recordDigest(name, path string) error {
+	if w.digests == nil {
+		return nil
+	}
+	digest, err := outputDigest(path)
+	if err != nil {
+		return err
+	}
+	return w.digests.Add(name, digest)
+}
+
+// Verify checks the committed output of every application in the tree rooted
+// at inputPath without rendering anything: the hash recorded in hashes must
+// still be the one of the application's inputs, and the digest of its output
+// the one recorded when it was rendered. It returns every application that
+// fails either check, e.g. because its output was edited by hand.
+func (w *Walker) Verify(ctx context.Context, inputPath, outputPath string, maxDepth int, hashes HashStore) ([]Mismatch, error) {
+	if w.digests == nil {
+		return nil, errors.New("verifying the output needs the digests recorded with -output-digests")
+	}
+	var mismatches []Mismatch
+	errs := w.verify(ctx, inputPath, outputPath, 0, maxDepth, hashes, &mismatches)
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return mismatches, errors.Join(errs...)
+}
+
+func (w *Walker) verify(ctx context.Context, inputPath, outputPath string, depth, maxDepth int, hashes HashStore, mismatches *[]Mismatch) []error {
+	if maxDepth != InfiniteDepth && depth > maxDepth {
+		return nil
+	}
+	if _, err := os.Stat(inputPath); errors.Is(err, fs.ErrNotExist) && depth > 0 {
+		// The application has no output to look for descendants in,
+		// which is reported as a mismatch of the application itself.
+		return nil
+	}
+
+	sources, err := w.manifestFiles(inputPath, outputPath)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, source := range sources {
+		crds, appSets, err := helm.ReadAll(source)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, appSet := range appSets {
+			apps, err := applicationset.Expand(appSet)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			crds = append(crds, apps...)
+		}
+		for _, crd := range crds {
+			if ctx.Err() != nil {
+				return errs
+			}
+			if crd.Kind != "Application" || strings.HasSuffix(crd.ObjectMeta.Name, w.ignoreSuffix) || w.ignored(crd.ObjectMeta.Name) || w.skipped(crd) {
+				continue
+			}
+			path, err := appOutput(outputPath, crd)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", source, err))
+				continue
+			}
+			w.rewritePaths(crd)
+
+			mismatch, err := w.verifyApp(ctx, crd, path, hashes)
+			if _, ok := unsupportedSource(err); ok {
+				continue
+			}
+			switch {
+			case err != nil:
+				errs = append(errs, fmt.Errorf("%s: %w", path, err))
+				continue
+			case mismatch != "":
+				*mismatches = append(*mismatches, Mismatch{App: crd.ObjectMeta.Name, Reason: mismatch})
+			}
+			errs = append(errs, w.verify(ctx, path, outputPath, depth+1, maxDepth, hashes, mismatches)...)
+		}
+	}
+	return errs
+}
+
+// verifyApp returns why the output of crd in path can't be trusted, or an
+// empty string when it matches both its inputs and its recorded digest.
+func (w *Walker) verifyApp(ctx context.Context, crd *v1alpha1.Application, path string, hashes HashStore) (string, error) {
+	name := crd.ObjectMeta.Name
+	expected, err := w.GenerateHash(ctx, crd)
+	if err != nil {
+		return "", err
+	}
+	stored, err := hashes.Get(name)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case stored == "":
+		return "no hash is recorded for the application", nil
+	case stored != expected:
+		return "the inputs of the application changed since its output was rendered", nil
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return "the output of the application is missing", nil
+	}
+	recorded, err := w.digests.Get(name)
+	if err != nil {
+		return "", err
+	}
+	actual, err := outputDigest(path)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case recorded == "":
+		return "no digest is recorded for the output of the application", nil
+	case recorded != actual:
+		return "the output of the application was changed after it was rendered", nil
+	}
+	return "", nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/argoproj/argo-cd/v2/pkg/apis/application/v1alpha1"
+)
+
+func TestVerify(t *testing.T) {
+	root := t.TempDir()
+	output := t.TempDir()
+	writeApplications(t, root, "apps.yaml", "parent", "other")
+
+	digests, err := NewConsolidatedSumFileStore(filepath.Join(output, "digests.sum"), HashStrategyReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := &fakeRenderer{t: t, children: map[string][]string{"parent": {"child"}}}
+	hashOf := map[string]string{}
+	w := &Walker{
+		CopySource: func(ctx context.Context, application *v1alpha1.Application, output string) error {
+			if err := render.Render(ctx, application, output); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(output, "manifest.yaml"), []byte("kind: ConfigMap\n"), 0644)
+		},
+		GenerateHash: func(_ context.Context, application *v1alpha1.Application) (string, error) {
+			if hash, ok := hashOf[application.ObjectMeta.Name]; ok {
+				return hash, nil
+			}
+			return "hash", nil
+		},
+		ignoreSuffix: "-ignore",
+		digests:      digests,
+	}
+	hashes := NewMemoryHashStore()
+	if _, err := w.Walk(context.Background(), root, output, InfiniteDepth, hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func() []Mismatch {
+		t.Helper()
+		// Read the digests back, like a later run would.
+		if w.digests, err = NewConsolidatedSumFileStore(filepath.Join(output, "digests.sum"), HashStrategyRead); err != nil {
+			t.Fatal(err)
+		}
+		mismatches, err := w.Verify(context.Background(), root, output, InfiniteDepth, hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mismatches
+	}
+
+	if mismatches := verify(); len(mismatches) != 0 {
+		t.Errorf("expected the rendered output to match got: %v", mismatches)
+	}
+
+	if err := os.WriteFile(filepath.Join(output, "child", "manifest.yaml"), []byte("kind: Secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hashOf["other"] = "new-hash"
+	expected := []Mismatch{
+		{App: "child", Reason: "the output of the application was changed after it was rendered"},
+		{App: "other", Reason: "the inputs of the application changed since its output was rendered"},
+	}
+	if mismatches := verify(); !reflect.DeepEqual(mismatches, expected) {
+		t.Errorf("expected %v got: %v", expected, mismatches)
+	}
+
+	if err := os.RemoveAll(filepath.Join(output, "child")); err != nil {
+		t.Fatal(err)
+	}
+	delete(hashOf, "other")
+	expected = []Mismatch{{App: "child", Reason: "the output of the application is missing"}}
+	if mismatches := verify(); !reflect.DeepEqual(mismatches, expected) {
+		t.Errorf("expected %v got: %v", expected, mismatches)
+	}
+
+	w.digests = nil
+	if _, err := w.Verify(context.Background(), root, output, InfiniteDepth, hashes); err == nil {
+		t.Error("expected verifying without digests to fail")
+	}
+}